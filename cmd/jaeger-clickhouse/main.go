@@ -2,9 +2,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"path/filepath"
+	"strings"
 
 	// Package contains time zone info for connecting to ClickHouse servers with non-UTC time zone
 	_ "time/tzdata"
@@ -13,14 +16,24 @@ import (
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	yaml "gopkg.in/yaml.v3"
 
 	"github.com/jaegertracing/jaeger-clickhouse/storage"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		}
+	}
+
 	var configPath string
+	var renderSchema bool
 	flag.StringVar(&configPath, "config", "", "The absolute path to the ClickHouse plugin's configuration file")
+	flag.BoolVar(&renderSchema, "render-schema", false, "Print the SQL statements creating the tables for the given configuration and exit, without connecting to ClickHouse")
 	flag.Parse()
 
 	logger := hclog.New(&hclog.LoggerOptions{
@@ -36,15 +49,37 @@ func main() {
 		logger.Error("Could not read config file", "config", configPath, "error", err)
 		os.Exit(1)
 	}
-	var cfg storage.Configuration
-	err = yaml.Unmarshal(cfgFile, &cfg)
+	cfg, err := storage.ParseConfiguration(cfgFile, os.LookupEnv)
 	if err != nil {
 		logger.Error("Could not parse config file", "error", err)
+		os.Exit(1)
+	}
+	if renderSchema {
+		// The schema is rendered offline, so the connection settings do not need to be valid
+		if err := cfg.ValidateSchema(); err != nil {
+			logger.Error("Invalid config file", "error", err)
+			os.Exit(1)
+		}
+		for _, statement := range storage.RenderSchema(cfg) {
+			fmt.Printf("%s;\n\n", strings.TrimSpace(statement))
+		}
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		logger.Error("Invalid config file", "error", err)
+		os.Exit(1)
 	}
+	logger.SetLevel(cfg.GetLogLevel())
 
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		err = http.ListenAndServe(cfg.MetricsEndpoint, nil)
+		err = http.ListenAndServe(cfg.MetricsEndpoint, mux)
 		if err != nil {
 			logger.Error("Failed to listen for metrics endpoint", "error", err)
 		}
@@ -56,11 +91,17 @@ func main() {
 		logger.Error("Failed to create a storage", err)
 		os.Exit(1)
 	}
+	// Until the store is created, e.g. while tables are initialized, these are not found and probes fail
+	mux.Handle("/health", store.HealthHandler())
+	mux.Handle("/ready", store.ReadyHandler())
+	mux.Handle("/debug/config", store.ConfigHandler())
 	pluginServices.Store = store
 	pluginServices.ArchiveStore = store
 	pluginServices.StreamingSpanWriter = store
+	stopWatching := watchConfig(logger, configPath, store)
 
 	grpc.Serve(&pluginServices)
+	stopWatching()
 	if err = store.Close(); err != nil {
 		logger.Error("Failed to close store", "error", err)
 		os.Exit(1)
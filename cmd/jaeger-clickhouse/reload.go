@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage"
+)
+
+// configPollInterval is the interval in which the config file is checked for changes
+var configPollInterval = 5 * time.Second
+
+// configReloader applies a configuration while the plugin is running, as *storage.Store does
+type configReloader interface {
+	Reload(cfg storage.Configuration) error
+}
+
+// watchConfig reloads the configuration of store when the config file changes or the plugin receives SIGHUP,
+// until the returned function is called
+func watchConfig(logger hclog.Logger, configPath string, store configReloader) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	finish := make(chan bool)
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		modTime := configModTime(configPath)
+		for {
+			select {
+			case <-ticker.C:
+				current := configModTime(configPath)
+				// The file may be missing for a moment while it is replaced
+				if current.IsZero() || current.Equal(modTime) {
+					continue
+				}
+				modTime = current
+				logger.Info("Reloading changed config file", "config", configPath)
+			case <-signals:
+				logger.Info("Reloading config file on SIGHUP", "config", configPath)
+			case <-finish:
+				return
+			}
+			cfg, err := loadConfig(configPath)
+			if err == nil {
+				err = store.Reload(cfg)
+			}
+			if err != nil {
+				logger.Error("Could not reload config file, keeping the previous configuration", "config", configPath, "error", err)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(finish)
+		<-done
+	}
+}
+
+// configModTime returns the modification time of the config file, or the zero time if it cannot be read
+func configModTime(configPath string) time.Time {
+	info, err := os.Stat(filepath.Clean(configPath))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
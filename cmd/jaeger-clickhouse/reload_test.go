@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage"
+)
+
+type reloadRecorder struct {
+	configs chan storage.Configuration
+}
+
+func (r *reloadRecorder) Reload(cfg storage.Configuration) error {
+	r.configs <- cfg
+	return nil
+}
+
+func TestWatchConfig(t *testing.T) {
+	interval := configPollInterval
+	configPollInterval = 10 * time.Millisecond
+	defer func() { configPollInterval = interval }()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("address: clickhouse:9000\n"), 0o600))
+	recorder := &reloadRecorder{configs: make(chan storage.Configuration, 1)}
+	stopWatching := watchConfig(hclog.NewNullLogger(), configPath, recorder)
+	defer stopWatching()
+
+	// Reloaded on SIGHUP, even though the file did not change
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Equal(t, "clickhouse:9000", receiveConfig(t, recorder).Address)
+
+	// Reloaded when the file changes
+	require.NoError(t, os.WriteFile(configPath, []byte("address: other:9000\n"), 0o600))
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(configPath, modTime, modTime))
+	assert.Equal(t, "other:9000", receiveConfig(t, recorder).Address)
+
+	// Files which can not be parsed are not applied
+	require.NoError(t, os.WriteFile(configPath, []byte("address: [\n"), 0o600))
+	modTime = modTime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(configPath, modTime, modTime))
+	select {
+	case cfg := <-recorder.configs:
+		t.Fatalf("invalid config file was applied: %+v", cfg)
+	case <-time.After(10 * configPollInterval):
+	}
+}
+
+func receiveConfig(t *testing.T, recorder *reloadRecorder) storage.Configuration {
+	select {
+	case cfg := <-recorder.configs:
+		return cfg
+	case <-time.After(time.Second):
+		t.Fatal("config was not reloaded")
+		return storage.Configuration{}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/traceio"
+)
+
+// listFlag collects the values of a flag which can be repeated or given as a comma separated list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func newCommandLogger() hclog.Logger {
+	return hclog.New(&hclog.LoggerOptions{
+		Name:   "jaeger-clickhouse",
+		Level:  hclog.Info,
+		Output: os.Stderr,
+	})
+}
+
+// runExport implements the "export" subcommand, writing traces from ClickHouse to a file.
+func runExport(args []string) int {
+	var (
+		configPath, formatName, outputPath, service, operation, start, end string
+		archive                                                            bool
+		lookback, minDuration, maxDuration                                 time.Duration
+		limit                                                              int
+		traceIDs, tags                                                     listFlag
+	)
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "The absolute path to the ClickHouse plugin's configuration file")
+	flags.BoolVar(&archive, "archive", false, "Read traces from the archive table")
+	flags.StringVar(&formatName, "format", string(traceio.FormatJaegerJSON), "Output format, either jaeger or otlp")
+	flags.StringVar(&outputPath, "output", "-", "Output file, - for stdout")
+	flags.Var(&traceIDs, "trace-id", "Trace ID to export, can be repeated. If set, search flags are ignored")
+	flags.StringVar(&service, "service", "", "Service name to search traces for")
+	flags.StringVar(&operation, "operation", "", "Operation name to search traces for")
+	flags.Var(&tags, "tag", "Tag to search traces for as key=value, can be repeated")
+	flags.StringVar(&start, "start", "", "Start of the search range in RFC3339 format. Default is now minus lookback")
+	flags.StringVar(&end, "end", "", "End of the search range in RFC3339 format. Default is now")
+	flags.DurationVar(&lookback, "lookback", time.Hour, "Length of the search range if start is not set")
+	flags.DurationVar(&minDuration, "min-duration", 0, "Minimal duration of searched spans")
+	flags.DurationVar(&maxDuration, "max-duration", 0, "Maximal duration of searched spans")
+	flags.IntVar(&limit, "limit", 20, "Maximal number of searched traces")
+	_ = flags.Parse(args)
+
+	logger := newCommandLogger()
+	format, err := traceio.ParseFormat(formatName)
+	if err != nil {
+		logger.Error("Invalid format", "error", err)
+		return 2
+	}
+
+	var query *spanstore.TraceQueryParameters
+	ids := make([]model.TraceID, 0, len(traceIDs))
+	for _, traceID := range traceIDs {
+		id, err := model.TraceIDFromString(traceID)
+		if err != nil {
+			logger.Error("Invalid trace ID", "trace_id", traceID, "error", err)
+			return 2
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		if query, err = buildQuery(service, operation, start, end, lookback, minDuration, maxDuration, limit, tags); err != nil {
+			logger.Error("Invalid search parameters", "error", err)
+			return 2
+		}
+	}
+
+	store, ok := openStore(logger, configPath, storage.NewReadOnlyStore)
+	if !ok {
+		return 1
+	}
+	defer store.Close()
+	reader := store.SpanReader()
+	if archive {
+		reader = store.ArchiveSpanReader()
+	}
+
+	out := io.Writer(os.Stdout)
+	if outputPath != "-" {
+		file, err := os.Create(filepath.Clean(outputPath))
+		if err != nil {
+			logger.Error("Could not create output file", "output", outputPath, "error", err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	var exported int
+	if query == nil {
+		exported, err = traceio.ExportTraceIDs(context.Background(), reader, ids, out, format)
+	} else {
+		exported, err = traceio.ExportQuery(context.Background(), reader, query, out, format)
+	}
+	if err != nil {
+		logger.Error("Could not export traces", "error", err)
+		return 1
+	}
+	logger.Info("Exported traces", "traces", exported, "format", format)
+	return 0
+}
+
+func buildQuery(
+	service, operation, start, end string,
+	lookback, minDuration, maxDuration time.Duration,
+	limit int,
+	tags []string,
+) (*spanstore.TraceQueryParameters, error) {
+	if service == "" {
+		return nil, fmt.Errorf("either trace-id or service is required")
+	}
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:   service,
+		OperationName: operation,
+		Tags:          make(map[string]string, len(tags)),
+		StartTimeMax:  time.Now(),
+		DurationMin:   minDuration,
+		DurationMax:   maxDuration,
+		NumTraces:     limit,
+	}
+	var err error
+	if end != "" {
+		if query.StartTimeMax, err = time.Parse(time.RFC3339, end); err != nil {
+			return nil, fmt.Errorf("invalid end: %w", err)
+		}
+	}
+	query.StartTimeMin = query.StartTimeMax.Add(-lookback)
+	if start != "" {
+		if query.StartTimeMin, err = time.Parse(time.RFC3339, start); err != nil {
+			return nil, fmt.Errorf("invalid start: %w", err)
+		}
+	}
+	for _, tag := range tags {
+		key, value, found := strings.Cut(tag, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid tag %q, expected key=value", tag)
+		}
+		query.Tags[key] = value
+	}
+	return query, nil
+}
+
+// runImport implements the "import" subcommand, writing traces from files to ClickHouse.
+func runImport(args []string) int {
+	var (
+		configPath, formatName string
+		archive                bool
+	)
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [flags] file...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&configPath, "config", "", "The absolute path to the ClickHouse plugin's configuration file")
+	flags.BoolVar(&archive, "archive", false, "Write traces to the archive table")
+	flags.StringVar(&formatName, "format", string(traceio.FormatJaegerJSON), "Input format, either jaeger or otlp")
+	_ = flags.Parse(args)
+
+	logger := newCommandLogger()
+	format, err := traceio.ParseFormat(formatName)
+	if err != nil {
+		logger.Error("Invalid format", "error", err)
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	store, ok := openStore(logger, configPath, storage.NewStore)
+	if !ok {
+		return 1
+	}
+	defer store.Close()
+	// Imported spans are written synchronously, so failed writes are reported rather than dropped
+	writer, err := store.ImportSpanWriter(archive)
+	if err != nil {
+		logger.Error("Could not create the span writer", "error", err)
+		return 1
+	}
+
+	imported := 0
+	failed := false
+	for _, inputPath := range flags.Args() {
+		count, err := importFile(writer, inputPath, format)
+		imported += count
+		if err != nil {
+			logger.Error("Could not import traces", "input", inputPath, "error", err)
+			failed = true
+		}
+	}
+	// Write the spans of the last batch
+	if err := writer.Close(); err != nil {
+		logger.Error("Could not write spans", "error", err)
+		return 1
+	}
+	logger.Info("Imported spans", "spans", imported, "format", format)
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func importFile(writer spanstore.Writer, inputPath string, format traceio.Format) (int, error) {
+	in := io.Reader(os.Stdin)
+	if inputPath != "-" {
+		file, err := os.Open(filepath.Clean(inputPath))
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		in = file
+	}
+	return traceio.Import(context.Background(), in, format, writer)
+}
+
+// openStore loads the configuration and opens the store with newStore
+func openStore(
+	logger hclog.Logger,
+	configPath string,
+	newStore func(hclog.Logger, storage.Configuration) (*storage.Store, error),
+) (*storage.Store, bool) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		logger.Error("Could not load config file", "config", configPath, "error", err)
+		return nil, false
+	}
+	store, err := newStore(logger, cfg)
+	if err != nil {
+		logger.Error("Failed to create a storage", "error", err)
+		return nil, false
+	}
+	return store, true
+}
+
+func loadConfig(configPath string) (storage.Configuration, error) {
+	cfgFile, err := os.ReadFile(filepath.Clean(configPath))
+	if err != nil {
+		return storage.Configuration{}, err
+	}
+	return storage.ParseConfiguration(cfgFile, os.LookupEnv)
+}
@@ -0,0 +1,9 @@
+ALTER TABLE {{.Table}}
+{{if .OnCluster}}ON CLUSTER {{.Cluster}}{{end}}
+{{- if .ServiceColumn}}
+    ADD COLUMN IF NOT EXISTS service LowCardinality(String){{if not .Distributed}} CODEC (ZSTD(1)){{end}} AFTER traceID
+{{- else if .TTL}}
+    MODIFY {{.TTL}}
+{{- else}}
+    REMOVE TTL
+{{- end}}
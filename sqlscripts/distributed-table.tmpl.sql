@@ -1,3 +1,6 @@
 CREATE TABLE IF NOT EXISTS {{.Table}}
-    ON CLUSTER '{cluster}' AS {{.Database}}.{{.Table}}_local
-    ENGINE = Distributed('{cluster}', {{.Database}}, {{.Table}}_local, {{.Hash}})
+    ON CLUSTER {{.Cluster}} AS {{.Database}}.{{.Table}}_local
+    ENGINE = Distributed({{.Cluster}}, {{.Database}}, {{.Table}}_local, {{.Hash}})
+    {{- if .Settings}}
+    SETTINGS {{.Settings}}
+    {{- end}}
@@ -1,5 +1,5 @@
 CREATE TABLE IF NOT EXISTS {{.SpansIndexTable}}
-{{if .Replication}}ON CLUSTER '{cluster}'{{end}}
+{{if .OnCluster}}ON CLUSTER {{.Cluster}}{{end}}
 (
     {{if .Multitenant -}}
     tenant     LowCardinality(String) CODEC (ZSTD(1)),
@@ -16,7 +16,7 @@ CREATE TABLE IF NOT EXISTS {{.SpansIndexTable}}
     ) CODEC (ZSTD(1)),
     INDEX idx_tag_keys tags.key TYPE bloom_filter(0.01) GRANULARITY 64,
     INDEX idx_duration durationUs TYPE minmax GRANULARITY 1
-) ENGINE {{if .Replication}}ReplicatedMergeTree{{else}}MergeTree(){{end}}
+) ENGINE {{if .Replication}}ReplicatedMergeTree{{.ReplicaArgs}}{{else}}MergeTree(){{end}}
     {{.TTLTimestamp}}
     PARTITION BY (
         {{if .Multitenant -}}
@@ -25,4 +25,4 @@ CREATE TABLE IF NOT EXISTS {{.SpansIndexTable}}
         toDate(timestamp)
     )
     ORDER BY (service, -toUnixTimestamp(timestamp))
-    SETTINGS index_granularity = 1024
+    SETTINGS index_granularity = 1024{{if .StoragePolicy}}, storage_policy = {{.StoragePolicy}}{{end}}
@@ -1,6 +1,6 @@
 CREATE MATERIALIZED VIEW IF NOT EXISTS {{.OperationsTable}}
-{{if .Replication}}ON CLUSTER '{cluster}'{{end}}
-    ENGINE {{if .Replication}}ReplicatedSummingMergeTree{{else}}SummingMergeTree{{end}}
+{{if .OnCluster}}ON CLUSTER {{.Cluster}}{{end}}
+    ENGINE {{if .Replication}}ReplicatedSummingMergeTree{{.ReplicaArgs}}{{else}}SummingMergeTree{{end}}
     {{.TTLDate}}
     PARTITION BY (
         {{if .Multitenant -}}
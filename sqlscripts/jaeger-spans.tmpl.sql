@@ -1,13 +1,20 @@
 CREATE TABLE IF NOT EXISTS {{.SpansTable}}
-{{if .Replication}}ON CLUSTER '{cluster}'{{end}}
+{{if .OnCluster}}ON CLUSTER {{.Cluster}}{{end}}
 (
     {{if .Multitenant -}}
     tenant    LowCardinality(String) CODEC (ZSTD(1)),
     {{- end -}}
     timestamp DateTime CODEC (Delta, ZSTD(1)),
     traceID   String CODEC (ZSTD(1)),
+    {{- if .ServiceColumn}}
+    service   LowCardinality(String) CODEC (ZSTD(1)),
+    {{- end}}
+    {{- if .Deduplication}}
+    spanID    String CODEC (ZSTD(1)),
+    startTime DateTime64(6) CODEC (Delta, ZSTD(1)),
+    {{- end}}
     model     String CODEC (ZSTD(3))
-) ENGINE {{if .Replication}}ReplicatedMergeTree{{else}}MergeTree(){{end}}
+) ENGINE {{if .Replication}}Replicated{{end}}{{if .Deduplication}}Replacing{{end}}MergeTree{{if .Replication}}{{.ReplicaArgs}}{{else}}(){{end}}
     {{.TTLTimestamp}}
     PARTITION BY (
         {{if .Multitenant -}}
@@ -15,5 +22,5 @@ CREATE TABLE IF NOT EXISTS {{.SpansTable}}
         {{- end -}}
         toDate(timestamp)
     )
-    ORDER BY traceID
-    SETTINGS index_granularity = 1024
+    ORDER BY {{if .Deduplication}}(traceID, spanID, startTime){{else}}traceID{{end}}
+    SETTINGS index_granularity = 1024{{if .StoragePolicy}}, storage_policy = {{.StoragePolicy}}{{end}}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var addressHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "jaeger_clickhouse_address_healthy",
+	Help: "Whether the last connection to the ClickHouse address succeeded, by address and role (read or write)",
+}, []string{"address", "role"})
+
+var registerAddressMetrics sync.Once
+
+// balancedConnector opens connections to one of several ClickHouse addresses in the order of its strategy.
+// Addresses whose last connection failed are tried after the healthy ones until the backoff has passed.
+type balancedConnector struct {
+	logger     hclog.Logger
+	role       string
+	strategy   ConnectionStrategy
+	backoff    time.Duration
+	addresses  []string
+	connectors []driver.Connector
+
+	mutex  sync.Mutex
+	next   int
+	failed []time.Time
+	random *rand.Rand
+}
+
+var _ driver.Connector = (*balancedConnector)(nil)
+
+func newBalancedConnector(
+	logger hclog.Logger,
+	role string,
+	addresses []string,
+	connectors []driver.Connector,
+	strategy ConnectionStrategy,
+	backoff time.Duration,
+) *balancedConnector {
+	registerAddressMetrics.Do(func() {
+		prometheus.MustRegister(addressHealthy)
+	})
+
+	return &balancedConnector{
+		logger:     logger,
+		role:       role,
+		strategy:   strategy,
+		backoff:    backoff,
+		addresses:  addresses,
+		connectors: connectors,
+		failed:     make([]time.Time, len(addresses)),
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Connect implements driver.Connector and returns a connection to the first address that accepts it
+func (c *balancedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var err error
+	for _, i := range c.order(time.Now()) {
+		var conn driver.Conn
+		conn, err = c.connectors[i].Connect(ctx)
+		c.setHealthy(i, err == nil)
+		if err == nil {
+			return conn, nil
+		}
+		c.logger.Warn("Could not connect to ClickHouse", "address", c.addresses[i], "role", c.role, "error", err)
+	}
+	return nil, err
+}
+
+// Driver implements driver.Connector
+func (c *balancedConnector) Driver() driver.Driver {
+	return c.connectors[0].Driver()
+}
+
+// order returns the indexes of the addresses in the order they are tried, healthy addresses first
+func (c *balancedConnector) order(now time.Time) []int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	count := len(c.addresses)
+	order := make([]int, count)
+	switch c.strategy {
+	case ConnectionRoundRobin:
+		for i := range order {
+			order[i] = (c.next + i) % count
+		}
+		c.next = (c.next + 1) % count
+	case ConnectionRandom:
+		copy(order, c.random.Perm(count))
+	default:
+		for i := range order {
+			order[i] = i
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return c.isHealthy(order[i], now) && !c.isHealthy(order[j], now)
+	})
+	return order
+}
+
+func (c *balancedConnector) isHealthy(i int, now time.Time) bool {
+	return c.failed[i].IsZero() || now.Sub(c.failed[i]) >= c.backoff
+}
+
+func (c *balancedConnector) setHealthy(i int, healthy bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if healthy {
+		c.failed[i] = time.Time{}
+		addressHealthy.WithLabelValues(c.addresses[i], c.role).Set(1)
+	} else {
+		c.failed[i] = time.Now()
+		addressHealthy.WithLabelValues(c.addresses[i], c.role).Set(0)
+	}
+}
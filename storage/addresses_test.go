@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+var errConnect = errors.New("connection refused")
+
+type fakeConn struct {
+	driver.Conn
+	address string
+}
+
+type fakeConnector struct {
+	address string
+	err     error
+	calls   int
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return fakeConn{address: c.address}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+func newFakeBalancedConnector(logger mocks.SpyLogger, strategy ConnectionStrategy, connectors ...*fakeConnector) *balancedConnector {
+	addresses := make([]string, len(connectors))
+	driverConnectors := make([]driver.Connector, len(connectors))
+	for i, fake := range connectors {
+		addresses[i] = fake.address
+		driverConnectors[i] = fake
+	}
+	return newBalancedConnector(logger, "write", addresses, driverConnectors, strategy, time.Minute)
+}
+
+func TestBalancedConnector_Order(t *testing.T) {
+	now := time.Now()
+	tests := map[string]struct {
+		strategy ConnectionStrategy
+		failed   []time.Time
+		expected [][]int
+	}{
+		"in order": {
+			strategy: ConnectionInOrder,
+			expected: [][]int{{0, 1, 2}, {0, 1, 2}},
+		},
+		"round robin": {
+			strategy: ConnectionRoundRobin,
+			expected: [][]int{{0, 1, 2}, {1, 2, 0}, {2, 0, 1}, {0, 1, 2}},
+		},
+		"in order failed": {
+			strategy: ConnectionInOrder,
+			failed:   []time.Time{now, {}, now},
+			expected: [][]int{{1, 0, 2}},
+		},
+		"round robin failed": {
+			strategy: ConnectionRoundRobin,
+			failed:   []time.Time{{}, now, {}},
+			expected: [][]int{{0, 2, 1}, {2, 0, 1}, {2, 0, 1}},
+		},
+		"failed after backoff": {
+			strategy: ConnectionInOrder,
+			failed:   []time.Time{now.Add(-time.Hour), {}, {}},
+			expected: [][]int{{0, 1, 2}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			connector := newFakeBalancedConnector(
+				mocks.NewSpyLogger(),
+				test.strategy,
+				&fakeConnector{address: "a"},
+				&fakeConnector{address: "b"},
+				&fakeConnector{address: "c"},
+			)
+			if test.failed != nil {
+				connector.failed = test.failed
+			}
+			for _, expected := range test.expected {
+				assert.Equal(t, expected, connector.order(now))
+			}
+		})
+	}
+}
+
+func TestBalancedConnector_OrderRandom(t *testing.T) {
+	connector := newFakeBalancedConnector(
+		mocks.NewSpyLogger(),
+		ConnectionRandom,
+		&fakeConnector{address: "a"},
+		&fakeConnector{address: "b"},
+		&fakeConnector{address: "c"},
+	)
+	connector.failed[1] = time.Now()
+
+	for i := 0; i < 10; i++ {
+		order := connector.order(time.Now())
+		assert.ElementsMatch(t, []int{0, 1, 2}, order)
+		assert.Equal(t, 1, order[2], "the failed address is tried last")
+	}
+}
+
+func TestBalancedConnector_Connect(t *testing.T) {
+	logger := mocks.NewSpyLogger()
+	failing := &fakeConnector{address: "a", err: errConnect}
+	healthy := &fakeConnector{address: "b"}
+	connector := newFakeBalancedConnector(logger, ConnectionInOrder, failing, healthy)
+
+	conn, err := connector.Connect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, fakeConn{address: "b"}, conn)
+	assert.False(t, connector.failed[0].IsZero())
+	assert.True(t, connector.failed[1].IsZero())
+
+	// The failed address is tried last during the backoff
+	conn, err = connector.Connect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, fakeConn{address: "b"}, conn)
+	assert.Equal(t, 1, failing.calls)
+	assert.Equal(t, 2, healthy.calls)
+
+	logger.AssertLogsOfLevelEqual(t, hclog.Warn, []mocks.LogMock{
+		{Msg: "Could not connect to ClickHouse", Args: []interface{}{"address", "a", "role", "write", "error", errConnect}},
+	})
+}
+
+func TestBalancedConnector_ConnectError(t *testing.T) {
+	connector := newFakeBalancedConnector(
+		mocks.NewSpyLogger(),
+		ConnectionInOrder,
+		&fakeConnector{address: "a", err: errors.New("first")},
+		&fakeConnector{address: "b", err: errConnect},
+	)
+
+	_, err := connector.Connect(context.Background())
+	assert.Equal(t, errConnect, err)
+}
+
+func TestConfiguration_GetAddresses(t *testing.T) {
+	tests := map[string]struct {
+		config       Configuration
+		expected     []string
+		expectedRead []string
+	}{
+		"address": {
+			config:   Configuration{Address: "tcp://localhost:9000"},
+			expected: []string{"localhost:9000"},
+		},
+		"addresses": {
+			config:   Configuration{Address: "localhost:9000", Addresses: []string{"tcp://a:9000", "b:9000"}},
+			expected: []string{"a:9000", "b:9000"},
+		},
+		"read addresses": {
+			config:       Configuration{Address: "a:9000", ReadAddresses: []string{"tcp://b:9000", "c:9000"}},
+			expected:     []string{"a:9000"},
+			expectedRead: []string{"b:9000", "c:9000"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.config.getAddresses())
+			assert.Equal(t, test.expectedRead, test.config.getReadAddresses())
+		})
+	}
+}
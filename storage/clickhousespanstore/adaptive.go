@@ -0,0 +1,193 @@
+package clickhousespanstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	batchSizeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_batch_write_size",
+		Help: "Current number of pending spans which triggers a write, see batch_write_size",
+	}, []string{"tenant", "table"})
+	batchFlushIntervalGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_batch_flush_interval_seconds",
+		Help: "Current interval after which pending spans are written, see batch_flush_interval",
+	}, []string{"tenant", "table"})
+)
+
+const (
+	// adaptiveErrorFactor grows batches after failed writes, which are often caused by too many parts
+	adaptiveErrorFactor = 2
+	// adaptiveLatencyFactor grows batches when writes take longer than half of the flush interval
+	adaptiveLatencyFactor = 1.5
+)
+
+// AdaptiveBatching configures bounds for adapting the batch size and flush interval of SpanWriter.
+type AdaptiveBatching struct {
+	Enabled     bool
+	MinSize     int64
+	MaxSize     int64
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
+// batchController adapts the batch size and flush interval to the observed span rate and write outcomes.
+// Failed and slow writes make batches bigger and less frequent, low span rates make the interval longer
+// so small batches are not flushed too often, and high span rates make batches bigger so writes stay driven by the interval.
+type batchController struct {
+	// bounds are only changed by reset on the writer goroutine, and read by observeWrite under mutex
+	bounds       AdaptiveBatching
+	baseSize     int64
+	baseInterval time.Duration
+
+	size        int64
+	interval    time.Duration
+	received    int64
+	windowStart time.Time
+
+	mutex        sync.Mutex
+	writes       int
+	failures     int
+	totalLatency time.Duration
+
+	// sizeGauge and intervalGauge report the current batch size and flush interval of the writer's table
+	sizeGauge     prometheus.Gauge
+	intervalGauge prometheus.Gauge
+}
+
+func newBatchController(
+	tenant string,
+	table TableName,
+	bounds AdaptiveBatching,
+	size int64,
+	interval time.Duration,
+	now time.Time,
+) *batchController {
+	controller := &batchController{
+		sizeGauge:     batchSizeGauge.WithLabelValues(tenant, string(table)),
+		intervalGauge: batchFlushIntervalGauge.WithLabelValues(tenant, string(table)),
+	}
+	controller.reset(bounds, size, interval, now)
+	return controller
+}
+
+// reset starts over with new bounds, batch size and flush interval, discarding all observations.
+// It is called only from the writer goroutine.
+func (c *batchController) reset(bounds AdaptiveBatching, size int64, interval time.Duration, now time.Time) {
+	if bounds.Enabled {
+		size = clampSize(size, bounds.MinSize, bounds.MaxSize)
+		interval = clampInterval(interval, bounds.MinInterval, bounds.MaxInterval)
+	}
+	c.mutex.Lock()
+	c.bounds = bounds
+	c.writes, c.failures, c.totalLatency = 0, 0, 0
+	c.mutex.Unlock()
+
+	c.baseSize = size
+	c.baseInterval = interval
+	c.size = size
+	c.interval = interval
+	c.received = 0
+	c.windowStart = now
+	c.setGauges()
+}
+
+// observeSpan records a span accepted by the writer. It is called only from the writer goroutine.
+func (c *batchController) observeSpan() {
+	c.received++
+}
+
+// observeWrite records the outcome of a batch write. It may be called from any worker.
+func (c *batchController) observeWrite(latency time.Duration, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.bounds.Enabled {
+		return
+	}
+	c.writes++
+	c.totalLatency += latency
+	if err != nil {
+		c.failures++
+	}
+}
+
+// adjust recalculates the batch size and flush interval from the observations since the last adjustment.
+// It is called only from the writer goroutine.
+func (c *batchController) adjust(now time.Time) (int64, time.Duration) {
+	if !c.bounds.Enabled {
+		return c.size, c.interval
+	}
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < c.bounds.MinInterval || elapsed <= 0 {
+		return c.size, c.interval
+	}
+
+	c.mutex.Lock()
+	writes, failures, totalLatency := c.writes, c.failures, c.totalLatency
+	c.writes, c.failures, c.totalLatency = 0, 0, 0
+	c.mutex.Unlock()
+
+	rate := float64(c.received) / elapsed.Seconds()
+	c.received = 0
+	c.windowStart = now
+
+	size := float64(c.size)
+	interval := float64(c.interval)
+	switch {
+	case failures > 0:
+		size *= adaptiveErrorFactor
+		interval *= adaptiveErrorFactor
+	case writes > 0 && totalLatency/time.Duration(writes) > c.interval/2:
+		size *= adaptiveLatencyFactor
+		interval *= adaptiveLatencyFactor
+	default:
+		targetInterval := float64(c.baseInterval)
+		if rate == 0 {
+			targetInterval = float64(c.bounds.MaxInterval)
+		} else if rate*c.baseInterval.Seconds() < float64(c.bounds.MinSize) {
+			// Wait until at least a minimal batch is collected
+			targetInterval = float64(c.bounds.MinSize) / rate * float64(time.Second)
+		}
+		targetSize := rate * targetInterval / float64(time.Second)
+		if targetSize < float64(c.baseSize) {
+			targetSize = float64(c.baseSize)
+		}
+		// Move halfway towards the target to smooth out bursts
+		size = (size + targetSize) / 2
+		interval = (interval + targetInterval) / 2
+	}
+
+	c.size = clampSize(int64(size), c.bounds.MinSize, c.bounds.MaxSize)
+	c.interval = clampInterval(time.Duration(interval), c.bounds.MinInterval, c.bounds.MaxInterval)
+	c.setGauges()
+	return c.size, c.interval
+}
+
+// setGauges reports the batch size and flush interval, which are static if adaptive batching is disabled
+func (c *batchController) setGauges() {
+	c.sizeGauge.Set(float64(c.size))
+	c.intervalGauge.Set(c.interval.Seconds())
+}
+
+func clampSize(value, min, max int64) int64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+func clampInterval(value, min, max time.Duration) time.Duration {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
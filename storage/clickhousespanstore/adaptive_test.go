@@ -0,0 +1,177 @@
+package clickhousespanstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchController_Adjust(t *testing.T) {
+	bounds := AdaptiveBatching{
+		Enabled:     true,
+		MinSize:     100,
+		MaxSize:     10_000,
+		MinInterval: time.Second,
+		MaxInterval: 30 * time.Second,
+	}
+	start := time.Unix(0, 0)
+
+	tests := map[string]struct {
+		bounds           AdaptiveBatching
+		spans            int
+		writes           []time.Duration
+		failures         int
+		elapsed          time.Duration
+		expectedSize     int64
+		expectedInterval time.Duration
+	}{
+		"disabled": {
+			bounds:           AdaptiveBatching{},
+			spans:            10,
+			failures:         1,
+			elapsed:          10 * time.Second,
+			expectedSize:     1000,
+			expectedInterval: 5 * time.Second,
+		},
+		"too early": {
+			bounds:           bounds,
+			failures:         1,
+			elapsed:          time.Millisecond,
+			expectedSize:     1000,
+			expectedInterval: 5 * time.Second,
+		},
+		"failed writes": {
+			bounds:           bounds,
+			spans:            1000,
+			writes:           []time.Duration{time.Millisecond},
+			failures:         1,
+			elapsed:          10 * time.Second,
+			expectedSize:     2000,
+			expectedInterval: 10 * time.Second,
+		},
+		"slow writes": {
+			bounds:           bounds,
+			spans:            1000,
+			writes:           []time.Duration{4 * time.Second},
+			elapsed:          10 * time.Second,
+			expectedSize:     1500,
+			expectedInterval: 7500 * time.Millisecond,
+		},
+		"no spans": {
+			bounds:           bounds,
+			elapsed:          10 * time.Second,
+			expectedSize:     1000,
+			expectedInterval: 17500 * time.Millisecond,
+		},
+		"low rate": {
+			bounds:           bounds,
+			spans:            100,
+			elapsed:          10 * time.Second,
+			expectedSize:     1000,
+			expectedInterval: 7500 * time.Millisecond,
+		},
+		"high rate": {
+			bounds:           bounds,
+			spans:            30_000,
+			elapsed:          10 * time.Second,
+			expectedSize:     8000,
+			expectedInterval: 5 * time.Second,
+		},
+		"upper bounds": {
+			bounds:           AdaptiveBatching{Enabled: true, MinSize: 100, MaxSize: 1500, MinInterval: time.Second, MaxInterval: 6 * time.Second},
+			failures:         1,
+			elapsed:          10 * time.Second,
+			expectedSize:     1500,
+			expectedInterval: 6 * time.Second,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			controller := newBatchController("", testSpansTable, test.bounds, 1000, 5*time.Second, start)
+			for i := 0; i < test.spans; i++ {
+				controller.observeSpan()
+			}
+			for _, latency := range test.writes {
+				controller.observeWrite(latency, nil)
+			}
+			for i := 0; i < test.failures; i++ {
+				controller.observeWrite(time.Millisecond, fmt.Errorf("write failed"))
+			}
+			size, interval := controller.adjust(start.Add(test.elapsed))
+			assert.Equal(t, test.expectedSize, size)
+			assert.Equal(t, test.expectedInterval, interval)
+		})
+	}
+}
+
+func TestBatchController_ObservationsAreReset(t *testing.T) {
+	controller := newBatchController("", testSpansTable, AdaptiveBatching{
+		Enabled:     true,
+		MinSize:     100,
+		MaxSize:     10_000,
+		MinInterval: time.Second,
+		MaxInterval: 30 * time.Second,
+	}, 1000, 5*time.Second, time.Unix(0, 0))
+
+	controller.observeWrite(time.Millisecond, fmt.Errorf("write failed"))
+	size, interval := controller.adjust(time.Unix(10, 0))
+	assert.Equal(t, int64(2000), size)
+	assert.Equal(t, 10*time.Second, interval)
+
+	for i := 0; i < 500; i++ {
+		controller.observeSpan()
+	}
+	// Without new failures, size and interval move halfway back towards the configured values
+	size, interval = controller.adjust(time.Unix(20, 0))
+	assert.Equal(t, int64(1500), size)
+	assert.Equal(t, 7500*time.Millisecond, interval)
+}
+
+func TestBatchController_Reset(t *testing.T) {
+	controller := newBatchController("", testSpansTable, AdaptiveBatching{
+		Enabled:     true,
+		MinSize:     100,
+		MaxSize:     10_000,
+		MinInterval: time.Second,
+		MaxInterval: 30 * time.Second,
+	}, 1000, 5*time.Second, time.Unix(0, 0))
+	controller.observeWrite(time.Millisecond, fmt.Errorf("write failed"))
+
+	// Observations before the reset are discarded, and the size is clamped to the new bounds
+	controller.reset(AdaptiveBatching{
+		Enabled:     true,
+		MinSize:     10,
+		MaxSize:     500,
+		MinInterval: time.Second,
+		MaxInterval: 30 * time.Second,
+	}, 1000, 5*time.Second, time.Unix(10, 0))
+	for i := 0; i < 5000; i++ {
+		controller.observeSpan()
+	}
+	size, interval := controller.adjust(time.Unix(20, 0))
+	assert.Equal(t, int64(500), size)
+	assert.Equal(t, 5*time.Second, interval)
+
+	// Without adaptive batching, the configured size and interval are kept
+	controller.reset(AdaptiveBatching{}, 20, time.Minute, time.Unix(20, 0))
+	controller.observeWrite(time.Millisecond, fmt.Errorf("write failed"))
+	size, interval = controller.adjust(time.Unix(100, 0))
+	assert.Equal(t, int64(20), size)
+	assert.Equal(t, time.Minute, interval)
+}
+
+func TestBatchController_GaugesWithoutAdaptiveBatching(t *testing.T) {
+	newBatchController("tenant", "gauges_table", AdaptiveBatching{}, 500, 2*time.Second, time.Unix(0, 0))
+
+	assert.Equal(t, float64(500), testutil.ToFloat64(batchSizeGauge.WithLabelValues("tenant", "gauges_table")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(batchFlushIntervalGauge.WithLabelValues("tenant", "gauges_table")))
+}
+
+func TestQueueCapacity(t *testing.T) {
+	assert.Equal(t, int64(10_000), queueCapacity(WriterSettings{Size: 1000, Adaptive: AdaptiveBatching{MaxSize: 10_000}}))
+	assert.Equal(t, int64(1000), queueCapacity(WriterSettings{Size: 1000}))
+}
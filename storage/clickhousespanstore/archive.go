@@ -0,0 +1,335 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// archivedTraceTTL is how long a trace is remembered after archiving.
+// Jaeger archives a trace by writing all of its spans in a quick succession,
+// so the trace is copied on the first span and the rest of the spans are skipped.
+const archivedTraceTTL = time.Minute
+
+// minArchiveSweep is the number of remembered traces from which expired traces are removed
+const minArchiveSweep = 64
+
+// archiveState is the state of a trace which is being archived or was archived recently
+type archiveState struct {
+	// done is closed once archiving finished, the fields below must only be read after it is closed
+	done     chan struct{}
+	copied   bool
+	err      error
+	archived time.Time
+}
+
+// finished returns whether archiving of the trace finished
+func (state *archiveState) finished() bool {
+	select {
+	case <-state.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ArchiveWriter archives traces by copying them from the spans table to the archive table in ClickHouse.
+// Copying is synchronous and skipped for traces which are already archived. Concurrent writes of spans of the same
+// trace wait for a single copy, while different traces are archived in parallel.
+// Spans of traces which are not found in the spans table are passed to the fallback writer.
+// If an archive index table is given, copied traces are indexed there as well.
+// Replicas of the plugin may archive a trace at the same time. With insert deduplication, ClickHouse then drops
+// the second copy, as copies of a trace are inserted with the same deduplication token, otherwise duplicated
+// spans are removed when traces are read.
+type ArchiveWriter struct {
+	logger            hclog.Logger
+	db                *sql.DB
+	spansTable        TableName
+	archiveTable      TableName
+	archiveIndexTable TableName
+	tenant            string
+	deduplication     bool
+	insertSettings    InsertSettings
+	fallback          spanstore.Writer
+
+	// tagIndexMutex guards tagIndex, which is changed by Update
+	tagIndexMutex sync.Mutex
+	tagIndex      *TagIndex
+
+	// mutex guards traces and sweepAt, it is not held while traces are copied
+	mutex  sync.Mutex
+	traces map[model.TraceID]*archiveState
+	// sweepAt is the number of remembered traces at which expired traces are removed
+	sweepAt int
+}
+
+var _ spanstore.Writer = (*ArchiveWriter)(nil)
+
+// NewArchiveWriter returns an ArchiveWriter for the database
+func NewArchiveWriter(
+	logger hclog.Logger,
+	db *sql.DB,
+	spansTable,
+	archiveTable,
+	archiveIndexTable TableName,
+	tenant string,
+	deduplication bool,
+	insertSettings InsertSettings,
+	tagIndex *TagIndex,
+	fallback spanstore.Writer,
+) *ArchiveWriter {
+	registerStatementMetrics()
+	return &ArchiveWriter{
+		logger:            logger,
+		db:                db,
+		spansTable:        spansTable,
+		archiveTable:      archiveTable,
+		archiveIndexTable: archiveIndexTable,
+		tenant:            tenant,
+		deduplication:     deduplication,
+		insertSettings:    insertSettings,
+		tagIndex:          tagIndex,
+		fallback:          fallback,
+		traces:            make(map[model.TraceID]*archiveState),
+		sweepAt:           minArchiveSweep,
+	}
+}
+
+// WriteSpan archives the whole trace of the span, unless it is already archived
+func (w *ArchiveWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	copied, err := w.archiveTrace(ctx, span.TraceID)
+	if err != nil {
+		return err
+	}
+	if copied {
+		return nil
+	}
+	return w.fallback.WriteSpan(ctx, span)
+}
+
+// archiveTrace copies the trace from the spans table to the archive table, or waits for the copy if it is
+// already being copied. It returns whether the trace was found in either of them.
+func (w *ArchiveWriter) archiveTrace(ctx context.Context, traceID model.TraceID) (bool, error) {
+	now := time.Now()
+	w.mutex.Lock()
+	state, ok := w.traces[traceID]
+	if ok && state.finished() && now.Sub(state.archived) > archivedTraceTTL {
+		ok = false
+	}
+	if !ok {
+		state = &archiveState{done: make(chan struct{})}
+		w.traces[traceID] = state
+		w.sweep(now)
+	}
+	w.mutex.Unlock()
+
+	if ok {
+		select {
+		case <-state.done:
+			return state.copied, state.err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	state.copied, state.err = w.copyTraceIfMissing(ctx, traceID)
+	state.archived = time.Now()
+	if state.err != nil {
+		// Failures are not remembered, so the next span of the trace retries
+		w.mutex.Lock()
+		if w.traces[traceID] == state {
+			delete(w.traces, traceID)
+		}
+		w.mutex.Unlock()
+	}
+	close(state.done)
+	return state.copied, state.err
+}
+
+// sweep removes traces which were archived more than archivedTraceTTL ago. It only runs once the number of
+// remembered traces doubled since the last sweep, so its cost is spread over the archived traces.
+func (w *ArchiveWriter) sweep(now time.Time) {
+	if len(w.traces) < w.sweepAt {
+		return
+	}
+	for id, state := range w.traces {
+		if state.finished() && now.Sub(state.archived) > archivedTraceTTL {
+			delete(w.traces, id)
+		}
+	}
+	w.sweepAt = 2 * len(w.traces)
+	if w.sweepAt < minArchiveSweep {
+		w.sweepAt = minArchiveSweep
+	}
+}
+
+// copyTraceIfMissing copies the trace to the archive table unless it is already there, and indexes it unless
+// it is already in the archive index table, e.g. if indexing failed after copying before.
+// It returns whether the trace was found in either the spans or the archive table.
+func (w *ArchiveWriter) copyTraceIfMissing(ctx context.Context, traceID model.TraceID) (bool, error) {
+	archived, err := w.countSpans(ctx, w.archiveTable, traceID)
+	if err != nil {
+		return false, err
+	}
+	if archived == 0 {
+		w.logger.Debug("Copying trace to archive", "trace_id", traceID.String())
+		if err := w.copyTrace(ctx, traceID); err != nil {
+			return false, err
+		}
+		if archived, err = w.countCopiedSpans(ctx, traceID); err != nil {
+			return false, err
+		}
+	}
+	if archived == 0 || w.archiveIndexTable == "" {
+		return archived > 0, nil
+	}
+
+	indexed, err := w.countSpans(ctx, w.archiveIndexTable, traceID)
+	if err != nil {
+		return false, err
+	}
+	if indexed == 0 {
+		// Index rows are inserted with the same deduplication token as on previous attempts
+		if err := w.indexTrace(ctx, traceID); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// countSpans returns the number of rows of the trace in table
+func (w *ArchiveWriter) countSpans(ctx context.Context, table TableName, traceID model.TraceID) (uint64, error) {
+	query := fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", table)
+	args := []interface{}{traceID.String()}
+	if w.tenant != "" {
+		query += " AND tenant = ?"
+		args = append(args, w.tenant)
+	}
+
+	var count uint64
+	err := w.db.QueryRowContext(ctx, query, args...).Scan(&count)
+	return count, err
+}
+
+// countCopiedSpans returns the number of rows of the trace in the archive table after copying it, and counts
+// the size of their values as written bytes like for rows written by SpanWriter
+func (w *ArchiveWriter) countCopiedSpans(ctx context.Context, traceID model.TraceID) (uint64, error) {
+	rowBytes := fmt.Sprintf("%d + length(traceID) + length(model)", dateTimeBytes)
+	if w.deduplication {
+		rowBytes += fmt.Sprintf(" + length(spanID) + %d", dateTime64Bytes)
+	}
+	query := fmt.Sprintf("SELECT count(), sum(%s) FROM %s WHERE traceID = ?", rowBytes, w.archiveTable)
+	args := []interface{}{traceID.String()}
+	if w.tenant != "" {
+		query = fmt.Sprintf("SELECT count(), sum(length(tenant) + %s) FROM %s WHERE traceID = ? AND tenant = ?", rowBytes, w.archiveTable)
+		args = append(args, w.tenant)
+	}
+
+	var count, written uint64
+	if err := w.db.QueryRowContext(ctx, query, args...).Scan(&count, &written); err != nil {
+		return 0, err
+	}
+	numWrittenBytes.WithLabelValues(w.tenant, string(w.archiveTable)).Add(float64(written))
+	return count, nil
+}
+
+func (w *ArchiveWriter) copyTrace(ctx context.Context, traceID model.TraceID) error {
+	columns := "timestamp, traceID, model"
+	if w.deduplication {
+		columns = "timestamp, traceID, spanID, startTime, model"
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE traceID = ?", w.archiveTable, columns, columns, w.spansTable)
+	args := []interface{}{traceID.String()}
+	if w.tenant != "" {
+		query = fmt.Sprintf(
+			"INSERT INTO %s (tenant, %s) SELECT tenant, %s FROM %s WHERE traceID = ? AND tenant = ?",
+			w.archiveTable,
+			columns,
+			columns,
+			w.spansTable,
+		)
+		args = append(args, w.tenant)
+	}
+
+	settings := w.copyInsertSettings(traceID, w.archiveTable)
+	_, err := w.db.ExecContext(clickhouse.Context(ctx, clickhouse.WithSettings(settings)), query, args...)
+	return err
+}
+
+// copySettings returns the settings of inserts of archived traces. The archived spans are counted right after they
+// are copied, so inserts into distributed tables wait until the spans were written to the shards.
+// Async inserts do not apply to copies.
+func (w *ArchiveWriter) copySettings() InsertSettings {
+	settings := w.insertSettings
+	settings.Async = false
+	settings.DistributedSync = true
+	return settings
+}
+
+// copyInsertSettings returns the ClickHouse settings of the copy of a trace into table
+func (w *ArchiveWriter) copyInsertSettings(traceID model.TraceID, table TableName) clickhouse.Settings {
+	return w.copySettings().settings(w.deduplicationToken(traceID) + "-" + string(table))
+}
+
+// deduplicationToken identifies the copy of a trace, it is the same for all replicas of the plugin
+func (w *ArchiveWriter) deduplicationToken(traceID model.TraceID) string {
+	return "archive-" + w.tenant + "-" + traceID.String()
+}
+
+// indexTrace writes the index rows of an archived trace, which are built from its spans in the same way as on write
+func (w *ArchiveWriter) indexTrace(ctx context.Context, traceID model.TraceID) error {
+	reader := NewTraceReader(w.db, "", "", w.archiveTable, w.tenant, 0, nil)
+	traces, err := reader.getTraces(ctx, []model.TraceID{traceID})
+	if err != nil {
+		return err
+	}
+	worker := WriteWorker{
+		params: &WorkerParams{
+			logger:         w.logger,
+			db:             w.db,
+			indexTable:     w.archiveIndexTable,
+			tenant:         w.tenant,
+			insertSettings: w.copySettings(),
+			settings:       WriterSettings{TagIndex: w.getTagIndex()},
+		},
+		token: w.deduplicationToken(traceID),
+	}
+	for _, trace := range traces {
+		if err := worker.writeIndexBatch(trace.Spans); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update replaces the rules of indexed tags of archived traces, and applies settings to the fallback writer
+func (w *ArchiveWriter) Update(tagIndex *TagIndex, settings WriterSettings) {
+	w.tagIndexMutex.Lock()
+	w.tagIndex = tagIndex
+	w.tagIndexMutex.Unlock()
+	if fallback, ok := w.fallback.(*SpanWriter); ok {
+		fallback.Update(settings)
+	}
+}
+
+func (w *ArchiveWriter) getTagIndex() *TagIndex {
+	w.tagIndexMutex.Lock()
+	defer w.tagIndexMutex.Unlock()
+	return w.tagIndex
+}
+
+// Close Implements io.Closer and closes the fallback writer
+func (w *ArchiveWriter) Close() error {
+	if closer, ok := w.fallback.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
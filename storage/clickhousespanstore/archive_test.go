@@ -0,0 +1,315 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const testSpansArchiveTable = "test_spans_archive_table"
+
+type spanRecorder struct {
+	mutex sync.Mutex
+	spans []*model.Span
+}
+
+func (r *spanRecorder) WriteSpan(_ context.Context, span *model.Span) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.spans = append(r.spans, span)
+	return nil
+}
+
+func TestArchiveWriter_WriteSpan(t *testing.T) {
+	traceID := testSpan.TraceID.String()
+	tests := map[string]struct {
+		tenant           string
+		deduplication    bool
+		countQuery       string
+		copyQuery        string
+		copiedQuery      string
+		args             []driver.Value
+		archivedBefore   uint64
+		archivedAfter    uint64
+		expectCopy       bool
+		expectedFallback int
+	}{
+		"copy": {
+			countQuery:    fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testSpansArchiveTable),
+			copyQuery:     fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) SELECT timestamp, traceID, model FROM %s WHERE traceID = ?", testSpansArchiveTable, testSpansTable),
+			copiedQuery:   fmt.Sprintf("SELECT count(), sum(4 + length(traceID) + length(model)) FROM %s WHERE traceID = ?", testSpansArchiveTable),
+			args:          []driver.Value{traceID},
+			archivedAfter: 2,
+			expectCopy:    true,
+		},
+		"copy tenant": {
+			tenant:     testTenant,
+			countQuery: fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ? AND tenant = ?", testSpansArchiveTable),
+			copyQuery:  fmt.Sprintf("INSERT INTO %s (tenant, timestamp, traceID, model) SELECT tenant, timestamp, traceID, model FROM %s WHERE traceID = ? AND tenant = ?", testSpansArchiveTable, testSpansTable),
+			copiedQuery: fmt.Sprintf(
+				"SELECT count(), sum(length(tenant) + 4 + length(traceID) + length(model)) FROM %s WHERE traceID = ? AND tenant = ?",
+				testSpansArchiveTable,
+			),
+			args:          []driver.Value{traceID, testTenant},
+			archivedAfter: 2,
+			expectCopy:    true,
+		},
+		"copy deduplication": {
+			deduplication: true,
+			countQuery:    fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testSpansArchiveTable),
+			copyQuery: fmt.Sprintf(
+				"INSERT INTO %s (timestamp, traceID, spanID, startTime, model) SELECT timestamp, traceID, spanID, startTime, model FROM %s WHERE traceID = ?",
+				testSpansArchiveTable,
+				testSpansTable,
+			),
+			copiedQuery: fmt.Sprintf(
+				"SELECT count(), sum(4 + length(traceID) + length(model) + length(spanID) + 8) FROM %s WHERE traceID = ?",
+				testSpansArchiveTable,
+			),
+			args:          []driver.Value{traceID},
+			archivedAfter: 2,
+			expectCopy:    true,
+		},
+		"already archived": {
+			countQuery:     fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testSpansArchiveTable),
+			args:           []driver.Value{traceID},
+			archivedBefore: 2,
+		},
+		"not in spans table": {
+			countQuery:       fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testSpansArchiveTable),
+			copyQuery:        fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) SELECT timestamp, traceID, model FROM %s WHERE traceID = ?", testSpansArchiveTable, testSpansTable),
+			copiedQuery:      fmt.Sprintf("SELECT count(), sum(4 + length(traceID) + length(model)) FROM %s WHERE traceID = ?", testSpansArchiveTable),
+			args:             []driver.Value{traceID},
+			expectCopy:       true,
+			expectedFallback: 2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := mocks.GetDbMock()
+			require.NoError(t, err, "an error was not expected when opening a stub database connection")
+			defer db.Close()
+
+			mock.ExpectQuery(test.countQuery).WithArgs(test.args...).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(test.archivedBefore))
+			if test.expectCopy {
+				mock.ExpectExec(test.copyQuery).WithArgs(test.args...).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(test.copiedQuery).WithArgs(test.args...).WillReturnRows(sqlmock.NewRows([]string{"count()", "bytes"}).AddRow(test.archivedAfter, uint64(100)))
+			}
+
+			fallback := &spanRecorder{}
+			writer := NewArchiveWriter(mocks.NewSpyLogger(), db, testSpansTable, testSpansArchiveTable, "", test.tenant, test.deduplication, InsertSettings{}, nil, fallback)
+			// The second span of the same trace must not hit the database again
+			for i := 0; i < 2; i++ {
+				require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+			assert.Len(t, fallback.spans, test.expectedFallback)
+		})
+	}
+}
+
+func TestArchiveWriter_CopyError(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	mock.ExpectQuery(fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testSpansArchiveTable)).
+		WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(0)))
+	mock.ExpectExec(fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) SELECT timestamp, traceID, model FROM %s WHERE traceID = ?", testSpansArchiveTable, testSpansTable)).
+		WillReturnError(errorMock)
+
+	fallback := &spanRecorder{}
+	writer := NewArchiveWriter(mocks.NewSpyLogger(), db, testSpansTable, testSpansArchiveTable, "", "", false, InsertSettings{}, nil, fallback)
+	assert.ErrorIs(t, writer.WriteSpan(context.Background(), &testSpan), errorMock)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, fallback.spans)
+}
+
+func TestArchiveWriter_WriteSpanIndex(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	traceID := testSpan.TraceID.String()
+	countQuery := fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testSpansArchiveTable)
+	copiedQuery := fmt.Sprintf("SELECT count(), sum(4 + length(traceID) + length(model)) FROM %s WHERE traceID = ?", testSpansArchiveTable)
+
+	mock.ExpectQuery(countQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(0)))
+	mock.ExpectExec(fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) SELECT timestamp, traceID, model FROM %s WHERE traceID = ?", testSpansArchiveTable, testSpansTable)).
+		WithArgs(traceID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(copiedQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()", "bytes"}).AddRow(uint64(1), uint64(100)))
+	mock.ExpectQuery(fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testIndexTable)).
+		WithArgs(traceID).
+		WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(0)))
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansArchiveTable)).
+		WithArgs(traceID).
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow(spanJSON))
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare(indexWriteExpectation.preparation)
+	for _, args := range indexWriteExpectation.execArgs {
+		prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	archiveBytes := testutil.ToFloat64(numWrittenBytes.WithLabelValues("", testSpansArchiveTable))
+	indexBytes := testutil.ToFloat64(numWrittenBytes.WithLabelValues("", testIndexTable))
+	fallback := &spanRecorder{}
+	writer := NewArchiveWriter(mocks.NewSpyLogger(), db, testSpansTable, testSpansArchiveTable, testIndexTable, "", false, InsertSettings{}, nil, fallback)
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, fallback.spans)
+	// The bytes of copied rows are counted by ClickHouse, and the bytes of index rows when they are inserted
+	assert.Equal(t, archiveBytes+100, testutil.ToFloat64(numWrittenBytes.WithLabelValues("", testSpansArchiveTable)))
+	assert.Greater(t, testutil.ToFloat64(numWrittenBytes.WithLabelValues("", testIndexTable)), indexBytes)
+}
+
+func TestArchiveWriter_IndexRetry(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	traceID := testSpan.TraceID.String()
+	countQuery := fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testSpansArchiveTable)
+	copiedQuery := fmt.Sprintf("SELECT count(), sum(4 + length(traceID) + length(model)) FROM %s WHERE traceID = ?", testSpansArchiveTable)
+	indexCountQuery := fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testIndexTable)
+	readQuery := fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?)", testSpansArchiveTable)
+
+	// The trace is copied, but inserting its index rows fails
+	mock.ExpectQuery(countQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(0)))
+	mock.ExpectExec(fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) SELECT timestamp, traceID, model FROM %s WHERE traceID = ?", testSpansArchiveTable, testSpansTable)).
+		WithArgs(traceID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(copiedQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()", "bytes"}).AddRow(uint64(1), uint64(100)))
+	mock.ExpectQuery(indexCountQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(0)))
+	mock.ExpectQuery(readQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow(spanJSON))
+	mock.ExpectBegin()
+	mock.ExpectPrepare(indexWriteExpectation.preparation).ExpectExec().WithArgs(indexWriteExpectation.execArgs[0]...).WillReturnError(errorMock)
+	mock.ExpectRollback()
+
+	// The next span finds the archived trace and indexes it without copying it again
+	mock.ExpectQuery(countQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(1)))
+	mock.ExpectQuery(indexCountQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(0)))
+	mock.ExpectQuery(readQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow(spanJSON))
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare(indexWriteExpectation.preparation)
+	for _, args := range indexWriteExpectation.execArgs {
+		prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	// Indexed traces are not indexed again
+	mock.ExpectQuery(countQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(1)))
+	mock.ExpectQuery(indexCountQuery).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(3)))
+
+	fallback := &spanRecorder{}
+	writer := NewArchiveWriter(mocks.NewSpyLogger(), db, testSpansTable, testSpansArchiveTable, testIndexTable, "", false, InsertSettings{}, nil, fallback)
+	assert.ErrorIs(t, writer.WriteSpan(context.Background(), &testSpan), errorMock)
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+	// A new writer, e.g. of another replica, does not remember the trace
+	writer = NewArchiveWriter(mocks.NewSpyLogger(), db, testSpansTable, testSpansArchiveTable, testIndexTable, "", false, InsertSettings{}, nil, fallback)
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, fallback.spans)
+}
+
+func TestArchiveWriter_CopyInsertSettings(t *testing.T) {
+	traceID := testSpan.TraceID
+	tests := map[string]struct {
+		insertSettings InsertSettings
+		expected       clickhouse.Settings
+	}{
+		"default": {
+			expected: clickhouse.Settings{"insert_distributed_sync": 1},
+		},
+		"sharded async": {
+			insertSettings: InsertSettings{Async: true, WaitForAsync: true},
+			expected:       clickhouse.Settings{"insert_distributed_sync": 1},
+		},
+		"deduplication": {
+			insertSettings: InsertSettings{Deduplication: true},
+			expected: clickhouse.Settings{
+				"insert_deduplication_token": "archive-" + testTenant + "-" + traceID.String() + "-" + testSpansArchiveTable,
+				"insert_distributed_sync":    1,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Replicas of the plugin insert copies of the same trace with the same settings
+			for i := 0; i < 2; i++ {
+				writer := NewArchiveWriter(mocks.NewSpyLogger(), nil, testSpansTable, testSpansArchiveTable, "", testTenant, false, test.insertSettings, nil, &spanRecorder{})
+				assert.Equal(t, test.expected, writer.copyInsertSettings(traceID, testSpansArchiveTable))
+			}
+		})
+	}
+}
+
+func TestArchiveWriter_ConcurrentWriteSpan(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceID := testSpan.TraceID.String()
+	countQuery := fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", testSpansArchiveTable)
+	mock.ExpectQuery(countQuery).
+		WithArgs(traceID).
+		WillDelayFor(50 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(uint64(2)))
+
+	fallback := &spanRecorder{}
+	writer := NewArchiveWriter(mocks.NewSpyLogger(), db, testSpansTable, testSpansArchiveTable, "", "", false, InsertSettings{}, nil, fallback)
+
+	// Spans of the same trace written at the same time wait for a single copy
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+		}()
+	}
+	wg.Wait()
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, fallback.spans)
+}
+
+func TestArchiveWriter_Sweep(t *testing.T) {
+	writer := NewArchiveWriter(mocks.NewSpyLogger(), nil, testSpansTable, testSpansArchiveTable, "", "", false, InsertSettings{}, nil, &spanRecorder{})
+	now := time.Now()
+	for i := 0; i < minArchiveSweep; i++ {
+		state := &archiveState{done: make(chan struct{}), archived: now.Add(-2 * archivedTraceTTL)}
+		if i%2 == 0 {
+			close(state.done)
+		}
+		writer.traces[model.NewTraceID(0, uint64(i))] = state
+	}
+
+	writer.sweep(now)
+	// Traces which are still being archived are kept
+	assert.Len(t, writer.traces, minArchiveSweep/2)
+	assert.Equal(t, minArchiveSweep, writer.sweepAt)
+}
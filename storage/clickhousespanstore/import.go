@@ -0,0 +1,74 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// ImportWriter writes spans imported from files in batches, synchronously on WriteSpan and Close.
+// Spans are redacted and truncated like by SpanWriter, but they are neither sampled nor discarded due to
+// max_span_count or max_pending_bytes, and failed inserts are returned to the caller instead of being retried.
+type ImportWriter struct {
+	params WorkerParams
+	size   int
+	batch  []*model.Span
+}
+
+var (
+	_ spanstore.Writer = (*ImportWriter)(nil)
+	_ io.Closer        = (*ImportWriter)(nil)
+)
+
+// NewImportWriter returns an ImportWriter for the database, which writes batches of params.Size spans.
+// The sampler and the limits of pending spans of params are ignored.
+func NewImportWriter(params SpanWriterParams) *ImportWriter {
+	registerStatementMetrics()
+	size := int(params.Size)
+	if size <= 0 {
+		size = 1
+	}
+	return &ImportWriter{
+		params: WorkerParams{
+			logger:         params.Logger,
+			db:             params.DB,
+			indexTable:     params.IndexTable,
+			spansTable:     params.SpansTable,
+			tenant:         params.Tenant,
+			encoding:       params.Encoding,
+			deduplication:  params.Deduplication,
+			serviceColumn:  params.ServiceColumn,
+			insertSettings: params.InsertSettings,
+			settings:       params.WriterSettings,
+		},
+		size:  size,
+		batch: make([]*model.Span, 0, size),
+	}
+}
+
+// WriteSpan adds the span to the batch, and writes the batch once it is full
+func (w *ImportWriter) WriteSpan(_ context.Context, span *model.Span) error {
+	w.batch = append(w.batch, span)
+	if len(w.batch) < w.size {
+		return nil
+	}
+	return w.Flush()
+}
+
+// Flush writes the spans of the batch. The batch is cleared even if writing failed.
+func (w *ImportWriter) Flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	batch := w.params.prepareBatch(w.batch)
+	w.batch = make([]*model.Span, 0, w.size)
+	worker := WriteWorker{params: &w.params, token: newDeduplicationToken()}
+	return worker.writeBatch(batch)
+}
+
+// Close implements io.Closer and writes the remaining spans
+func (w *ImportWriter) Close() error {
+	return w.Flush()
+}
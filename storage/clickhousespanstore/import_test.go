@@ -0,0 +1,77 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestImportWriter_WriteSpan(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	modelWriteExpectation := getModelWriteExpectation(spanJSON, "")
+	for _, expectation := range []expectation{modelWriteExpectation, indexWriteExpectation} {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare(expectation.preparation)
+		for _, args := range expectation.execArgs {
+			prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+	}
+	mock.ExpectBegin()
+	mock.ExpectPrepare(modelWriteExpectation.preparation).ExpectExec().WithArgs(modelWriteExpectation.execArgs[0]...).WillReturnError(errorMock)
+	mock.ExpectRollback()
+
+	// The sampler drops all spans and a single pending span exceeds max_span_count, both are ignored by imports
+	rate := 0.0
+	writer := NewImportWriter(SpanWriterParams{
+		Logger:         mocks.NewSpyLogger(),
+		DB:             db,
+		IndexTable:     testIndexTable,
+		SpansTable:     testSpansTable,
+		Encoding:       EncodingJSON,
+		Sampler:        NewSampler(SamplingRules{Rate: &rate}),
+		WriterSettings: WriterSettings{Delay: time.Hour, Size: 1, MaxSpanCount: 1},
+	})
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+	// The batch is written synchronously, so the error is reported to the caller
+	assert.ErrorIs(t, writer.WriteSpan(context.Background(), &testSpan), errorMock)
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestImportWriter_CloseWritesBatch(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	modelWriteExpectation := getModelWriteExpectation(spanJSON, "")
+	mock.ExpectBegin()
+	mock.ExpectPrepare(modelWriteExpectation.preparation).ExpectExec().WithArgs(modelWriteExpectation.execArgs[0]...).WillReturnError(errorMock)
+	mock.ExpectRollback()
+
+	writer := NewImportWriter(SpanWriterParams{
+		Logger:         mocks.NewSpyLogger(),
+		DB:             db,
+		IndexTable:     testIndexTable,
+		SpansTable:     testSpansTable,
+		Encoding:       EncodingJSON,
+		WriterSettings: WriterSettings{Delay: time.Hour, Size: 10},
+	})
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+	assert.ErrorIs(t, writer.Close(), errorMock)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,228 @@
+package clickhousespanstore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TruncatedTagKey marks spans which were truncated due to SpanLimits, its value lists the truncation reasons
+const TruncatedTagKey = "jaeger_clickhouse.truncated"
+
+const (
+	truncatedTagValue = "tag_value"
+	truncatedTags     = "tags"
+	truncatedLogs     = "logs"
+	truncatedSize     = "span_bytes"
+)
+
+var numTruncatedSpans = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_truncated_spans_total",
+	Help: "Number of spans truncated before writing due to span limits, by service and reason",
+}, []string{"service", "reason"})
+
+var registerLimitsMetrics sync.Once
+
+// SpanLimits bounds the size of spans written to ClickHouse. A zero value disables the corresponding limit.
+type SpanLimits struct {
+	// MaxTagValueLength is the maximal length in bytes of string and binary values of tags and log fields
+	MaxTagValueLength int
+	// MaxTags is the maximal number of span tags
+	MaxTags int
+	// MaxLogs is the maximal number of span logs
+	MaxLogs int
+	// MaxSpanBytes is the maximal protobuf encoded size of a span including the TruncatedTagKey tag,
+	// logs and then tags are dropped to fit it
+	MaxSpanBytes int
+}
+
+func (limits SpanLimits) enabled() bool {
+	return limits.MaxTagValueLength > 0 || limits.MaxTags > 0 || limits.MaxLogs > 0 || limits.MaxSpanBytes > 0
+}
+
+// apply returns batch with spans exceeding the limits replaced by truncated copies
+func (limits SpanLimits) apply(batch []*model.Span) []*model.Span {
+	if !limits.enabled() {
+		return batch
+	}
+	registerLimitsMetrics.Do(func() {
+		prometheus.MustRegister(numTruncatedSpans)
+	})
+
+	result := make([]*model.Span, len(batch))
+	for i, span := range batch {
+		result[i] = limits.truncate(span)
+	}
+	return result
+}
+
+// truncate returns span if it is within the limits, or its truncated copy with the TruncatedTagKey tag
+func (limits SpanLimits) truncate(span *model.Span) *model.Span {
+	truncated := *span
+	reasons := map[string]bool{}
+
+	if limits.MaxTagValueLength > 0 {
+		if tags, ok := limits.truncateValues(span.Tags); ok {
+			truncated.Tags = tags
+			reasons[truncatedTagValue] = true
+		}
+		if span.Process != nil {
+			if tags, ok := limits.truncateValues(span.Process.Tags); ok {
+				process := *span.Process
+				process.Tags = tags
+				truncated.Process = &process
+				reasons[truncatedTagValue] = true
+			}
+		}
+		logsCopied := false
+		for i, log := range span.Logs {
+			if fields, ok := limits.truncateValues(log.Fields); ok {
+				if !logsCopied {
+					truncated.Logs = append([]model.Log(nil), span.Logs...)
+					logsCopied = true
+				}
+				truncated.Logs[i].Fields = fields
+				reasons[truncatedTagValue] = true
+			}
+		}
+	}
+
+	tags, marker := withoutMarker(truncated.Tags)
+	if limits.MaxTags > 0 && len(tags) > limits.MaxTags {
+		tags = tags[:limits.MaxTags]
+		reasons[truncatedTags] = true
+	}
+	if limits.MaxLogs > 0 && len(truncated.Logs) > limits.MaxLogs {
+		truncated.Logs = truncated.Logs[:limits.MaxLogs]
+		reasons[truncatedLogs] = true
+	}
+	truncated.Tags = tags
+
+	if limits.MaxSpanBytes > 0 && truncated.Size()+markerSize(reasons, marker) > limits.MaxSpanBytes {
+		reasons[truncatedSize] = true
+		// Room is reserved for the marker tag with the final reasons
+		maxSize := limits.MaxSpanBytes - markerSize(reasons, marker)
+		// The span is encoded once, then the sizes of the dropped logs and tags are subtracted
+		size := truncated.Size()
+		for len(truncated.Logs) > 0 && size > maxSize {
+			size -= logSize(truncated.Logs[len(truncated.Logs)-1])
+			truncated.Logs = truncated.Logs[:len(truncated.Logs)-1]
+		}
+		for len(truncated.Tags) > 0 && size > maxSize {
+			size -= tagSize(truncated.Tags[len(truncated.Tags)-1])
+			truncated.Tags = truncated.Tags[:len(truncated.Tags)-1]
+		}
+	}
+
+	if len(reasons) == 0 {
+		return span
+	}
+
+	service := ""
+	if span.Process != nil {
+		service = span.Process.ServiceName
+	}
+	for reason := range reasons {
+		numTruncatedSpans.WithLabelValues(service, reason).Inc()
+	}
+	truncated.Tags = append(append([]model.KeyValue(nil), truncated.Tags...), markerTag(reasons, marker))
+	return &truncated
+}
+
+// markerTag returns the TruncatedTagKey tag with reasons. If the span was truncated before,
+// e.g. by another writer, the reasons of its previous marker are kept as well.
+func markerTag(reasons map[string]bool, marker *model.KeyValue) model.KeyValue {
+	all := make(map[string]bool, len(reasons))
+	for reason := range reasons {
+		all[reason] = true
+	}
+	if marker != nil {
+		for _, reason := range strings.Split(marker.VStr, ",") {
+			all[reason] = true
+		}
+	}
+	return model.String(TruncatedTagKey, joinReasons(all))
+}
+
+// markerSize returns the number of bytes the marker tag adds to the encoded span, which is 0 if the span is
+// neither truncated nor was truncated before
+func markerSize(reasons map[string]bool, marker *model.KeyValue) int {
+	if len(reasons) == 0 && marker == nil {
+		return 0
+	}
+	return tagSize(markerTag(reasons, marker))
+}
+
+// emptySpanSize is the encoded size of a span without fields, which includes its start time and duration
+var emptySpanSize = (&model.Span{}).Size()
+
+// tagSize returns the number of bytes tag adds to the encoded span. Repeated fields are encoded one after the other,
+// so the size of a tag does not depend on other tags.
+func tagSize(tag model.KeyValue) int {
+	return (&model.Span{Tags: []model.KeyValue{tag}}).Size() - emptySpanSize
+}
+
+// logSize returns the number of bytes log adds to the encoded span
+func logSize(log model.Log) int {
+	return (&model.Span{Logs: []model.Log{log}}).Size() - emptySpanSize
+}
+
+// truncateValues returns a copy of tags with values longer than MaxTagValueLength truncated, and whether there were any
+func (limits SpanLimits) truncateValues(tags []model.KeyValue) ([]model.KeyValue, bool) {
+	var result []model.KeyValue
+	for i, tag := range tags {
+		switch {
+		case tag.VType == model.StringType && len(tag.VStr) > limits.MaxTagValueLength:
+			if result == nil {
+				result = append([]model.KeyValue(nil), tags...)
+			}
+			result[i].VStr = truncateString(tag.VStr, limits.MaxTagValueLength)
+		case tag.VType == model.BinaryType && len(tag.VBinary) > limits.MaxTagValueLength:
+			if result == nil {
+				result = append([]model.KeyValue(nil), tags...)
+			}
+			result[i].VBinary = tag.VBinary[:limits.MaxTagValueLength]
+		}
+	}
+	return result, result != nil
+}
+
+// truncateString cuts value to at most length bytes without splitting a multibyte character
+func truncateString(value string, length int) string {
+	value = value[:length]
+	for len(value) > 0 {
+		r, size := utf8.DecodeLastRuneInString(value)
+		if r != utf8.RuneError || size != 1 {
+			break
+		}
+		value = value[:len(value)-1]
+	}
+	return value
+}
+
+// withoutMarker returns tags without the TruncatedTagKey tag, and the removed tag if there was one
+func withoutMarker(tags []model.KeyValue) ([]model.KeyValue, *model.KeyValue) {
+	for i := range tags {
+		if tags[i].Key == TruncatedTagKey {
+			marker := tags[i]
+			result := append(append([]model.KeyValue(nil), tags[:i]...), tags[i+1:]...)
+			return result, &marker
+		}
+	}
+	return tags, nil
+}
+
+func joinReasons(reasons map[string]bool) string {
+	result := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		if reason != "" {
+			result = append(result, reason)
+		}
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
@@ -0,0 +1,148 @@
+package clickhousespanstore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpanLimits_Apply(t *testing.T) {
+	newSpan := func() *model.Span {
+		return &model.Span{
+			OperationName: "operation",
+			Tags: []model.KeyValue{
+				model.String("short", "value"),
+				model.String("long", strings.Repeat("a", 100)),
+				model.Binary("binary", make([]byte, 100)),
+				model.Int64("int", 1),
+			},
+			Logs: []model.Log{
+				{Fields: []model.KeyValue{model.String("event", strings.Repeat("b", 100))}},
+				{Fields: []model.KeyValue{model.String("event", "short")}},
+				{Fields: []model.KeyValue{model.String("event", "short")}},
+			},
+			Process: model.NewProcess("service", []model.KeyValue{model.String("hostname", strings.Repeat("c", 100))}),
+		}
+	}
+
+	tests := map[string]struct {
+		limits   SpanLimits
+		expected func(*model.Span)
+		reasons  string
+	}{
+		"disabled": {
+			limits:   SpanLimits{},
+			expected: func(*model.Span) {},
+		},
+		"within limits": {
+			limits:   SpanLimits{MaxTagValueLength: 100, MaxTags: 4, MaxLogs: 3, MaxSpanBytes: 10_000},
+			expected: func(*model.Span) {},
+		},
+		"tag value length": {
+			limits: SpanLimits{MaxTagValueLength: 10},
+			expected: func(span *model.Span) {
+				span.Tags[1].VStr = strings.Repeat("a", 10)
+				span.Tags[2].VBinary = make([]byte, 10)
+				span.Logs[0].Fields[0].VStr = strings.Repeat("b", 10)
+				span.Process.Tags[0].VStr = strings.Repeat("c", 10)
+			},
+			reasons: "tag_value",
+		},
+		"tags and logs": {
+			limits: SpanLimits{MaxTags: 2, MaxLogs: 1},
+			expected: func(span *model.Span) {
+				span.Tags = span.Tags[:2]
+				span.Logs = span.Logs[:1]
+			},
+			reasons: "logs,tags",
+		},
+		"span bytes": {
+			limits: SpanLimits{MaxSpanBytes: 520},
+			expected: func(span *model.Span) {
+				span.Logs = span.Logs[:0]
+			},
+			reasons: "span_bytes",
+		},
+		"span bytes with marker": {
+			// The span fits without logs, but not with the marker tag
+			limits: SpanLimits{MaxSpanBytes: 450},
+			expected: func(span *model.Span) {
+				span.Tags = span.Tags[:2]
+				span.Logs = span.Logs[:0]
+			},
+			reasons: "span_bytes",
+		},
+		"span bytes and tags": {
+			limits: SpanLimits{MaxTags: 3, MaxSpanBytes: 450},
+			expected: func(span *model.Span) {
+				span.Tags = span.Tags[:2]
+				span.Logs = span.Logs[:0]
+			},
+			reasons: "span_bytes,tags",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			span := newSpan()
+			result := test.limits.apply([]*model.Span{span})
+			require.Len(t, result, 1)
+			assert.Equal(t, newSpan(), span, "the original span must not be modified")
+
+			expected := newSpan()
+			test.expected(expected)
+			if test.reasons != "" {
+				expected.Tags = append(expected.Tags, model.String(TruncatedTagKey, test.reasons))
+			} else {
+				assert.Same(t, span, result[0])
+			}
+			assert.Equal(t, expected, result[0])
+			if test.limits.MaxSpanBytes > 0 {
+				assert.LessOrEqual(t, result[0].Size(), test.limits.MaxSpanBytes)
+			}
+		})
+	}
+}
+
+func TestSpanLimits_FieldSizes(t *testing.T) {
+	span := &model.Span{
+		Tags: []model.KeyValue{model.String("short", "value"), model.Binary("long", make([]byte, 200))},
+		Logs: []model.Log{{Fields: []model.KeyValue{model.String("event", strings.Repeat("a", 200))}}, {}},
+	}
+	// The sizes of logs and tags add up to the encoded size of the span, so they can be subtracted when dropping them
+	size := span.Size()
+	for _, log := range span.Logs {
+		size -= logSize(log)
+	}
+	for _, tag := range span.Tags {
+		size -= tagSize(tag)
+	}
+	assert.Equal(t, (&model.Span{}).Size(), size)
+}
+
+func TestSpanLimits_ApplyTruncatedSpan(t *testing.T) {
+	limits := SpanLimits{MaxTags: 1, MaxLogs: 1}
+	span := &model.Span{
+		Tags:    []model.KeyValue{model.String("a", "a"), model.String("b", "b")},
+		Logs:    []model.Log{{}, {}},
+		Process: model.NewProcess("truncated-service", nil),
+	}
+
+	truncated := limits.apply([]*model.Span{span})[0]
+	assert.Equal(t, []model.KeyValue{model.String("a", "a"), model.String(TruncatedTagKey, "logs,tags")}, truncated.Tags)
+	assert.Equal(t, float64(1), testutil.ToFloat64(numTruncatedSpans.WithLabelValues("truncated-service", "tags")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(numTruncatedSpans.WithLabelValues("truncated-service", "logs")))
+
+	// The marker tag does not count against the limits, so truncating again keeps the span
+	assert.Same(t, truncated, limits.apply([]*model.Span{truncated})[0])
+}
+
+func TestSpanLimits_TruncateString(t *testing.T) {
+	assert.Equal(t, "abc", truncateString("abcdef", 3))
+	assert.Equal(t, "a", truncateString("aé", 2), "multibyte characters are not split")
+	assert.Equal(t, "aé", truncateString("aéb", 3))
+}
@@ -0,0 +1,95 @@
+package clickhousespanstore
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	operationInsert = "insert"
+	operationQuery  = "query"
+
+	// errorCodeUnknown labels errors which do not carry a ClickHouse error code, e.g. network errors
+	errorCodeUnknown = "unknown"
+)
+
+var (
+	insertDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_insert_duration_seconds",
+		Help:    "Latency of inserts of batches of spans, by tenant and table",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"tenant", "table"})
+	insertRows = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_insert_rows",
+		Help:    "Number of rows of successful inserts, by tenant and table",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"tenant", "table"})
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_query_duration_seconds",
+		Help:    "Latency of reads, by tenant, table and TraceReader method",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"tenant", "table", "method"})
+	numInsertRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_insert_retries_total",
+		Help: "Number of retried inserts of batches of spans, by tenant and table",
+	}, []string{"tenant", "table"})
+	numErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_errors_total",
+		Help: "Number of failed inserts and queries, by tenant, table, operation and ClickHouse error code",
+	}, []string{"tenant", "table", "operation", "code"})
+	numWrittenBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_written_bytes_total",
+		Help: "Size in bytes of the values of rows written to the spans, index and archive tables, by tenant and table",
+	}, []string{"tenant", "table"})
+	numDecodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_decode_errors_total",
+		Help: "Number of spans and trace IDs read which could not be decoded, by tenant and table",
+	}, []string{"tenant", "table"})
+)
+
+// httpErrorCode matches the error code in exceptions returned over the HTTP protocol
+var httpErrorCode = regexp.MustCompile(`Code: (\d+)`)
+
+var registerStatementMetricsOnce sync.Once
+
+func registerStatementMetrics() {
+	registerStatementMetricsOnce.Do(func() {
+		prometheus.MustRegister(insertDuration, insertRows, queryDuration, numInsertRetries, numErrors, numWrittenBytes, numDecodeErrors)
+	})
+}
+
+// observeInsert records the latency of an insert into table, and its rows if it succeeded or its error otherwise
+func observeInsert(tenant string, table TableName, rows int, duration time.Duration, err error) {
+	insertDuration.WithLabelValues(tenant, string(table)).Observe(duration.Seconds())
+	if err != nil {
+		numErrors.WithLabelValues(tenant, string(table), operationInsert, errorCode(err)).Inc()
+		return
+	}
+	insertRows.WithLabelValues(tenant, string(table)).Observe(float64(rows))
+}
+
+// observeQuery records the latency of a TraceReader method reading table, and its error if it failed
+func observeQuery(tenant string, table TableName, method string, duration time.Duration, err error) {
+	queryDuration.WithLabelValues(tenant, string(table), method).Observe(duration.Seconds())
+	if err != nil {
+		numErrors.WithLabelValues(tenant, string(table), operationQuery, errorCode(err)).Inc()
+	}
+}
+
+// errorCode returns the ClickHouse error code of err, or errorCodeUnknown if it has none
+func errorCode(err error) string {
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return strconv.Itoa(int(exception.Code))
+	}
+	if match := httpErrorCode.FindStringSubmatch(err.Error()); match != nil {
+		return match[1]
+	}
+	return errorCodeUnknown
+}
@@ -0,0 +1,145 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	metric := &dto.Metric{}
+	require.NoError(t, observer.(prometheus.Metric).Write(metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := map[string]struct {
+		err          error
+		expectedCode string
+	}{
+		"native protocol": {
+			err:          fmt.Errorf("insert: %w", &clickhouse.Exception{Code: 241, Message: "Memory limit exceeded"}),
+			expectedCode: "241",
+		},
+		"http protocol": {
+			err:          fmt.Errorf("clickhouse [execute]:: 500 code: Code: 60. DB::Exception: Table default.jaeger_spans doesn't exist"),
+			expectedCode: "60",
+		},
+		"other": {
+			err:          errorMock,
+			expectedCode: errorCodeUnknown,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expectedCode, errorCode(test.err))
+		})
+	}
+}
+
+func TestWriteWorker_Metrics(t *testing.T) {
+	const tenant = "metrics_write_tenant"
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	modelWriteExpectation := getModelWriteExpectation(spanJSON, tenant)
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare(modelWriteExpectation.preparation)
+	prep.ExpectExec().WithArgs(modelWriteExpectation.execArgs[0]...).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin().WillReturnError(&clickhouse.Exception{Code: 241})
+
+	writeWorker := getWriteWorker(mocks.NewSpyLogger(), db, EncodingJSON, testIndexTable, tenant)
+	assert.Error(t, writeWorker.writeBatch(testSpans))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, uint64(1), sampleCount(t, insertDuration.WithLabelValues(tenant, testSpansTable)))
+	assert.Equal(t, uint64(1), sampleCount(t, insertRows.WithLabelValues(tenant, testSpansTable)))
+	// The values of the tenant, timestamp, traceID and model columns
+	rowBytes := len(tenant) + 4 + len(testSpan.TraceID.String()) + len(spanJSON)
+	assert.Equal(t, float64(rowBytes), testutil.ToFloat64(numWrittenBytes.WithLabelValues(tenant, testSpansTable)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(numWrittenBytes.WithLabelValues(tenant, testIndexTable)))
+	assert.Equal(t, uint64(1), sampleCount(t, insertDuration.WithLabelValues(tenant, testIndexTable)))
+	assert.Equal(t, uint64(0), sampleCount(t, insertRows.WithLabelValues(tenant, testIndexTable)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(numErrors.WithLabelValues(tenant, testIndexTable, operationInsert, "241")))
+	assert.Equal(t, testIndexTable, string(writeWorker.pendingTable()))
+}
+
+func TestTraceReader_Metrics(t *testing.T) {
+	const tenant = "metrics_read_tenant"
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, tenant, 0, nil)
+	mock.ExpectQuery(fmt.Sprintf("SELECT service FROM %s WHERE tenant = ? GROUP BY service", testOperationsTable)).
+		WithArgs(tenant).
+		WillReturnError(errorMock)
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?) AND tenant = ?", testSpansTable)).
+		WillReturnRows(sqlmock.NewRows([]string{"model"}))
+	mock.ExpectQuery(fmt.Sprintf("SELECT model FROM %s PREWHERE traceID IN (?) AND tenant = ?", testSpansTable)).
+		WillReturnRows(sqlmock.NewRows([]string{"model"}).AddRow("{not json"))
+
+	_, err = traceReader.GetServices(context.Background())
+	assert.ErrorIs(t, err, errorMock)
+	_, err = traceReader.GetTrace(context.Background(), model.NewTraceID(1, 2))
+	assert.ErrorIs(t, err, spanstore.ErrTraceNotFound)
+	_, err = traceReader.GetTrace(context.Background(), model.NewTraceID(1, 2))
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, uint64(1), sampleCount(t, queryDuration.WithLabelValues(tenant, testOperationsTable, "GetServices")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(numErrors.WithLabelValues(tenant, testOperationsTable, operationQuery, errorCodeUnknown)))
+	assert.Equal(t, uint64(2), sampleCount(t, queryDuration.WithLabelValues(tenant, testSpansTable, "GetTrace")))
+	// A trace which is not found is not an error
+	assert.Equal(t, float64(1), testutil.ToFloat64(numErrors.WithLabelValues(tenant, testSpansTable, operationQuery, errorCodeUnknown)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(numDecodeErrors.WithLabelValues(tenant, testSpansTable)))
+}
+
+func TestTraceReader_FindTracesMetrics(t *testing.T) {
+	const tenant = "metrics_find_tenant"
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, tenant, testMaxNumSpans, nil)
+	mock.
+		ExpectQuery(fmt.Sprintf(
+			"SELECT DISTINCT traceID FROM %s WHERE service = ? AND tenant = ? AND timestamp >= ? AND timestamp <= ? ORDER BY service, timestamp DESC LIMIT ?",
+			testIndexTable,
+		)).
+		WillReturnError(errorMock)
+
+	_, err = traceReader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  "service",
+		NumTraces:    testNumTraces,
+		StartTimeMin: testStartTime,
+		StartTimeMax: testStartTime.Add(time.Hour),
+	})
+	assert.ErrorIs(t, err, errorMock)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// The failed search is counted once, under the index table
+	assert.Equal(t, uint64(1), sampleCount(t, queryDuration.WithLabelValues(tenant, testIndexTable, "FindTraceIDs")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(numErrors.WithLabelValues(tenant, testIndexTable, operationQuery, errorCodeUnknown)))
+	assert.Equal(t, uint64(0), sampleCount(t, queryDuration.WithLabelValues(tenant, testSpansTable, "FindTraces")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(numErrors.WithLabelValues(tenant, testSpansTable, operationQuery, errorCodeUnknown)))
+}
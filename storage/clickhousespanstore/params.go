@@ -2,9 +2,12 @@ package clickhousespanstore
 
 import (
 	"database/sql"
+	"sync"
 	"time"
 
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
 	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
 )
 
 // WorkerParams contains parameters that are shared between WriteWorkers
@@ -15,5 +18,77 @@ type WorkerParams struct {
 	spansTable TableName
 	tenant     string
 	encoding   Encoding
-	delay      time.Duration
+	// deduplication adds the spanID and startTime columns used for deduplication to the spans table inserts
+	deduplication bool
+	// serviceColumn adds the service column used by service TTLs to the spans table inserts
+	serviceColumn  bool
+	insertSettings InsertSettings
+	// batchController is notified about the outcome of batch writes, which it uses when adaptive batching is enabled
+	batchController *batchController
+
+	// mutex guards settings, which are updated when the configuration is reloaded
+	mutex    sync.RWMutex
+	settings WriterSettings
+}
+
+// prepareBatch returns batch with spans redacted and truncated, ready to be written
+func (params *WorkerParams) prepareBatch(batch []*model.Span) []*model.Span {
+	params.mutex.RLock()
+	spanLimits, redactor := params.settings.SpanLimits, params.settings.Redactor
+	params.mutex.RUnlock()
+	return spanLimits.apply(redactor.apply(batch))
+}
+
+func (params *WorkerParams) getDelay() time.Duration {
+	params.mutex.RLock()
+	defer params.mutex.RUnlock()
+	return params.settings.Delay
+}
+
+func (params *WorkerParams) getTagIndex() *TagIndex {
+	params.mutex.RLock()
+	defer params.mutex.RUnlock()
+	return params.settings.TagIndex
+}
+
+// update replaces the settings, which can be changed while workers are running
+func (params *WorkerParams) update(settings WriterSettings) {
+	params.mutex.Lock()
+	defer params.mutex.Unlock()
+	params.settings = settings
+}
+
+// InsertSettings controls how spans are inserted into ClickHouse
+type InsertSettings struct {
+	// Deduplication sends a deduplication token with every insert, so retried inserts are not duplicated
+	Deduplication bool
+	// Async enables async_insert, so ClickHouse buffers and batches inserts on the server side
+	Async bool
+	// WaitForAsync makes async inserts return only after the data was flushed to the table
+	WaitForAsync bool
+	// SkipBatching writes every span as soon as it arrives instead of batching spans in the plugin.
+	// It is only applied together with Async.
+	SkipBatching bool
+	// DistributedSync makes inserts into distributed tables return only after the data was written to all shards
+	DistributedSync bool
+}
+
+// settings returns the ClickHouse settings for an insert identified by token
+func (settings InsertSettings) settings(token string) clickhouse.Settings {
+	result := clickhouse.Settings{}
+	if settings.Deduplication && token != "" {
+		result["insert_deduplication_token"] = token
+	}
+	if settings.Async {
+		result["async_insert"] = 1
+		if settings.WaitForAsync {
+			result["wait_for_async_insert"] = 1
+		} else {
+			result["wait_for_async_insert"] = 0
+		}
+	}
+	if settings.DistributedSync {
+		result["insert_distributed_sync"] = 1
+	}
+	return result
 }
@@ -3,6 +3,7 @@ package clickhousespanstore
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,48 +12,66 @@ import (
 var (
 	numDiscardedSpans = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "jaeger_clickhouse_discarded_spans",
-		Help: "Count of spans that have been discarded due to pending writes exceeding max_span_count",
+		Help: "Count of spans that have been discarded due to pending writes exceeding max_span_count or max_pending_bytes",
 	})
 	numPendingSpans = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "jaeger_clickhouse_pending_spans",
 		Help: "Number of spans that are currently pending, counts against max_span_count",
 	})
+	numPendingBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_pending_bytes",
+		Help: "Size in bytes of spans that are currently pending, counts against max_pending_bytes",
+	})
 )
 
 // WriteWorkerPool is a worker pool for writing batches of spans.
 // Given a new batch, WriteWorkerPool creates a new WriteWorker.
 // If the number of currently processed spans if more than maxSpanCount, then the oldest worker is removed.
+// Batches which would make the number of pending spans exceed maxSpanCount,
+// or the size of pending spans exceed maxPendingBytes, are discarded.
 type WriteWorkerPool struct {
 	params *WorkerParams
 
 	finish  chan bool
 	done    sync.WaitGroup
-	batches chan []*model.Span
+	batches chan preparedBatch
+
+	// mutex guards maxSpanCount and maxPendingBytes, which are changed by setLimits while the pool works
+	mutex           sync.Mutex
+	maxSpanCount    int
+	maxPendingBytes int64
+	workers         workerHeap
+	workerDone      chan *WriteWorker
+
+	// pendingSpans is the number of spans of batches which are being written
+	pendingSpans atomic.Int64
+}
 
-	maxSpanCount int
-	mutex        sync.Mutex
-	workers      workerHeap
-	workerDone   chan *WriteWorker
+// preparedBatch is a batch of redacted and truncated spans with its size counted against maxPendingBytes
+type preparedBatch struct {
+	spans []*model.Span
+	bytes int64
 }
 
 var registerPoolMetrics sync.Once
 
-func NewWorkerPool(params *WorkerParams, maxSpanCount int) WriteWorkerPool {
+func NewWorkerPool(params *WorkerParams, maxSpanCount int, maxPendingBytes int64) WriteWorkerPool {
 	registerPoolMetrics.Do(func() {
-		prometheus.MustRegister(numDiscardedSpans, numPendingSpans)
+		prometheus.MustRegister(numDiscardedSpans, numPendingSpans, numPendingBytes)
 	})
 
 	return WriteWorkerPool{
 		params:  params,
 		finish:  make(chan bool),
 		done:    sync.WaitGroup{},
-		batches: make(chan []*model.Span),
+		batches: make(chan preparedBatch),
 
 		mutex:      sync.Mutex{},
 		workers:    newWorkerHeap(100),
 		workerDone: make(chan *WriteWorker),
 
-		maxSpanCount: maxSpanCount,
+		maxSpanCount:    maxSpanCount,
+		maxPendingBytes: maxPendingBytes,
 	}
 }
 
@@ -60,21 +79,26 @@ func (pool *WriteWorkerPool) Work() {
 	finish := false
 	nextWorkerID := int32(1)
 	pendingSpanCount := 0
+	pendingBytes := int64(0)
 	for {
 		// Initialize to zero, or update value from previous loop
 		numPendingSpans.Set(float64(pendingSpanCount))
+		numPendingBytes.Set(float64(pendingBytes))
+		pool.pendingSpans.Store(int64(pendingSpanCount))
 
 		pool.done.Add(1)
 		select {
-		case batch := <-pool.batches:
-			batchSize := len(batch)
-			if pool.checkLimit(pendingSpanCount, batchSize) {
+		case prepared := <-pool.batches:
+			batch, batchSize, batchBytes := prepared.spans, len(prepared.spans), prepared.bytes
+			if pool.checkLimit(pendingSpanCount, batchSize, pendingBytes, batchBytes) {
 				// Limit disabled or batch fits within limit, write the batch.
 				worker := WriteWorker{
 					workerID: nextWorkerID,
 
-					params: pool.params,
-					batch:  batch,
+					params:     pool.params,
+					batch:      batch,
+					batchBytes: batchBytes,
+					token:      newDeduplicationToken(),
 
 					finish:     make(chan bool),
 					workerDone: pool.workerDone,
@@ -87,15 +111,18 @@ func (pool *WriteWorkerPool) Work() {
 				}
 				pool.workers.AddWorker(&worker)
 				pendingSpanCount += batchSize
+				pendingBytes += batchBytes
 				go worker.Work()
 			} else {
 				// Limit exceeded, complain
 				numDiscardedSpans.Add(float64(batchSize))
-				pool.params.logger.Error("Discarding batch of spans due to exceeding pending span count", "batch_size", batchSize, "pending_span_count", pendingSpanCount, "max_span_count", pool.maxSpanCount)
+				maxSpanCount, maxPendingBytes := pool.getLimits()
+				pool.params.logger.Error("Discarding batch of spans due to exceeding pending span count or size", "batch_size", batchSize, "pending_span_count", pendingSpanCount, "max_span_count", maxSpanCount, "batch_bytes", batchBytes, "pending_bytes", pendingBytes, "max_pending_bytes", maxPendingBytes)
 			}
 		case worker := <-pool.workerDone:
 			// The worker has finished, subtract its work from the count and clean it from the heap.
 			pendingSpanCount -= len(worker.batch)
+			pendingBytes -= worker.batchBytes
 			if err := pool.workers.RemoveWorker(worker); err != nil {
 				pool.params.logger.Error("could not remove worker", "worker", worker, "error", err)
 			}
@@ -111,8 +138,11 @@ func (pool *WriteWorkerPool) Work() {
 	}
 }
 
+// WriteBatch redacts and truncates batch, and measures the size of the resulting spans on the calling goroutine,
+// so the pool only compares sizes against the limits
 func (pool *WriteWorkerPool) WriteBatch(batch []*model.Span) {
-	pool.batches <- batch
+	batch = pool.params.prepareBatch(batch)
+	pool.batches <- preparedBatch{spans: batch, bytes: batchByteSize(batch)}
 }
 
 func (pool *WriteWorkerPool) Close() {
@@ -120,12 +150,37 @@ func (pool *WriteWorkerPool) Close() {
 	pool.done.Wait()
 }
 
-// checkLimit returns whether batchSize fits within the maxSpanCount
-func (pool *WriteWorkerPool) checkLimit(pendingSpanCount int, batchSize int) bool {
-	if pool.maxSpanCount <= 0 {
-		return true
+// setLimits replaces the limits of pending spans, which apply to batches written from now on
+func (pool *WriteWorkerPool) setLimits(maxSpanCount int, maxPendingBytes int64) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.maxSpanCount = maxSpanCount
+	pool.maxPendingBytes = maxPendingBytes
+}
+
+func (pool *WriteWorkerPool) getLimits() (int, int64) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.maxSpanCount, pool.maxPendingBytes
+}
+
+// checkLimit returns whether batchSize fits within the maxSpanCount and batchBytes fits within the maxPendingBytes
+func (pool *WriteWorkerPool) checkLimit(pendingSpanCount int, batchSize int, pendingBytes int64, batchBytes int64) bool {
+	maxSpanCount, maxPendingBytes := pool.getLimits()
+	if maxSpanCount > 0 && pendingSpanCount+batchSize > maxSpanCount {
+		return false
+	}
+	if maxPendingBytes > 0 && pendingBytes+batchBytes > maxPendingBytes {
+		return false
 	}
+	return true
+}
 
-	// Check limit, add batchSize if within limit
-	return pendingSpanCount+batchSize <= pool.maxSpanCount
+// batchByteSize returns the protobuf encoded size of the spans in batch, approximating the memory they hold
+func batchByteSize(batch []*model.Span) int64 {
+	size := int64(0)
+	for _, span := range batch {
+		size += int64(span.Size())
+	}
+	return size
 }
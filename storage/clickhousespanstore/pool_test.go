@@ -0,0 +1,92 @@
+package clickhousespanstore
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteWorkerPool_CheckLimit(t *testing.T) {
+	tests := map[string]struct {
+		maxSpanCount     int
+		maxPendingBytes  int64
+		pendingSpanCount int
+		pendingBytes     int64
+		expected         bool
+	}{
+		"no limits": {
+			pendingSpanCount: 1_000_000,
+			pendingBytes:     1_000_000_000,
+			expected:         true,
+		},
+		"within limits": {
+			maxSpanCount:     100,
+			maxPendingBytes:  10_000,
+			pendingSpanCount: 90,
+			pendingBytes:     9_000,
+			expected:         true,
+		},
+		"span count exceeded": {
+			maxSpanCount:     100,
+			maxPendingBytes:  10_000,
+			pendingSpanCount: 91,
+			pendingBytes:     9_000,
+			expected:         false,
+		},
+		"pending bytes exceeded": {
+			maxSpanCount:     100,
+			maxPendingBytes:  10_000,
+			pendingSpanCount: 90,
+			pendingBytes:     9_001,
+			expected:         false,
+		},
+		"only pending bytes limit": {
+			maxPendingBytes:  10_000,
+			pendingSpanCount: 1_000_000,
+			pendingBytes:     9_001,
+			expected:         false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pool := NewWorkerPool(&WorkerParams{}, test.maxSpanCount, test.maxPendingBytes)
+			assert.Equal(t, test.expected, pool.checkLimit(test.pendingSpanCount, 10, test.pendingBytes, 1_000))
+		})
+	}
+}
+
+func TestWriteWorkerPool_SetLimits(t *testing.T) {
+	pool := NewWorkerPool(&WorkerParams{}, 100, 0)
+	assert.False(t, pool.checkLimit(95, 10, 0, 1_000))
+
+	pool.setLimits(200, 1_000)
+	assert.True(t, pool.checkLimit(95, 10, 0, 1_000))
+	assert.False(t, pool.checkLimit(95, 10, 1, 1_000))
+}
+
+func TestWriteWorkerPool_BatchByteSize(t *testing.T) {
+	small := &model.Span{OperationName: "a"}
+	large := &model.Span{OperationName: "a", Logs: []model.Log{{Fields: []model.KeyValue{model.String("message", string(make([]byte, 10_000)))}}}}
+
+	assert.Equal(t, int64(0), batchByteSize(nil))
+	assert.Equal(t, int64(small.Size()+large.Size()), batchByteSize([]*model.Span{small, large}))
+	assert.Greater(t, batchByteSize([]*model.Span{large}), int64(10_000))
+}
+
+func TestWriteWorkerPool_WriteBatchPrepares(t *testing.T) {
+	params := &WorkerParams{settings: WriterSettings{SpanLimits: SpanLimits{MaxSpanBytes: 200}}}
+	pool := NewWorkerPool(params, 0, 1_000)
+	large := &model.Span{OperationName: "a", Logs: []model.Log{{Fields: []model.KeyValue{model.String("message", string(make([]byte, 10_000)))}}}}
+
+	go pool.WriteBatch([]*model.Span{large})
+	prepared := <-pool.batches
+	// The size is measured after truncation, so the batch fits within max_pending_bytes
+	require.Len(t, prepared.spans, 1)
+	assert.Empty(t, prepared.spans[0].Logs)
+	assert.Equal(t, batchByteSize(prepared.spans), prepared.bytes)
+	assert.LessOrEqual(t, prepared.bytes, int64(200))
+	assert.True(t, pool.checkLimit(0, 1, 0, prepared.bytes))
+}
@@ -7,12 +7,14 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
@@ -21,6 +23,13 @@ const (
 	maxProgressiveSteps                   = 4
 )
 
+var (
+	numDuplicateSpans = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_duplicate_spans_total",
+		Help: "Number of duplicated spans which were removed from read traces",
+	})
+)
+
 var (
 	errNoOperationsTable = errors.New("no operations table supplied")
 	errNoIndexTable      = errors.New("no index table supplied")
@@ -34,13 +43,28 @@ type TraceReader struct {
 	indexTable      TableName
 	spansTable      TableName
 	tenant          string
-	maxNumSpans     uint
+
+	// mutex guards maxNumSpans and tagIndex, which are changed by Update
+	mutex       sync.RWMutex
+	maxNumSpans uint
+	tagIndex    *TagIndex
+}
+
+// spanKey identifies a span within a trace for deduplication
+type spanKey struct {
+	spanID    model.SpanID
+	startTime int64
 }
 
+var registerReaderMetrics sync.Once
 var _ spanstore.Reader = (*TraceReader)(nil)
 
 // NewTraceReader returns a TraceReader for the database
-func NewTraceReader(db *sql.DB, operationsTable, indexTable, spansTable TableName, tenant string, maxNumSpans uint) *TraceReader {
+func NewTraceReader(db *sql.DB, operationsTable, indexTable, spansTable TableName, tenant string, maxNumSpans uint, tagIndex *TagIndex) *TraceReader {
+	registerReaderMetrics.Do(func() {
+		prometheus.MustRegister(numDuplicateSpans)
+	})
+	registerStatementMetrics()
 	return &TraceReader{
 		db:              db,
 		operationsTable: operationsTable,
@@ -48,9 +72,26 @@ func NewTraceReader(db *sql.DB, operationsTable, indexTable, spansTable TableNam
 		spansTable:      spansTable,
 		tenant:          tenant,
 		maxNumSpans:     maxNumSpans,
+		tagIndex:        tagIndex,
 	}
 }
 
+// observe records the latency of method reading table since start, and its error if it failed
+func (r *TraceReader) observe(method string, table TableName, start time.Time, err error) {
+	if errors.Is(err, spanstore.ErrTraceNotFound) {
+		err = nil
+	}
+	observeQuery(r.tenant, table, method, time.Since(start), err)
+}
+
+// Update replaces the maximum number of spans fetched per trace and the rules of indexed tags
+func (r *TraceReader) Update(maxNumSpans uint, tagIndex *TagIndex) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.maxNumSpans = maxNumSpans
+	r.tagIndex = tagIndex
+}
+
 func (r *TraceReader) getTraces(ctx context.Context, traceIDs []model.TraceID) ([]*model.Trace, error) {
 	returning := make([]*model.Trace, 0, len(traceIDs))
 
@@ -76,8 +117,11 @@ func (r *TraceReader) getTraces(ctx context.Context, traceIDs []model.TraceID) (
 		args = append(args, r.tenant)
 	}
 
-	if r.maxNumSpans > 0 {
-		query += fmt.Sprintf(" ORDER BY timestamp LIMIT %d BY traceID", r.maxNumSpans)
+	r.mutex.RLock()
+	maxNumSpans := r.maxNumSpans
+	r.mutex.RUnlock()
+	if maxNumSpans > 0 {
+		query += fmt.Sprintf(" ORDER BY timestamp LIMIT %d BY traceID", maxNumSpans)
 	}
 
 	span.SetTag("db.statement", query)
@@ -91,6 +135,8 @@ func (r *TraceReader) getTraces(ctx context.Context, traceIDs []model.TraceID) (
 	defer rows.Close()
 
 	traces := map[model.TraceID]*model.Trace{}
+	// Clients and collectors may retry writes, so the same span can be stored more than once
+	seen := map[model.TraceID]map[spanKey]bool{}
 
 	for rows.Next() {
 		var serialized string
@@ -109,12 +155,21 @@ func (r *TraceReader) getTraces(ctx context.Context, traceIDs []model.TraceID) (
 		}
 
 		if err != nil {
+			numDecodeErrors.WithLabelValues(r.tenant, string(r.spansTable)).Inc()
 			return nil, err
 		}
 
 		if _, ok := traces[span.TraceID]; !ok {
 			traces[span.TraceID] = &model.Trace{}
+			seen[span.TraceID] = map[spanKey]bool{}
+		}
+
+		key := spanKey{spanID: span.SpanID, startTime: span.StartTime.UnixNano()}
+		if seen[span.TraceID][key] {
+			numDuplicateSpans.Inc()
+			continue
 		}
+		seen[span.TraceID][key] = true
 
 		traces[span.TraceID].Spans = append(traces[span.TraceID].Spans, &span)
 	}
@@ -133,10 +188,13 @@ func (r *TraceReader) getTraces(ctx context.Context, traceIDs []model.TraceID) (
 }
 
 // GetTrace takes a traceID and returns a Trace associated with that traceID
-func (r *TraceReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+func (r *TraceReader) GetTrace(ctx context.Context, traceID model.TraceID) (trace *model.Trace, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "GetTrace")
 	defer span.Finish()
 
+	start := time.Now()
+	defer func() { r.observe("GetTrace", r.spansTable, start, err) }()
+
 	traces, err := r.getTraces(ctx, []model.TraceID{traceID})
 	if err != nil {
 		return nil, err
@@ -175,7 +233,7 @@ func (r *TraceReader) getStrings(ctx context.Context, sql string, args ...interf
 }
 
 // GetServices fetches the sorted service list that have not expired
-func (r *TraceReader) GetServices(ctx context.Context) ([]string, error) {
+func (r *TraceReader) GetServices(ctx context.Context) (services []string, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "GetServices")
 	defer span.Finish()
 
@@ -183,6 +241,9 @@ func (r *TraceReader) GetServices(ctx context.Context) ([]string, error) {
 		return nil, errNoOperationsTable
 	}
 
+	start := time.Now()
+	defer func() { r.observe("GetServices", r.operationsTable, start, err) }()
+
 	query := fmt.Sprintf("SELECT service FROM %s", r.operationsTable)
 	args := make([]interface{}, 0)
 
@@ -202,7 +263,7 @@ func (r *TraceReader) GetServices(ctx context.Context) ([]string, error) {
 func (r *TraceReader) GetOperations(
 	ctx context.Context,
 	params spanstore.OperationQueryParameters,
-) ([]spanstore.Operation, error) {
+) (operations []spanstore.Operation, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "GetOperations")
 	defer span.Finish()
 
@@ -210,6 +271,9 @@ func (r *TraceReader) GetOperations(
 		return nil, errNoOperationsTable
 	}
 
+	start := time.Now()
+	defer func() { r.observe("GetOperations", r.operationsTable, start, err) }()
+
 	//nolint:gosec  , G201: SQL string formatting
 	query := fmt.Sprintf("SELECT operation, spankind FROM %s WHERE", r.operationsTable)
 	args := make([]interface{}, 0)
@@ -232,7 +296,7 @@ func (r *TraceReader) GetOperations(
 
 	defer rows.Close()
 
-	operations := make([]spanstore.Operation, 0)
+	operations = make([]spanstore.Operation, 0)
 
 	for rows.Next() {
 		var name, spanKind string
@@ -254,20 +318,23 @@ func (r *TraceReader) GetOperations(
 }
 
 // FindTraces retrieves traces that match the traceQuery
-func (r *TraceReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+func (r *TraceReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) (traces []*model.Trace, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraces")
 	defer span.Finish()
 
+	// The search of trace IDs is observed by FindTraceIDs, under the index table
 	traceIDs, err := r.FindTraceIDs(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 
+	start := time.Now()
+	defer func() { r.observe("FindTraces", r.spansTable, start, err) }()
 	return r.getTraces(ctx, traceIDs)
 }
 
 // FindTraceIDs retrieves only the TraceIDs that match the traceQuery, but not the trace data
-func (r *TraceReader) FindTraceIDs(ctx context.Context, params *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+func (r *TraceReader) FindTraceIDs(ctx context.Context, params *spanstore.TraceQueryParameters) (traceIDs []model.TraceID, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraceIDs")
 	defer span.Finish()
 
@@ -275,6 +342,16 @@ func (r *TraceReader) FindTraceIDs(ctx context.Context, params *spanstore.TraceQ
 		return nil, errStartTimeRequired
 	}
 
+	r.mutex.RLock()
+	tagIndex := r.tagIndex
+	r.mutex.RUnlock()
+	if err := tagIndex.checkSearch(params.ServiceName, params.Tags); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	defer func() { r.observe("FindTraceIDs", r.indexTable, start, err) }()
+
 	end := params.StartTimeMax
 	if end.IsZero() {
 		end = time.Now()
@@ -399,6 +476,7 @@ func (r *TraceReader) findTraceIDsInRange(ctx context.Context, params *spanstore
 	for i, traceIDString := range traceIDStrings {
 		traceID, err := model.TraceIDFromString(traceIDString)
 		if err != nil {
+			numDecodeErrors.WithLabelValues(r.tenant, string(r.indexTable)).Inc()
 			return nil, err
 		}
 		traceIDs[i] = traceID
@@ -54,7 +54,7 @@ func TestTraceReader_FindTraceIDs(t *testing.T) {
 			require.NoError(t, err, "an error was not expected when opening a stub database connection")
 			defer db.Close()
 
-			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans)
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans, nil)
 			start := testStartTime
 			end := start.Add(24 * time.Hour)
 			fullDuration := end.Sub(start)
@@ -130,7 +130,7 @@ func TestTraceReader_FindTraceIDsShortDurationAfterReduction(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	service := "service"
 	start := testStartTime
 	end := start.Add(8 * time.Hour)
@@ -213,7 +213,7 @@ func TestTraceReader_FindTraceIDsEarlyExit(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	service := "service"
 	start := testStartTime
 	end := start.Add(24 * time.Hour)
@@ -266,7 +266,7 @@ func TestTraceReader_FindTraceIDsShortRange(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	service := "service"
 	start := testStartTime
 	end := start.Add(time.Hour)
@@ -309,7 +309,7 @@ func TestTraceReader_FindTraceIDsQueryError(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	service := "service"
 	start := testStartTime
 	end := start.Add(24 * time.Hour)
@@ -348,7 +348,7 @@ func TestTraceReader_FindTraceIDsZeroStartTime(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	service := "service"
 	start := time.Time{}
 	end := testStartTime
@@ -365,6 +365,48 @@ func TestTraceReader_FindTraceIDsZeroStartTime(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestTraceReader_FindTraceIDsUnindexedTag(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	tagIndex := NewTagIndex(mocks.NewSpyLogger(), TagIndexRules{DenyKeys: []string{"key"}, RejectUnindexedSearches: true})
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, tagIndex)
+	params := spanstore.TraceQueryParameters{
+		ServiceName:  "service",
+		NumTraces:    testNumTraces,
+		StartTimeMin: testStartTime,
+		StartTimeMax: testStartTime.Add(time.Minute),
+		Tags:         map[string]string{"key": "value"},
+	}
+
+	traceIDs, err := traceReader.FindTraceIDs(context.Background(), &params)
+	require.EqualError(t, err, `tags key are not indexed for service "service"`)
+	assert.Equal(t, []model.TraceID(nil), traceIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTraceReader_Update(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
+	traceReader.Update(0, NewTagIndex(mocks.NewSpyLogger(), TagIndexRules{DenyKeys: []string{"key"}, RejectUnindexedSearches: true}))
+	params := spanstore.TraceQueryParameters{
+		ServiceName:  "service",
+		NumTraces:    testNumTraces,
+		StartTimeMin: testStartTime,
+		StartTimeMax: testStartTime.Add(time.Minute),
+		Tags:         map[string]string{"key": "value"},
+	}
+
+	_, err = traceReader.FindTraceIDs(context.Background(), &params)
+	require.EqualError(t, err, `tags key are not indexed for service "service"`)
+	assert.Equal(t, uint(0), traceReader.maxNumSpans)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestTraceReader_GetServices(t *testing.T) {
 	tests := map[string]struct {
 		query  string
@@ -388,7 +430,7 @@ func TestTraceReader_GetServices(t *testing.T) {
 			require.NoError(t, err, "an error was not expected when opening a stub database connection")
 			defer db.Close()
 
-			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans)
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans, nil)
 			expectedServices := []string{"GET /first", "POST /second", "PUT /third"}
 			expectedServiceValues := make([]driver.Value, len(expectedServices))
 			for i := range expectedServices {
@@ -411,7 +453,7 @@ func TestTraceReader_GetServicesQueryError(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 
 	mock.
 		ExpectQuery(fmt.Sprintf("SELECT service FROM %s GROUP BY service", testOperationsTable)).
@@ -427,7 +469,7 @@ func TestTraceReader_GetServicesNoTable(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, "", testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, "", testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 
 	services, err := traceReader.GetServices(context.Background())
 	require.ErrorIs(t, err, errNoOperationsTable)
@@ -473,7 +515,7 @@ func TestTraceReader_GetOperations(t *testing.T) {
 				WithArgs(test.args...).
 				WillReturnRows(test.rows)
 
-			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans)
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans, nil)
 			operations, err := traceReader.GetOperations(context.Background(), params)
 			require.NoError(t, err)
 			assert.Equal(t, test.expected, operations)
@@ -487,7 +529,7 @@ func TestTraceReader_GetOperationsQueryError(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	service := "test service"
 	params := spanstore.OperationQueryParameters{ServiceName: service}
 	mock.
@@ -506,7 +548,7 @@ func TestTraceReader_GetOperationsNoTable(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, "", testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, "", testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	service := "test service"
 	params := spanstore.OperationQueryParameters{ServiceName: service}
 	operations, err := traceReader.GetOperations(context.Background(), params)
@@ -559,6 +601,11 @@ func TestTraceReader_GetTrace(t *testing.T) {
 			expectedTrace: &trace,
 			expectedError: nil,
 		},
+		"duplicated spans": {
+			queryResult:   getEncodedSpans(append(spans, spans...), func(span *model.Span) ([]byte, error) { return json.Marshal(span) }),
+			expectedTrace: &trace,
+			expectedError: nil,
+		},
 		"trace not found": {
 			queryResult:   sqlmock.NewRows([]string{"model"}),
 			expectedTrace: nil,
@@ -589,7 +636,7 @@ func TestTraceReader_GetTrace(t *testing.T) {
 					WillReturnRows(test.queryResult)
 			}
 
-			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans)
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans, nil)
 			trace, err := traceReader.GetTrace(context.Background(), traceID)
 			require.ErrorIs(t, err, test.expectedError)
 			if trace != nil {
@@ -698,7 +745,7 @@ func TestSpanWriter_getTraces(t *testing.T) {
 				WithArgs(test.args...).
 				WillReturnRows(test.queryResult)
 
-			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans)
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans, nil)
 			traces, err := traceReader.getTraces(context.Background(), traceIDs)
 			require.NoError(t, err)
 			model.SortTraces(traces)
@@ -781,7 +828,7 @@ func TestSpanWriter_getTracesIncorrectData(t *testing.T) {
 				WithArgs(test.args...).
 				WillReturnRows(test.queryResult)
 
-			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans)
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans, nil)
 			traces, err := traceReader.getTraces(context.Background(), traceIDs)
 			if test.expectedError == nil {
 				assert.NoError(t, err)
@@ -799,7 +846,7 @@ func TestSpanWriter_getTracesQueryError(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	traceIDs := []model.TraceID{
 		{High: 0, Low: 1},
 		{High: 2, Low: 2},
@@ -830,7 +877,7 @@ func TestSpanWriter_getTracesRowsScanError(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	traceIDs := []model.TraceID{
 		{High: 0, Low: 1},
 		{High: 2, Low: 2},
@@ -862,7 +909,7 @@ func TestSpanWriter_getTraceNoTraceIDs(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	traceIDs := make([]model.TraceID, 0)
 
 	traces, err := traceReader.getTraces(context.Background(), traceIDs)
@@ -1073,7 +1120,7 @@ func TestSpanWriter_findTraceIDsInRange(t *testing.T) {
 				WithArgs(test.expectedArgs...).
 				WillReturnRows(queryResult)
 
-			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans)
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans, nil)
 			res, err := traceReader.findTraceIDsInRange(
 				context.Background(),
 				&test.queryParams,
@@ -1092,7 +1139,7 @@ func TestSpanReader_findTraceIDsInRangeNoIndexTable(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, "", testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, "", testSpansTable, "", testMaxNumSpans, nil)
 	res, err := traceReader.findTraceIDsInRange(
 		context.Background(),
 		nil,
@@ -1109,7 +1156,7 @@ func TestSpanReader_findTraceIDsInRangeEndBeforeStart(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	res, err := traceReader.findTraceIDsInRange(
 		context.Background(),
 		nil,
@@ -1126,7 +1173,7 @@ func TestSpanReader_findTraceIDsInRangeQueryError(t *testing.T) {
 	require.NoError(t, err, "an error was not expected when opening a stub database connection")
 	defer db.Close()
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 	service := "test_service"
 	start := time.Unix(0, 0)
 	end := time.Now()
@@ -1188,7 +1235,7 @@ func TestSpanReader_findTraceIDsInRangeIncorrectData(t *testing.T) {
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans)
+			traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, test.tenant, testMaxNumSpans, nil)
 
 			rowValues := []driver.Value{
 				"1",
@@ -1230,7 +1277,7 @@ func TestSpanReader_getStrings(t *testing.T) {
 	}
 	mock.ExpectQuery(query).WithArgs(argValues...).WillReturnRows(result)
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 
 	queryResult, err := traceReader.getStrings(context.Background(), query, args...)
 	assert.NoError(t, err)
@@ -1248,7 +1295,7 @@ func TestSpanReader_getStringsQueryError(t *testing.T) {
 	args := []interface{}{"a"}
 	mock.ExpectQuery(query).WithArgs(argValues...).WillReturnError(errorMock)
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 
 	queryResult, err := traceReader.getStrings(context.Background(), query, args...)
 	assert.EqualError(t, err, errorMock.Error())
@@ -1272,7 +1319,7 @@ func TestSpanReader_getStringsRowError(t *testing.T) {
 	result.RowError(2, errorMock)
 	mock.ExpectQuery(query).WithArgs(argValues...).WillReturnRows(result)
 
-	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans)
+	traceReader := NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", testMaxNumSpans, nil)
 
 	queryResult, err := traceReader.getStrings(context.Background(), query, args...)
 	assert.EqualError(t, err, errorMock.Error())
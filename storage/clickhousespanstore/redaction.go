@@ -0,0 +1,218 @@
+package clickhousespanstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultMaskReplacement = "***"
+	// hashedValuePrefix marks hashed values, so they are not hashed again when redacted spans are written again,
+	// e.g. when a trace is archived
+	hashedValuePrefix = "sha256:"
+
+	ruleAllowKeys = "allow_keys"
+	ruleDenyKeys  = "deny_keys"
+	ruleHashKeys  = "hash_keys"
+)
+
+var numRedactionHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_redaction_hits_total",
+	Help: "Number of tags and log fields changed or removed by redaction, by rule",
+}, []string{"rule"})
+
+var registerRedactionMetrics sync.Once
+
+// RedactionRules configures redaction of span tags, process tags and log fields before spans are written
+type RedactionRules struct {
+	// AllowKeys, if non-empty, are the only keys which are kept, all others are removed
+	AllowKeys []string `yaml:"allow_keys"`
+	// DenyKeys are removed
+	DenyKeys []string `yaml:"deny_keys"`
+	// HashKeys have their values replaced by "sha256:" and the hex encoded SHA-256 hash of HashSalt and the value.
+	// Values which are already hashed are kept, and masks are not applied to hashed values.
+	HashKeys []string `yaml:"hash_keys"`
+	HashSalt string   `yaml:"hash_salt"`
+	// Masks replace matches in string values
+	Masks []MaskRule `yaml:"masks"`
+}
+
+// MaskRule replaces matches of Pattern in string values with Replacement
+type MaskRule struct {
+	// Name identifies the rule in the jaeger_clickhouse_redaction_hits_total metric. Default is the pattern.
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+	// Replacement may refer to submatches, e.g. "${1}***". Default "***".
+	Replacement string `yaml:"replacement"`
+	// Keys, if non-empty, restricts the rule to values of these keys
+	Keys []string `yaml:"keys"`
+}
+
+// Redactor applies RedactionRules to spans
+type Redactor struct {
+	allowKeys map[string]bool
+	denyKeys  map[string]bool
+	hashKeys  map[string]bool
+	hashSalt  string
+	masks     []mask
+}
+
+type mask struct {
+	name        string
+	pattern     *regexp.Regexp
+	replacement string
+	keys        map[string]bool
+}
+
+// NewRedactor returns a Redactor for rules, or nil if rules are empty
+func NewRedactor(rules RedactionRules) (*Redactor, error) {
+	if len(rules.AllowKeys) == 0 && len(rules.DenyKeys) == 0 && len(rules.HashKeys) == 0 && len(rules.Masks) == 0 {
+		return nil, nil
+	}
+	registerRedactionMetrics.Do(func() {
+		prometheus.MustRegister(numRedactionHits)
+	})
+
+	redactor := &Redactor{
+		allowKeys: toSet(rules.AllowKeys),
+		denyKeys:  toSet(rules.DenyKeys),
+		hashKeys:  toSet(rules.HashKeys),
+		hashSalt:  rules.HashSalt,
+	}
+	for _, rule := range rules.Masks {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("could not compile redaction mask %q: %w", rule.Pattern, err)
+		}
+		name := rule.Name
+		if name == "" {
+			name = rule.Pattern
+		}
+		replacement := rule.Replacement
+		if replacement == "" {
+			replacement = defaultMaskReplacement
+		}
+		redactor.masks = append(redactor.masks, mask{
+			name:        name,
+			pattern:     pattern,
+			replacement: replacement,
+			keys:        toSet(rule.Keys),
+		})
+	}
+	return redactor, nil
+}
+
+// apply returns batch with spans affected by the rules replaced by redacted copies. A nil Redactor returns batch.
+func (redactor *Redactor) apply(batch []*model.Span) []*model.Span {
+	if redactor == nil {
+		return batch
+	}
+	result := make([]*model.Span, len(batch))
+	for i, span := range batch {
+		result[i] = redactor.redactSpan(span)
+	}
+	return result
+}
+
+func (redactor *Redactor) redactSpan(span *model.Span) *model.Span {
+	redacted := *span
+	changed := false
+
+	if tags, ok := redactor.redact(span.Tags); ok {
+		redacted.Tags = tags
+		changed = true
+	}
+	if span.Process != nil {
+		if tags, ok := redactor.redact(span.Process.Tags); ok {
+			process := *span.Process
+			process.Tags = tags
+			redacted.Process = &process
+			changed = true
+		}
+	}
+	logsCopied := false
+	for i, log := range span.Logs {
+		if fields, ok := redactor.redact(log.Fields); ok {
+			if !logsCopied {
+				redacted.Logs = append([]model.Log(nil), span.Logs...)
+				logsCopied = true
+			}
+			redacted.Logs[i].Fields = fields
+			changed = true
+		}
+	}
+
+	if !changed {
+		return span
+	}
+	return &redacted
+}
+
+// redact returns the redacted copy of tags, and whether any of them was changed
+func (redactor *Redactor) redact(tags []model.KeyValue) ([]model.KeyValue, bool) {
+	result := make([]model.KeyValue, 0, len(tags))
+	changed := false
+	for _, tag := range tags {
+		switch {
+		case len(redactor.allowKeys) > 0 && !redactor.allowKeys[tag.Key]:
+			numRedactionHits.WithLabelValues(ruleAllowKeys).Inc()
+			changed = true
+			continue
+		case redactor.denyKeys[tag.Key]:
+			numRedactionHits.WithLabelValues(ruleDenyKeys).Inc()
+			changed = true
+			continue
+		case redactor.hashKeys[tag.Key]:
+			if tag.VType != model.StringType || !isHashed(tag.VStr) {
+				numRedactionHits.WithLabelValues(ruleHashKeys).Inc()
+				hash := sha256.Sum256([]byte(redactor.hashSalt + tag.AsString()))
+				tag = model.String(tag.Key, hashedValuePrefix+hex.EncodeToString(hash[:]))
+				changed = true
+			}
+			result = append(result, tag)
+			continue
+		}
+
+		if tag.VType == model.StringType {
+			for _, mask := range redactor.masks {
+				if len(mask.keys) > 0 && !mask.keys[tag.Key] {
+					continue
+				}
+				if mask.pattern.MatchString(tag.VStr) {
+					numRedactionHits.WithLabelValues(mask.name).Inc()
+					tag.VStr = mask.pattern.ReplaceAllString(tag.VStr, mask.replacement)
+					changed = true
+				}
+			}
+		}
+		result = append(result, tag)
+	}
+	if !changed {
+		return tags, false
+	}
+	return result, true
+}
+
+// isHashed returns whether value was hashed by a Redactor
+func isHashed(value string) bool {
+	if !strings.HasPrefix(value, hashedValuePrefix) {
+		return false
+	}
+	hash, err := hex.DecodeString(value[len(hashedValuePrefix):])
+	return err == nil && len(hash) == sha256.Size
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
@@ -0,0 +1,142 @@
+package clickhousespanstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactor_Apply(t *testing.T) {
+	newSpan := func() *model.Span {
+		return &model.Span{
+			OperationName: "operation",
+			Tags: []model.KeyValue{
+				model.String("user.email", "contact: jane@example.com"),
+				model.String("password", "secret"),
+				model.Int64("user.id", 42),
+				model.String("http.method", "GET"),
+			},
+			Logs: []model.Log{
+				{Fields: []model.KeyValue{model.String("message", "paid with 4111 1111 1111 1111")}},
+			},
+			Process: model.NewProcess("service", []model.KeyValue{model.String("token", "Bearer abc.def")}),
+		}
+	}
+	hash := sha256.Sum256([]byte("salt42"))
+
+	tests := map[string]struct {
+		rules    RedactionRules
+		expected func(*model.Span)
+	}{
+		"deny keys": {
+			rules: RedactionRules{DenyKeys: []string{"password", "token"}},
+			expected: func(span *model.Span) {
+				span.Tags = []model.KeyValue{span.Tags[0], span.Tags[2], span.Tags[3]}
+				span.Process.Tags = []model.KeyValue{}
+			},
+		},
+		"allow keys": {
+			rules: RedactionRules{AllowKeys: []string{"http.method", "message"}},
+			expected: func(span *model.Span) {
+				span.Tags = []model.KeyValue{span.Tags[3]}
+				span.Process.Tags = []model.KeyValue{}
+			},
+		},
+		"hash keys": {
+			rules: RedactionRules{HashKeys: []string{"user.id"}, HashSalt: "salt"},
+			expected: func(span *model.Span) {
+				span.Tags[2] = model.String("user.id", "sha256:"+hex.EncodeToString(hash[:]))
+			},
+		},
+		"masks": {
+			rules: RedactionRules{Masks: []MaskRule{
+				{Name: "email", Pattern: `[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`},
+				{Name: "card", Pattern: `\b(?:\d[ -]?){13,16}\b`, Replacement: "<card>"},
+				{Name: "token", Pattern: `(?i)(bearer )[a-z0-9._-]+`, Replacement: "${1}***", Keys: []string{"token"}},
+			}},
+			expected: func(span *model.Span) {
+				span.Tags[0].VStr = "contact: ***"
+				span.Logs[0].Fields[0].VStr = "paid with <card>"
+				span.Process.Tags[0].VStr = "Bearer ***"
+			},
+		},
+		"mask restricted to other keys": {
+			rules:    RedactionRules{Masks: []MaskRule{{Pattern: "GET", Keys: []string{"http.url"}}}},
+			expected: func(*model.Span) {},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			redactor, err := NewRedactor(test.rules)
+			require.NoError(t, err)
+			span := newSpan()
+			result := redactor.apply([]*model.Span{span})
+			require.Len(t, result, 1)
+			assert.Equal(t, newSpan(), span, "the original span must not be modified")
+
+			expected := newSpan()
+			test.expected(expected)
+			assert.Equal(t, expected, result[0])
+		})
+	}
+}
+
+func TestRedactor_Idempotent(t *testing.T) {
+	redactor, err := NewRedactor(RedactionRules{
+		DenyKeys: []string{"password"},
+		HashKeys: []string{"user.id", "user.name"},
+		HashSalt: "salt",
+		Masks:    []MaskRule{{Pattern: `\d{4,}`}},
+	})
+	require.NoError(t, err)
+	span := &model.Span{Tags: []model.KeyValue{
+		model.String("password", "secret"),
+		model.Int64("user.id", 42),
+		// Values which look hashed, but were not hashed by a Redactor, are hashed
+		model.String("user.name", "sha256:1234"),
+		model.String("message", "order 12345"),
+	}}
+
+	redacted := redactor.apply([]*model.Span{span})
+	assert.Equal(t, redacted, redactor.apply(redacted), "redacting redacted spans again must not change them")
+	assert.Len(t, redacted[0].Tags, 3)
+	assert.True(t, isHashed(redacted[0].Tags[0].VStr))
+	assert.True(t, isHashed(redacted[0].Tags[1].VStr))
+	assert.Equal(t, "order ***", redacted[0].Tags[2].VStr)
+}
+
+func TestRedactor_Empty(t *testing.T) {
+	redactor, err := NewRedactor(RedactionRules{})
+	require.NoError(t, err)
+	assert.Nil(t, redactor)
+
+	span := &model.Span{Tags: []model.KeyValue{model.String("key", "value")}}
+	assert.Same(t, span, redactor.apply([]*model.Span{span})[0])
+}
+
+func TestRedactor_InvalidPattern(t *testing.T) {
+	_, err := NewRedactor(RedactionRules{Masks: []MaskRule{{Pattern: "("}}})
+	assert.EqualError(t, err, "could not compile redaction mask \"(\": error parsing regexp: missing closing ): `(`")
+}
+
+func TestRedactor_Hits(t *testing.T) {
+	redactor, err := NewRedactor(RedactionRules{
+		DenyKeys: []string{"hits.denied"},
+		Masks:    []MaskRule{{Name: "hits.mask", Pattern: "secret"}},
+	})
+	require.NoError(t, err)
+	before := testutil.ToFloat64(numRedactionHits.WithLabelValues(ruleDenyKeys))
+
+	redactor.apply([]*model.Span{{
+		Tags: []model.KeyValue{model.String("hits.denied", "value"), model.String("key", "secret and secret")},
+		Logs: []model.Log{{Fields: []model.KeyValue{model.String("hits.denied", "value")}}},
+	}})
+	assert.Equal(t, before+2, testutil.ToFloat64(numRedactionHits.WithLabelValues(ruleDenyKeys)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(numRedactionHits.WithLabelValues("hits.mask")))
+}
@@ -0,0 +1,311 @@
+package clickhousespanstore
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	dropReasonSampling         = "sampling"
+	dropReasonServiceRateLimit = "service_rate_limit"
+	dropReasonTenantRateLimit  = "tenant_rate_limit"
+
+	// samplingDecisionTTL is how long the decision for a trace is remembered after its last span,
+	// so later spans of the trace follow it
+	samplingDecisionTTL = time.Minute
+	// maxSamplingDecisions is the maximal number of remembered decisions, the least recently seen traces
+	// are forgotten first
+	maxSamplingDecisions = 100_000
+)
+
+var (
+	numSampledSpans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_sampled_spans_total",
+		Help: "Number of spans kept by sampling and rate limits, by service",
+	}, []string{"service"})
+	numDroppedSpans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_dropped_spans_total",
+		Help: "Number of spans dropped by sampling and rate limits, by service and reason",
+	}, []string{"service", "reason"})
+	numEvictedDecisions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_sampling_decisions_evicted_total",
+		Help: "Number of sampling decisions forgotten before their TTL because too many traces were seen",
+	})
+)
+
+var registerSamplingMetrics sync.Once
+
+// SamplingRules configures sampling and rate limiting of spans written by SpanWriter
+type SamplingRules struct {
+	// Rate is the probability of keeping a trace, between 0 and 1. Default 1.
+	Rate *float64 `yaml:"rate"`
+	// ServiceRates overrides Rate for traces whose first written span belongs to a service
+	ServiceRates map[string]float64 `yaml:"service_rates"`
+	// ServiceRateLimit is the maximal average number of spans per second written for each service. Traces are kept
+	// or dropped as a whole: spans of kept traces are always written and counted against the limit, and new traces
+	// are dropped while it is exceeded. 0 disables the limit.
+	ServiceRateLimit float64 `yaml:"service_rate_limit"`
+	// ServiceRateLimits overrides ServiceRateLimit for a service
+	ServiceRateLimits map[string]float64 `yaml:"service_rate_limits"`
+	// TenantRateLimit is the maximal average number of spans per second written for the tenant, enforced like
+	// ServiceRateLimit. 0 disables the limit.
+	TenantRateLimit float64 `yaml:"tenant_rate_limit"`
+}
+
+func (rules SamplingRules) enabled() bool {
+	return (rules.Rate != nil && *rules.Rate < 1) ||
+		len(rules.ServiceRates) > 0 ||
+		rules.ServiceRateLimit > 0 ||
+		len(rules.ServiceRateLimits) > 0 ||
+		rules.TenantRateLimit > 0
+}
+
+// Sampler decides whether spans are written. The decision is made for the first span of a trace and
+// followed by the later spans of the trace, so traces are kept or dropped as a whole. Error spans are always kept.
+type Sampler struct {
+	rules SamplingRules
+	now   func() time.Time
+
+	mutex          sync.Mutex
+	serviceBuckets map[string]*tokenBucket
+	tenantBucket   *tokenBucket
+	decisions      *decisionCache
+}
+
+// NewSampler returns a Sampler for rules, or nil if all spans are written
+func NewSampler(rules SamplingRules) *Sampler {
+	if !rules.enabled() {
+		return nil
+	}
+	registerSamplingMetrics.Do(func() {
+		prometheus.MustRegister(numSampledSpans, numDroppedSpans, numEvictedDecisions)
+	})
+	return newSampler(rules, time.Now)
+}
+
+func newSampler(rules SamplingRules, now func() time.Time) *Sampler {
+	sampler := &Sampler{
+		rules:          rules,
+		now:            now,
+		serviceBuckets: make(map[string]*tokenBucket),
+		decisions:      newDecisionCache(maxSamplingDecisions),
+	}
+	if rules.TenantRateLimit > 0 {
+		sampler.tenantBucket = newTokenBucket(rules.TenantRateLimit, now())
+	}
+	return sampler
+}
+
+// keep returns whether span should be written. A nil Sampler keeps all spans.
+func (sampler *Sampler) keep(span *model.Span) bool {
+	if sampler == nil {
+		return true
+	}
+	service := ""
+	if span.Process != nil {
+		service = span.Process.ServiceName
+	}
+	reason := sampler.decide(span, service)
+	if reason != "" {
+		numDroppedSpans.WithLabelValues(service, reason).Inc()
+		return false
+	}
+	numSampledSpans.WithLabelValues(service).Inc()
+	return true
+}
+
+// decide returns the reason for dropping span, or an empty string if it is kept
+func (sampler *Sampler) decide(span *model.Span, service string) string {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+
+	now := sampler.now()
+	serviceBucket := sampler.serviceBucket(service, now)
+
+	reason, decided := sampler.decisions.get(span.TraceID, now)
+	if isErrorSpan(span) {
+		// Later spans of the trace are kept as well
+		reason, decided = "", true
+		sampler.decisions.put(span.TraceID, reason, now)
+	}
+	if decided {
+		if reason == "" {
+			// Spans of kept traces are written even if they exceed the rate limits, so traces are not partially
+			// stored, but they are counted against the limits, which then drop new traces
+			serviceBucket.charge(now)
+			sampler.tenantBucket.charge(now)
+		}
+		return reason
+	}
+
+	switch {
+	case !sampleTraceID(span.TraceID, sampler.rate(service)):
+		reason = dropReasonSampling
+	case !serviceBucket.available(now):
+		reason = dropReasonServiceRateLimit
+	case !sampler.tenantBucket.available(now):
+		reason = dropReasonTenantRateLimit
+	default:
+		serviceBucket.charge(now)
+		sampler.tenantBucket.charge(now)
+	}
+	sampler.decisions.put(span.TraceID, reason, now)
+	return reason
+}
+
+func (sampler *Sampler) rate(service string) float64 {
+	if rate, ok := sampler.rules.ServiceRates[service]; ok {
+		return rate
+	}
+	if sampler.rules.Rate != nil {
+		return *sampler.rules.Rate
+	}
+	return 1
+}
+
+func (sampler *Sampler) serviceBucket(service string, now time.Time) *tokenBucket {
+	if bucket, ok := sampler.serviceBuckets[service]; ok {
+		return bucket
+	}
+	limit := sampler.rules.ServiceRateLimit
+	if serviceLimit, ok := sampler.rules.ServiceRateLimits[service]; ok {
+		limit = serviceLimit
+	}
+	var bucket *tokenBucket
+	if limit > 0 {
+		bucket = newTokenBucket(limit, now)
+	}
+	sampler.serviceBuckets[service] = bucket
+	return bucket
+}
+
+// sampleTraceID returns whether a trace is kept with probability rate.
+// The decision only depends on the trace ID, so all replicas of the plugin decide the same way.
+func sampleTraceID(traceID model.TraceID, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	// Compare the top 53 bits, which are represented exactly by a float64
+	return float64(traceID.Low>>11) < rate*(1<<53)
+}
+
+func isErrorSpan(span *model.Span) bool {
+	for _, tag := range span.Tags {
+		if tag.Key != "error" {
+			continue
+		}
+		if (tag.VType == model.BoolType && tag.VBool) || (tag.VType == model.StringType && tag.VStr == "true") {
+			return true
+		}
+	}
+	return false
+}
+
+// decisionCache remembers the sampling decisions of recently seen traces, the reason for dropping the trace or
+// an empty string if it is kept. Decisions expire samplingDecisionTTL after the last span of their trace, and the least
+// recently seen ones are evicted once size decisions are remembered, so memory stays bounded during span floods.
+type decisionCache struct {
+	size int
+	// order holds the decisions, the most recently seen first
+	order   *list.List
+	entries map[model.TraceID]*list.Element
+}
+
+type decision struct {
+	traceID model.TraceID
+	reason  string
+	seen    time.Time
+}
+
+func newDecisionCache(size int) *decisionCache {
+	return &decisionCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[model.TraceID]*list.Element),
+	}
+}
+
+// get returns the decision for the trace, and marks the trace as seen at now
+func (cache *decisionCache) get(traceID model.TraceID, now time.Time) (string, bool) {
+	element, ok := cache.entries[traceID]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*decision)
+	if now.Sub(entry.seen) >= samplingDecisionTTL {
+		cache.remove(element)
+		return "", false
+	}
+	entry.seen = now
+	cache.order.MoveToFront(element)
+	return entry.reason, true
+}
+
+// put remembers the decision for the trace, forgetting expired decisions and evicting the least recently seen ones
+func (cache *decisionCache) put(traceID model.TraceID, reason string, now time.Time) {
+	if element, ok := cache.entries[traceID]; ok {
+		entry := element.Value.(*decision)
+		entry.reason, entry.seen = reason, now
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[traceID] = cache.order.PushFront(&decision{traceID: traceID, reason: reason, seen: now})
+	for element := cache.order.Back(); element != nil; element = cache.order.Back() {
+		if now.Sub(element.Value.(*decision).seen) < samplingDecisionTTL {
+			if cache.order.Len() <= cache.size {
+				break
+			}
+			numEvictedDecisions.Inc()
+		}
+		cache.remove(element)
+	}
+}
+
+func (cache *decisionCache) remove(element *list.Element) {
+	delete(cache.entries, element.Value.(*decision).traceID)
+	cache.order.Remove(element)
+}
+
+// tokenBucket allows rate events per second on average, with bursts of up to one second worth of events.
+// Events can be charged while no tokens are available, the debt is then paid off before further events are allowed.
+// A nil tokenBucket allows all events.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens = math.Min(bucket.rate, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+}
+
+// available returns whether a token is available for an event
+func (bucket *tokenBucket) available(now time.Time) bool {
+	if bucket == nil {
+		return true
+	}
+	bucket.refill(now)
+	return bucket.tokens >= 1
+}
+
+// charge takes a token for an event, even if none is available
+func (bucket *tokenBucket) charge(now time.Time) {
+	if bucket == nil {
+		return
+	}
+	bucket.refill(now)
+	bucket.tokens--
+}
@@ -0,0 +1,160 @@
+package clickhousespanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSamplingSpan(traceID uint64, service string, tags ...model.KeyValue) *model.Span {
+	return &model.Span{
+		TraceID: model.NewTraceID(0, traceID),
+		Tags:    tags,
+		Process: model.NewProcess(service, nil),
+	}
+}
+
+func TestSampler_Empty(t *testing.T) {
+	rate := 1.0
+	sampler := NewSampler(SamplingRules{Rate: &rate})
+	assert.Nil(t, sampler)
+	assert.True(t, sampler.keep(newSamplingSpan(1, "service")))
+}
+
+func TestSampler_Rate(t *testing.T) {
+	rate := 0.5
+	sampler := newSampler(SamplingRules{
+		Rate:         &rate,
+		ServiceRates: map[string]float64{"dropped": 0, "kept": 1},
+	}, time.Now)
+
+	half := uint64(1) << 63
+	tests := map[string]struct {
+		span     *model.Span
+		expected string
+	}{
+		"low trace ID":          {span: newSamplingSpan(half-1, "service"), expected: ""},
+		"high trace ID":         {span: newSamplingSpan(half+1, "service"), expected: dropReasonSampling},
+		"service rate dropped":  {span: newSamplingSpan(1, "dropped"), expected: dropReasonSampling},
+		"service rate kept":     {span: newSamplingSpan(half+2, "kept"), expected: ""},
+		"error span":            {span: newSamplingSpan(half+3, "dropped", model.Bool("error", true)), expected: ""},
+		"error string span":     {span: newSamplingSpan(half+4, "dropped", model.String("error", "true")), expected: ""},
+		"no error span":         {span: newSamplingSpan(half+5, "dropped", model.Bool("error", false)), expected: dropReasonSampling},
+		"decided trace kept":    {span: newSamplingSpan(half+2, "dropped"), expected: ""},
+		"decided trace dropped": {span: newSamplingSpan(half+1, "kept"), expected: dropReasonSampling},
+		"error of dropped span": {span: newSamplingSpan(1, "dropped", model.Bool("error", true)), expected: ""},
+		"after error span":      {span: newSamplingSpan(1, "dropped"), expected: ""},
+	}
+	// The cases depend on the decisions of the previous ones
+	for _, name := range []string{
+		"low trace ID", "high trace ID", "service rate dropped", "service rate kept", "error span", "error string span",
+		"no error span", "decided trace kept", "decided trace dropped", "error of dropped span", "after error span",
+	} {
+		test := tests[name]
+		assert.Equal(t, test.expected, sampler.decide(test.span, test.span.Process.ServiceName), name)
+	}
+}
+
+func TestSampler_RateLimits(t *testing.T) {
+	now := time.Unix(0, 0)
+	sampler := newSampler(SamplingRules{
+		ServiceRateLimit:  2,
+		ServiceRateLimits: map[string]float64{"unlimited": 0},
+		TenantRateLimit:   3,
+	}, func() time.Time { return now })
+
+	decide := func(traceID uint64, service string) string {
+		span := newSamplingSpan(traceID, service)
+		return sampler.decide(span, service)
+	}
+	assert.Equal(t, "", decide(1, "service"))
+	assert.Equal(t, "", decide(2, "service"))
+	assert.Equal(t, dropReasonServiceRateLimit, decide(3, "service"))
+	// Spans of kept traces are kept regardless of the limits, but counted against them
+	assert.Equal(t, "", decide(1, "service"))
+	assert.Equal(t, dropReasonTenantRateLimit, decide(4, "unlimited"))
+
+	now = now.Add(time.Second)
+	// Traces dropped due to the rate limits stay dropped, so they are not partially stored
+	assert.Equal(t, dropReasonServiceRateLimit, decide(3, "service"))
+	assert.Equal(t, "", decide(5, "unlimited"))
+
+	now = now.Add(samplingDecisionTTL / 2)
+	assert.Equal(t, "", decide(6, "service"))
+	// Decisions of traces seen within the TTL are still followed
+	assert.Equal(t, "", decide(1, "service"))
+	assert.Equal(t, dropReasonServiceRateLimit, decide(3, "service"))
+	assert.Equal(t, dropReasonServiceRateLimit, decide(7, "service"))
+
+	// Decisions expire once no span of the trace was seen for the TTL
+	now = now.Add(samplingDecisionTTL)
+	assert.Equal(t, "", decide(3, "service"))
+}
+
+func TestSampler_RateLimitsLargeTrace(t *testing.T) {
+	now := time.Unix(0, 0)
+	sampler := newSampler(SamplingRules{ServiceRateLimit: 10}, func() time.Time { return now })
+
+	decide := func(traceID uint64) string {
+		span := newSamplingSpan(traceID, "service")
+		return sampler.decide(span, "service")
+	}
+	// All 100 spans of the kept trace are written
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "", decide(1))
+	}
+	// The spans exceeded the limit by 90, new traces are dropped until the debt is paid off and a token is available
+	for second := 0; second < 10; second++ {
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, dropReasonServiceRateLimit, decide(uint64(2+second)), "second %d", second)
+		}
+		now = now.Add(time.Second)
+	}
+	// The spans of dropped traces are not counted, so the limit allows new traces again
+	assert.Equal(t, "", decide(20))
+	assert.Equal(t, dropReasonServiceRateLimit, decide(2))
+}
+
+func TestSampler_Keep(t *testing.T) {
+	rate := 0.0
+	sampler := newSampler(SamplingRules{Rate: &rate, ServiceRates: map[string]float64{"keep-service": 1}}, time.Now)
+
+	assert.False(t, sampler.keep(newSamplingSpan(1, "drop-service")))
+	assert.True(t, sampler.keep(newSamplingSpan(2, "keep-service")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(numDroppedSpans.WithLabelValues("drop-service", dropReasonSampling)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(numSampledSpans.WithLabelValues("keep-service")))
+}
+
+func TestDecisionCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := newDecisionCache(2)
+	traceID := func(id uint64) model.TraceID { return model.NewTraceID(0, id) }
+	evicted := testutil.ToFloat64(numEvictedDecisions)
+
+	cache.put(traceID(1), "", now)
+	cache.put(traceID(2), dropReasonSampling, now)
+	// Seeing trace 1 makes trace 2 the least recently seen one, which is evicted by trace 3
+	_, ok := cache.get(traceID(1), now)
+	assert.True(t, ok)
+	cache.put(traceID(3), dropReasonServiceRateLimit, now)
+	assert.Equal(t, 2, cache.order.Len())
+	assert.Len(t, cache.entries, 2)
+	assert.Equal(t, evicted+1, testutil.ToFloat64(numEvictedDecisions))
+	_, ok = cache.get(traceID(2), now)
+	assert.False(t, ok)
+	reason, ok := cache.get(traceID(3), now)
+	assert.True(t, ok)
+	assert.Equal(t, dropReasonServiceRateLimit, reason)
+
+	// Expired decisions are forgotten without being counted as evicted
+	now = now.Add(samplingDecisionTTL)
+	cache.put(traceID(4), "", now)
+	assert.Equal(t, 1, cache.order.Len())
+	assert.Len(t, cache.entries, 1)
+	assert.Equal(t, evicted+1, testutil.ToFloat64(numEvictedDecisions))
+	_, ok = cache.get(traceID(1), now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,115 @@
+package clickhousespanstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// TagIndexRules selects the tag keys which are written to the index table.
+// All tags are still stored in the spans table, but only indexed tags can be searched for.
+type TagIndexRules struct {
+	// AllowKeys, if non-empty, are the only keys which are indexed
+	AllowKeys []string `yaml:"allow_keys"`
+	// DenyKeys are not indexed
+	DenyKeys []string `yaml:"deny_keys"`
+	// SkipLogFields excludes log fields from the index, only span and process tags are indexed
+	SkipLogFields bool `yaml:"skip_log_fields"`
+	// Services overrides the rules above for spans of a service
+	Services map[string]TagIndexServiceRules `yaml:"services"`
+	// RejectUnindexedSearches makes searches for tags which are not indexed fail instead of logging a warning
+	RejectUnindexedSearches bool `yaml:"reject_unindexed_searches"`
+}
+
+// TagIndexServiceRules overrides TagIndexRules for a service, rules which are not set are inherited
+type TagIndexServiceRules struct {
+	AllowKeys     []string `yaml:"allow_keys"`
+	DenyKeys      []string `yaml:"deny_keys"`
+	SkipLogFields *bool    `yaml:"skip_log_fields"`
+}
+
+// TagIndex decides which tags of a span are indexed
+type TagIndex struct {
+	logger   hclog.Logger
+	defaults tagIndexPolicy
+	services map[string]tagIndexPolicy
+	reject   bool
+}
+
+type tagIndexPolicy struct {
+	allowKeys     map[string]bool
+	denyKeys      map[string]bool
+	skipLogFields bool
+}
+
+// NewTagIndex returns a TagIndex for rules, or nil if all tags are indexed
+func NewTagIndex(logger hclog.Logger, rules TagIndexRules) *TagIndex {
+	if len(rules.AllowKeys) == 0 && len(rules.DenyKeys) == 0 && !rules.SkipLogFields && len(rules.Services) == 0 {
+		return nil
+	}
+	defaults := tagIndexPolicy{
+		allowKeys:     toSet(rules.AllowKeys),
+		denyKeys:      toSet(rules.DenyKeys),
+		skipLogFields: rules.SkipLogFields,
+	}
+	index := &TagIndex{
+		logger:   logger,
+		defaults: defaults,
+		services: make(map[string]tagIndexPolicy, len(rules.Services)),
+		reject:   rules.RejectUnindexedSearches,
+	}
+	for service, overrides := range rules.Services {
+		policy := defaults
+		if overrides.AllowKeys != nil {
+			policy.allowKeys = toSet(overrides.AllowKeys)
+		}
+		if overrides.DenyKeys != nil {
+			policy.denyKeys = toSet(overrides.DenyKeys)
+		}
+		if overrides.SkipLogFields != nil {
+			policy.skipLogFields = *overrides.SkipLogFields
+		}
+		index.services[service] = policy
+	}
+	return index
+}
+
+func (index *TagIndex) policy(service string) tagIndexPolicy {
+	if policy, ok := index.services[service]; ok {
+		return policy
+	}
+	return index.defaults
+}
+
+func (policy tagIndexPolicy) indexed(key string) bool {
+	if len(policy.allowKeys) > 0 && !policy.allowKeys[key] {
+		return false
+	}
+	return !policy.denyKeys[key]
+}
+
+// checkSearch returns an error if tags are searched for which are not indexed for service and searches should be rejected,
+// otherwise such searches are logged. Whether a key is only used by log fields is not known, so skip_log_fields is not checked.
+func (index *TagIndex) checkSearch(service string, tags map[string]string) error {
+	if index == nil || len(tags) == 0 {
+		return nil
+	}
+	policy := index.policy(service)
+	var missing []string
+	for key := range tags {
+		if !policy.indexed(key) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	if index.reject {
+		return fmt.Errorf("tags %s are not indexed for service %q", strings.Join(missing, ", "), service)
+	}
+	index.logger.Warn("Searching for tags which are not indexed, no traces will be found by them", "service", service, "tags", missing)
+	return nil
+}
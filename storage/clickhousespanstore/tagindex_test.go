@@ -0,0 +1,76 @@
+package clickhousespanstore
+
+import (
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestTagIndex_Empty(t *testing.T) {
+	index := NewTagIndex(mocks.NewSpyLogger(), TagIndexRules{RejectUnindexedSearches: true})
+	assert.Nil(t, index)
+	assert.NoError(t, index.checkSearch("service", map[string]string{"key": "value"}))
+}
+
+func TestTagIndex_CheckSearch(t *testing.T) {
+	rules := TagIndexRules{
+		DenyKeys: []string{"denied"},
+		Services: map[string]TagIndexServiceRules{
+			"allowed": {AllowKeys: []string{"allowed"}},
+		},
+	}
+	tests := map[string]struct {
+		reject        bool
+		service       string
+		tags          map[string]string
+		expectedError string
+		expectedWarns []mocks.LogMock
+	}{
+		"indexed": {
+			reject:  true,
+			service: "service",
+			tags:    map[string]string{"key": "value"},
+		},
+		"rejected": {
+			reject:        true,
+			service:       "service",
+			tags:          map[string]string{"key": "value", "denied": "value"},
+			expectedError: `tags denied are not indexed for service "service"`,
+		},
+		"rejected by service override": {
+			reject:        true,
+			service:       "allowed",
+			tags:          map[string]string{"key": "value", "denied": "value", "allowed": "value"},
+			expectedError: `tags denied, key are not indexed for service "allowed"`,
+		},
+		"warned": {
+			service: "service",
+			tags:    map[string]string{"denied": "value"},
+			expectedWarns: []mocks.LogMock{{
+				Msg:  "Searching for tags which are not indexed, no traces will be found by them",
+				Args: []interface{}{"service", "service", "tags", []string{"denied"}},
+			}},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			logger := mocks.NewSpyLogger()
+			rules.RejectUnindexedSearches = test.reject
+			index := NewTagIndex(logger, rules)
+			err := index.checkSearch(test.service, test.tags)
+			if test.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+			if test.expectedWarns == nil {
+				logger.AssertLogsEmpty(t)
+			} else {
+				logger.AssertLogsOfLevelEqual(t, hclog.Warn, test.expectedWarns)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package clickhousespanstore
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"sort"
@@ -8,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/gogo/protobuf/proto"
 	"github.com/jaegertracing/jaeger/model"
 )
@@ -19,12 +23,36 @@ var delays = []int{2, 3, 5, 8}
 // Interval in seconds between attempts changes due to delays slice, then it remains the same as the last value in delays.
 type WriteWorker struct {
 	// workerID is an arbitrary identifier for keeping track of this worker in logs
-	workerID   int32
-	params     *WorkerParams
-	batch      []*model.Span
+	workerID int32
+	params   *WorkerParams
+	batch    []*model.Span
+	// batchBytes is the size of batch counted against the pending bytes limit of the pool
+	batchBytes int64
 	finish     chan bool
 	workerDone chan *WriteWorker
 	done       sync.WaitGroup
+
+	// token identifies the batch for ClickHouse insert deduplication, it stays the same across retries
+	token string
+	// modelWritten and indexWritten record the parts of the batch which were already written, so retries skip them
+	modelWritten bool
+	indexWritten bool
+}
+
+// Sizes of the values of fixed width columns, counted in the bytes of written rows
+const (
+	dateTimeBytes   = 4
+	dateTime64Bytes = 8
+	uint64Bytes     = 8
+)
+
+func newDeduplicationToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		// Without a token inserts are not deduplicated, which is still correct
+		return ""
+	}
+	return hex.EncodeToString(token)
 }
 
 func (worker *WriteWorker) Work() {
@@ -41,13 +69,13 @@ func (worker *WriteWorker) Work() {
 	}
 	attempt := 0
 	for {
-		currentDelay := worker.getCurrentDelay(&attempt, worker.params.delay)
+		currentDelay := worker.getCurrentDelay(&attempt, worker.params.getDelay())
 		timer := time.After(currentDelay)
 		select {
 		case <-worker.finish:
-			worker.close()
 			return
 		case <-timer:
+			numInsertRetries.WithLabelValues(worker.params.tenant, string(worker.pendingTable())).Inc()
 			if err := worker.writeBatch(worker.batch); err != nil {
 				worker.params.logger.Error("Could not write a batch of spans", "error", err, "worker_id", worker.workerID)
 			} else {
@@ -70,26 +98,71 @@ func (worker *WriteWorker) getCurrentDelay(attempt *int, delay time.Duration) ti
 	return time.Duration(int64(delays[*attempt-1]) * delay.Nanoseconds())
 }
 
+// pendingTable returns the table which the batch is written to next
+func (worker *WriteWorker) pendingTable() TableName {
+	if worker.modelWritten {
+		return worker.params.indexTable
+	}
+	return worker.params.spansTable
+}
+
 func (worker *WriteWorker) close() {
-	worker.workerDone <- worker
+	// The pool stops listening for finished workers once it closes them
+	select {
+	case worker.workerDone <- worker:
+	case <-worker.finish:
+	}
 }
 
-func (worker *WriteWorker) writeBatch(batch []*model.Span) error {
+func (worker *WriteWorker) writeBatch(batch []*model.Span) (err error) {
 	worker.params.logger.Debug("Writing spans", "size", len(batch))
-	if err := worker.writeModelBatch(batch); err != nil {
-		return err
+	if worker.params.batchController != nil {
+		start := time.Now()
+		defer func() {
+			worker.params.batchController.observeWrite(time.Since(start), err)
+		}()
+	}
+	if !worker.modelWritten {
+		if err := worker.writeModelBatch(batch); err != nil {
+			return err
+		}
+		worker.modelWritten = true
 	}
 
-	if worker.params.indexTable != "" {
+	if worker.params.indexTable != "" && !worker.indexWritten {
 		if err := worker.writeIndexBatch(batch); err != nil {
 			return err
 		}
+		worker.indexWritten = true
 	}
 
 	return nil
 }
 
-func (worker *WriteWorker) writeModelBatch(batch []*model.Span) error {
+// insertContext returns the context for inserting the batch into table, carrying the configured insert settings
+func (worker *WriteWorker) insertContext(table TableName) context.Context {
+	ctx := context.Background()
+	var token string
+	if worker.token != "" {
+		token = worker.token + "-" + string(table)
+	}
+	settings := worker.params.insertSettings.settings(token)
+	if len(settings) == 0 {
+		return ctx
+	}
+	return clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+}
+
+func (worker *WriteWorker) writeModelBatch(batch []*model.Span) (err error) {
+	start := time.Now()
+	var written int
+	defer func() {
+		observeInsert(worker.params.tenant, worker.params.spansTable, len(batch), time.Since(start), err)
+		if err == nil {
+			numWrittenBytes.WithLabelValues(worker.params.tenant, string(worker.params.spansTable)).Add(float64(written))
+		}
+	}()
+
 	tx, err := worker.params.db.Begin()
 	if err != nil {
 		return err
@@ -104,14 +177,25 @@ func (worker *WriteWorker) writeModelBatch(batch []*model.Span) error {
 		}
 	}()
 
-	var query string
-	if worker.params.tenant == "" {
-		query = fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) VALUES (?, ?, ?)", worker.params.spansTable)
-	} else {
-		query = fmt.Sprintf("INSERT INTO %s (tenant, timestamp, traceID, model) VALUES (?, ?, ?, ?)", worker.params.spansTable)
+	columns := []string{"timestamp", "traceID"}
+	if worker.params.serviceColumn {
+		columns = append(columns, "service")
 	}
-
-	statement, err := tx.Prepare(query)
+	if worker.params.deduplication {
+		columns = append(columns, "spanID", "startTime")
+	}
+	columns = append(columns, "model")
+	if worker.params.tenant != "" {
+		columns = append([]string{"tenant"}, columns...)
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s)",
+		worker.params.spansTable,
+		strings.Join(columns, ", "),
+		"?"+strings.Repeat(", ?", len(columns)-1),
+	)
+
+	statement, err := tx.PrepareContext(worker.insertContext(worker.params.spansTable), query)
 	if err != nil {
 		return err
 	}
@@ -131,14 +215,22 @@ func (worker *WriteWorker) writeModelBatch(batch []*model.Span) error {
 			return err
 		}
 
-		if worker.params.tenant == "" {
-			_, err = statement.Exec(span.StartTime, span.TraceID.String(), serialized)
-		} else {
-			_, err = statement.Exec(worker.params.tenant, span.StartTime, span.TraceID.String(), serialized)
+		args := make([]interface{}, 0, len(columns))
+		if worker.params.tenant != "" {
+			args = append(args, worker.params.tenant)
 		}
-		if err != nil {
+		args = append(args, span.StartTime, span.TraceID.String())
+		if worker.params.serviceColumn {
+			args = append(args, span.Process.ServiceName)
+		}
+		if worker.params.deduplication {
+			args = append(args, span.SpanID.String(), span.StartTime)
+		}
+		args = append(args, serialized)
+		if _, err = statement.Exec(args...); err != nil {
 			return err
 		}
+		written += worker.spanRowBytes(span, serialized)
 	}
 
 	committed = true
@@ -146,7 +238,28 @@ func (worker *WriteWorker) writeModelBatch(batch []*model.Span) error {
 	return tx.Commit()
 }
 
-func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) error {
+// spanRowBytes returns the size of the values of the row of span in the spans table
+func (worker *WriteWorker) spanRowBytes(span *model.Span, serialized []byte) int {
+	size := len(worker.params.tenant) + dateTimeBytes + len(span.TraceID.String()) + len(serialized)
+	if worker.params.serviceColumn {
+		size += len(span.Process.ServiceName)
+	}
+	if worker.params.deduplication {
+		size += len(span.SpanID.String()) + dateTime64Bytes
+	}
+	return size
+}
+
+func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) (err error) {
+	start := time.Now()
+	var written int
+	defer func() {
+		observeInsert(worker.params.tenant, worker.params.indexTable, len(batch), time.Since(start), err)
+		if err == nil {
+			numWrittenBytes.WithLabelValues(worker.params.tenant, string(worker.params.indexTable)).Add(float64(written))
+		}
+	}()
+
 	tx, err := worker.params.db.Begin()
 	if err != nil {
 		return err
@@ -174,7 +287,7 @@ func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) error {
 		)
 	}
 
-	statement, err := tx.Prepare(query)
+	statement, err := tx.PrepareContext(worker.insertContext(worker.params.indexTable), query)
 	if err != nil {
 		return err
 	}
@@ -182,7 +295,7 @@ func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) error {
 	defer statement.Close()
 
 	for _, span := range batch {
-		keys, values := uniqueTagsForSpan(span)
+		keys, values := uniqueTagsForSpan(span, worker.params.getTagIndex())
 		if worker.params.tenant == "" {
 			_, err = statement.Exec(
 				span.StartTime,
@@ -208,6 +321,7 @@ func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) error {
 		if err != nil {
 			return err
 		}
+		written += worker.indexRowBytes(span, keys, values)
 	}
 
 	committed = true
@@ -215,23 +329,47 @@ func (worker *WriteWorker) writeIndexBatch(batch []*model.Span) error {
 	return tx.Commit()
 }
 
-func uniqueTagsForSpan(span *model.Span) (keys, values []string) {
+// indexRowBytes returns the size of the values of the row of span in the index table
+func (worker *WriteWorker) indexRowBytes(span *model.Span, keys, values []string) int {
+	size := len(worker.params.tenant) + dateTimeBytes + len(span.TraceID.String()) + len(span.Process.ServiceName) +
+		len(span.OperationName) + uint64Bytes
+	for i := range keys {
+		size += len(keys[i]) + len(values[i])
+	}
+	return size
+}
+
+// uniqueTagsForSpan returns the keys and values of the span tags, process tags and log fields which are indexed.
+// A nil index indexes all of them.
+func uniqueTagsForSpan(span *model.Span, index *TagIndex) (keys, values []string) {
 	uniqueTags := make(map[string][]string, len(span.Tags)+len(span.Process.Tags))
+	policy := tagIndexPolicy{}
+	if index != nil {
+		policy = index.policy(span.Process.ServiceName)
+	}
 
 	for i := range span.Tags {
 		key := tagKey(&span.GetTags()[i])
-		uniqueTags[key] = append(uniqueTags[key], tagValue(&span.GetTags()[i]))
+		if policy.indexed(key) {
+			uniqueTags[key] = append(uniqueTags[key], tagValue(&span.GetTags()[i]))
+		}
 	}
 
 	for i := range span.Process.Tags {
 		key := tagKey(&span.GetProcess().GetTags()[i])
-		uniqueTags[key] = append(uniqueTags[key], tagValue(&span.GetProcess().GetTags()[i]))
+		if policy.indexed(key) {
+			uniqueTags[key] = append(uniqueTags[key], tagValue(&span.GetProcess().GetTags()[i]))
+		}
 	}
 
-	for _, event := range span.Logs {
-		for i := range event.Fields {
-			key := tagKey(&event.GetFields()[i])
-			uniqueTags[key] = append(uniqueTags[key], tagValue(&event.GetFields()[i]))
+	if !policy.skipLogFields {
+		for _, event := range span.Logs {
+			for i := range event.Fields {
+				key := tagKey(&event.GetFields()[i])
+				if policy.indexed(key) {
+					uniqueTags[key] = append(uniqueTags[key], tagValue(&event.GetFields()[i]))
+				}
+			}
 		}
 	}
 
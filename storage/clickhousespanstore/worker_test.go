@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 	"github.com/gogo/protobuf/proto"
 	hclog "github.com/hashicorp/go-hclog"
@@ -48,7 +49,7 @@ var (
 		Duration:      time.Minute,
 	}
 	testSpans             = []*model.Span{&testSpan}
-	keys, values          = uniqueTagsForSpan(&testSpan)
+	keys, values          = uniqueTagsForSpan(&testSpan, nil)
 	indexWriteExpectation = expectation{
 		preparation: fmt.Sprintf("INSERT INTO %s (timestamp, traceID, service, operation, durationUs, tags.key, tags.value) VALUES (?, ?, ?, ?, ?, ?, ?)", testIndexTable),
 		execArgs: [][]driver.Value{{
@@ -135,7 +136,47 @@ func TestSpanWriter_UniqueTagsForSpan(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			process := model.Process{Tags: test.processTags}
 			span := model.Span{Tags: test.tags, Process: &process, Logs: test.logs}
-			actualKeys, actualValues := uniqueTagsForSpan(&span)
+			actualKeys, actualValues := uniqueTagsForSpan(&span, nil)
+			assert.Equal(t, test.expectedKeys, actualKeys)
+			assert.Equal(t, test.expectedValues, actualValues)
+		})
+	}
+}
+
+func TestSpanWriter_UniqueTagsForSpanWithTagIndex(t *testing.T) {
+	skipLogFields := false
+	index := NewTagIndex(mocks.NewSpyLogger(), TagIndexRules{
+		DenyKeys:      []string{"key3"},
+		SkipLogFields: true,
+		Services: map[string]TagIndexServiceRules{
+			"allowed": {AllowKeys: []string{"key1", "key2"}, SkipLogFields: &skipLogFields},
+		},
+	})
+	tests := map[string]struct {
+		service        string
+		expectedKeys   []string
+		expectedValues []string
+	}{
+		"defaults": {
+			service:        "service",
+			expectedKeys:   []string{"key2", "key4"},
+			expectedValues: []string{"value", "true"},
+		},
+		"service overrides": {
+			service:        "allowed",
+			expectedKeys:   []string{"key1", "key2"},
+			expectedValues: []string{"0.5", "value"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			process := model.Process{ServiceName: test.service, Tags: []model.KeyValue{model.Int64("key3", 412), model.Bool("key4", true)}}
+			span := model.Span{
+				Tags:    []model.KeyValue{model.String("key2", "value")},
+				Process: &process,
+				Logs:    []model.Log{{Fields: []model.KeyValue{model.Float64("key1", .5)}}},
+			}
+			actualKeys, actualValues := uniqueTagsForSpan(&span, index)
 			assert.Equal(t, test.expectedKeys, actualKeys)
 			assert.Equal(t, test.expectedValues, actualValues)
 		})
@@ -152,13 +193,15 @@ func TestSpanWriter_General(t *testing.T) {
 	modelWriteExpectationProto := getModelWriteExpectation(spanProto, "")
 	modelWriteExpectationProtoTenant := getModelWriteExpectation(spanProto, testTenant)
 	tests := map[string]struct {
-		encoding     Encoding
-		indexTable   TableName
-		tenant       string
-		spans        []*model.Span
-		expectations []expectation
-		action       func(writeWorker *WriteWorker, spans []*model.Span) error
-		expectedLogs []mocks.LogMock
+		encoding      Encoding
+		indexTable    TableName
+		tenant        string
+		deduplication bool
+		serviceColumn bool
+		spans         []*model.Span
+		expectations  []expectation
+		action        func(writeWorker *WriteWorker, spans []*model.Span) error
+		expectedLogs  []mocks.LogMock
 	}{
 		"write index batch": {
 			encoding:     EncodingJSON,
@@ -197,6 +240,41 @@ func TestSpanWriter_General(t *testing.T) {
 			expectations: []expectation{modelWriteExpectationProto},
 			action:       func(writeWorker *WriteWorker, spans []*model.Span) error { return writeWorker.writeModelBatch(spans) },
 		},
+		"write model batch deduplication": {
+			encoding:      EncodingJSON,
+			indexTable:    testIndexTable,
+			deduplication: true,
+			spans:         testSpans,
+			expectations: []expectation{{
+				preparation: fmt.Sprintf("INSERT INTO %s (timestamp, traceID, spanID, startTime, model) VALUES (?, ?, ?, ?, ?)", testSpansTable),
+				execArgs:    [][]driver.Value{{testSpan.StartTime, testSpan.TraceID.String(), testSpan.SpanID.String(), testSpan.StartTime, spanJSON}},
+			}},
+			action: func(writeWorker *WriteWorker, spans []*model.Span) error { return writeWorker.writeModelBatch(spans) },
+		},
+		"write model tenant batch deduplication": {
+			encoding:      EncodingJSON,
+			indexTable:    testIndexTable,
+			tenant:        testTenant,
+			deduplication: true,
+			spans:         testSpans,
+			expectations: []expectation{{
+				preparation: fmt.Sprintf("INSERT INTO %s (tenant, timestamp, traceID, spanID, startTime, model) VALUES (?, ?, ?, ?, ?, ?)", testSpansTable),
+				execArgs:    [][]driver.Value{{testTenant, testSpan.StartTime, testSpan.TraceID.String(), testSpan.SpanID.String(), testSpan.StartTime, spanJSON}},
+			}},
+			action: func(writeWorker *WriteWorker, spans []*model.Span) error { return writeWorker.writeModelBatch(spans) },
+		},
+		"write model batch service column": {
+			encoding:      EncodingJSON,
+			indexTable:    testIndexTable,
+			serviceColumn: true,
+			deduplication: true,
+			spans:         testSpans,
+			expectations: []expectation{{
+				preparation: fmt.Sprintf("INSERT INTO %s (timestamp, traceID, service, spanID, startTime, model) VALUES (?, ?, ?, ?, ?, ?)", testSpansTable),
+				execArgs:    [][]driver.Value{{testSpan.StartTime, testSpan.TraceID.String(), testSpan.Process.ServiceName, testSpan.SpanID.String(), testSpan.StartTime, spanJSON}},
+			}},
+			action: func(writeWorker *WriteWorker, spans []*model.Span) error { return writeWorker.writeModelBatch(spans) },
+		},
 		"write model tenant batch Proto": {
 			encoding:     EncodingProto,
 			indexTable:   testIndexTable,
@@ -265,6 +343,8 @@ func TestSpanWriter_General(t *testing.T) {
 
 			spyLogger := mocks.NewSpyLogger()
 			worker := getWriteWorker(spyLogger, db, test.encoding, test.indexTable, test.tenant)
+			worker.params.deduplication = test.deduplication
+			worker.params.serviceColumn = test.serviceColumn
 
 			for _, expectation := range test.expectations {
 				mock.ExpectBegin()
@@ -461,6 +541,74 @@ func TestSpanWriter_ExecError(t *testing.T) {
 	}
 }
 
+func TestSpanWriter_RetryWritesOnlyFailedParts(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	modelWriteExpectation := getModelWriteExpectation(spanJSON, "")
+
+	// The first attempt writes the spans, but fails to write the index
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare(modelWriteExpectation.preparation)
+	prep.ExpectExec().WithArgs(modelWriteExpectation.execArgs[0]...).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectPrepare(indexWriteExpectation.preparation).WillReturnError(errorMock)
+	mock.ExpectRollback()
+	// The retry writes only the index
+	mock.ExpectBegin()
+	prep = mock.ExpectPrepare(indexWriteExpectation.preparation)
+	prep.ExpectExec().WithArgs(indexWriteExpectation.execArgs[0]...).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	spyLogger := mocks.NewSpyLogger()
+	writeWorker := getWriteWorker(spyLogger, db, EncodingJSON, testIndexTable, "")
+	assert.ErrorIs(t, writeWorker.writeBatch(testSpans), errorMock)
+	assert.NoError(t, writeWorker.writeBatch(testSpans))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	// Nothing is left to write
+	assert.NoError(t, writeWorker.writeBatch(testSpans))
+}
+
+func TestSpanWriter_NewDeduplicationToken(t *testing.T) {
+	token := newDeduplicationToken()
+	assert.Len(t, token, 32)
+	assert.NotEqual(t, token, newDeduplicationToken())
+}
+
+func TestInsertSettings_Settings(t *testing.T) {
+	tests := map[string]struct {
+		insertSettings InsertSettings
+		token          string
+		expected       clickhouse.Settings
+	}{
+		"default":                {insertSettings: InsertSettings{}, token: "token", expected: clickhouse.Settings{}},
+		"deduplication":          {insertSettings: InsertSettings{Deduplication: true}, token: "token", expected: clickhouse.Settings{"insert_deduplication_token": "token"}},
+		"deduplication no token": {insertSettings: InsertSettings{Deduplication: true}, expected: clickhouse.Settings{}},
+		"async": {
+			insertSettings: InsertSettings{Async: true},
+			expected:       clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 0},
+		},
+		"async wait": {
+			insertSettings: InsertSettings{Async: true, WaitForAsync: true, Deduplication: true},
+			token:          "token",
+			expected:       clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 1, "insert_deduplication_token": "token"},
+		},
+		"distributed sync": {
+			insertSettings: InsertSettings{DistributedSync: true},
+			expected:       clickhouse.Settings{"insert_distributed_sync": 1},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.insertSettings.settings(test.token))
+		})
+	}
+}
+
 func getWriteWorker(spyLogger mocks.SpyLogger, db *sql.DB, encoding Encoding, indexTable TableName, tenant string) WriteWorker {
 	return WriteWorker{
 		params: &WorkerParams{
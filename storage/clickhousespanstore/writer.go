@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
@@ -36,61 +37,114 @@ var (
 type SpanWriter struct {
 	workerParams WorkerParams
 
-	size   int64
-	spans  chan *model.Span
-	finish chan bool
-	done   sync.WaitGroup
+	size       int64
+	pool       *WriteWorkerPool
+	controller *batchController
+	sampler    atomic.Pointer[Sampler]
+	spans      chan *model.Span
+	// updates holds the latest settings which the background writer did not pick up yet
+	updates     chan WriterSettings
+	updateMutex sync.Mutex
+	finish      chan bool
+	closeOnce   sync.Once
+	done        sync.WaitGroup
+}
+
+// WriterSettings are the settings of a SpanWriter which can be updated while it is running
+type WriterSettings struct {
+	SpanLimits SpanLimits
+	// Redactor redacts spans before they are written, nil writes spans unchanged
+	Redactor *Redactor
+	// TagIndex selects the indexed tags, nil indexes all tags
+	TagIndex *TagIndex
+	// Delay is the batch flush interval
+	Delay time.Duration
+	// Size is the batch write size
+	Size            int64
+	Adaptive        AdaptiveBatching
+	MaxSpanCount    int
+	MaxPendingBytes int64
+}
+
+// SpanWriterParams configures a SpanWriter
+type SpanWriterParams struct {
+	Logger     hclog.Logger
+	DB         *sql.DB
+	IndexTable TableName
+	SpansTable TableName
+	Tenant     string
+	Encoding   Encoding
+	// Deduplication adds the spanID and startTime columns used for deduplication to the spans table inserts
+	Deduplication bool
+	// ServiceColumn adds the service column used by service TTLs to the spans table inserts
+	ServiceColumn  bool
+	InsertSettings InsertSettings
+	// Sampler decides which spans are written, nil writes all spans
+	Sampler *Sampler
+	WriterSettings
 }
 
 var registerWriterMetrics sync.Once
 var _ spanstore.Writer = (*SpanWriter)(nil)
 
 // NewSpanWriter returns a SpanWriter for the database
-func NewSpanWriter(
-	logger hclog.Logger,
-	db *sql.DB,
-	indexTable,
-	spansTable TableName,
-	tenant string,
-	encoding Encoding,
-	delay time.Duration,
-	size int64,
-	maxSpanCount int,
-) *SpanWriter {
+func NewSpanWriter(params SpanWriterParams) *SpanWriter {
 	writer := &SpanWriter{
 		workerParams: WorkerParams{
-			logger:     logger,
-			db:         db,
-			indexTable: indexTable,
-			spansTable: spansTable,
-			tenant:     tenant,
-			encoding:   encoding,
-			delay:      delay,
+			logger:         params.Logger,
+			db:             params.DB,
+			indexTable:     params.IndexTable,
+			spansTable:     params.SpansTable,
+			tenant:         params.Tenant,
+			encoding:       params.Encoding,
+			deduplication:  params.Deduplication,
+			serviceColumn:  params.ServiceColumn,
+			insertSettings: params.InsertSettings,
+			settings:       params.WriterSettings,
 		},
-		size:   size,
-		spans:  make(chan *model.Span, size),
-		finish: make(chan bool),
+		size:       params.Size,
+		controller: newBatchController(params.Tenant, params.SpansTable, params.Adaptive, params.Size, params.Delay, time.Now()),
+		spans:      make(chan *model.Span, queueCapacity(params.WriterSettings)),
+		updates:    make(chan WriterSettings, 1),
+		finish:     make(chan bool),
 	}
+	writer.sampler.Store(params.Sampler)
+	writer.workerParams.batchController = writer.controller
+	pool := NewWorkerPool(&writer.workerParams, params.MaxSpanCount, params.MaxPendingBytes)
+	writer.pool = &pool
 
 	writer.registerMetrics()
-	go writer.backgroundWriter(maxSpanCount)
+	go writer.backgroundWriter()
 
 	return writer
 }
 
+// queueCapacity returns the number of spans WriteSpan accepts before blocking. The channel cannot be resized when
+// the batch size changes on reload or by adaptive batching, so it is sized for the largest batch.
+func queueCapacity(settings WriterSettings) int64 {
+	if settings.Adaptive.MaxSize > settings.Size {
+		return settings.Adaptive.MaxSize
+	}
+	return settings.Size
+}
+
 func (w *SpanWriter) registerMetrics() {
 	registerWriterMetrics.Do(func() {
 		prometheus.MustRegister(numWritesWithBatchSize)
 		prometheus.MustRegister(numWritesWithFlushInterval)
+		prometheus.MustRegister(batchSizeGauge)
+		prometheus.MustRegister(batchFlushIntervalGauge)
 	})
+	registerStatementMetrics()
 }
 
-func (w *SpanWriter) backgroundWriter(maxSpanCount int) {
-	pool := NewWorkerPool(&w.workerParams, maxSpanCount)
+func (w *SpanWriter) backgroundWriter() {
+	pool := w.pool
 	go pool.Work()
-	batch := make([]*model.Span, 0, w.size)
+	size, interval := w.size, w.workerParams.getDelay()
+	batch := make([]*model.Span, 0, size)
 
-	timer := time.After(w.workerParams.delay)
+	timer := time.After(interval)
 	last := time.Now()
 
 	for {
@@ -102,20 +156,36 @@ func (w *SpanWriter) backgroundWriter(maxSpanCount int) {
 		select {
 		case span := <-w.spans:
 			batch = append(batch, span)
-			flush = len(batch) == cap(batch)
+			w.controller.observeSpan()
+			flush = int64(len(batch)) >= size
 			if flush {
 				w.workerParams.logger.Debug("Flush due to batch size", "size", len(batch))
 				numWritesWithBatchSize.Inc()
 			}
 		case <-timer:
-			timer = time.After(w.workerParams.delay)
-			flush = time.Since(last) > w.workerParams.delay && len(batch) > 0
+			size, interval = w.controller.adjust(time.Now())
+			timer = time.After(interval)
+			flush = time.Since(last) > interval && len(batch) > 0
 			if flush {
 				w.workerParams.logger.Debug("Flush due to timer")
 				numWritesWithFlushInterval.Inc()
 			}
+		case settings := <-w.updates:
+			w.controller.reset(settings.Adaptive, settings.Size, settings.Delay, time.Now())
+			pool.setLimits(settings.MaxSpanCount, settings.MaxPendingBytes)
+			size, interval = w.controller.adjust(time.Now())
+			timer = time.After(interval)
+			flush = int64(len(batch)) >= size
+			if flush {
+				w.workerParams.logger.Debug("Flush due to batch size", "size", len(batch))
+				numWritesWithBatchSize.Inc()
+			}
 		case <-w.finish:
 			finish = true
+			// Pick up spans which were already accepted by WriteSpan, so they are not lost on close
+			for len(w.spans) > 0 {
+				batch = append(batch, <-w.spans)
+			}
 			flush = len(batch) > 0
 			w.workerParams.logger.Debug("Finish channel")
 		}
@@ -123,7 +193,8 @@ func (w *SpanWriter) backgroundWriter(maxSpanCount int) {
 		if flush {
 			pool.WriteBatch(batch)
 
-			batch = make([]*model.Span, 0, w.size)
+			size, interval = w.controller.adjust(time.Now())
+			batch = make([]*model.Span, 0, size)
 			last = time.Now()
 		}
 
@@ -140,13 +211,60 @@ func (w *SpanWriter) backgroundWriter(maxSpanCount int) {
 
 // WriteSpan writes the encoded span
 func (w *SpanWriter) WriteSpan(_ context.Context, span *model.Span) error {
+	if !w.sampler.Load().keep(span) {
+		return nil
+	}
+	if w.workerParams.insertSettings.Async && w.workerParams.insertSettings.SkipBatching {
+		// ClickHouse batches the inserts, so write the span right away and report failures to the caller
+		worker := WriteWorker{params: &w.workerParams}
+		return worker.writeBatch(w.workerParams.prepareBatch([]*model.Span{span}))
+	}
 	w.spans <- span
 	return nil
 }
 
-// Close Implements io.Closer and closes the underlying storage
+// Backlog reports the spans which the writer did not write yet
+type Backlog struct {
+	// Queued is the number of spans waiting to be batched, WriteSpan blocks once it reaches QueueCapacity
+	Queued        int
+	QueueCapacity int
+	// Pending is the number of spans of batches which are being written
+	Pending int64
+}
+
+// Backlog returns the spans which the writer did not write yet
+func (w *SpanWriter) Backlog() Backlog {
+	backlog := Backlog{Queued: len(w.spans), QueueCapacity: cap(w.spans)}
+	if w.pool != nil {
+		backlog.Pending = w.pool.pendingSpans.Load()
+	}
+	return backlog
+}
+
+// Update applies settings to batches written from now on. Batches which are already being written,
+// e.g. while retrying, keep the previous span limits and redaction rules.
+// Update does not block, settings which the background writer did not pick up yet are replaced.
+func (w *SpanWriter) Update(settings WriterSettings) {
+	w.updateMutex.Lock()
+	defer w.updateMutex.Unlock()
+	w.workerParams.update(settings)
+	select {
+	case <-w.updates:
+	default:
+	}
+	w.updates <- settings
+}
+
+// SetSampler replaces the sampler of spans, or disables sampling if sampler is nil
+func (w *SpanWriter) SetSampler(sampler *Sampler) {
+	w.sampler.Store(sampler)
+}
+
+// Close Implements io.Closer and closes the underlying storage, closing it again has no effect
 func (w *SpanWriter) Close() error {
-	w.finish <- true
-	w.done.Wait()
+	w.closeOnce.Do(func() {
+		w.finish <- true
+		w.done.Wait()
+	})
 	return nil
 }
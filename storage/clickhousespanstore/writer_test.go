@@ -0,0 +1,130 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func TestSpanWriter_CloseFlushesPendingSpans(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	for _, expectation := range []expectation{getModelWriteExpectation(spanJSON, ""), indexWriteExpectation} {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare(expectation.preparation)
+		for _, args := range expectation.execArgs {
+			prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	// Neither the batch size nor the flush interval is reached before closing
+	writer := newTestSpanWriter(db, InsertSettings{})
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+	require.NoError(t, writer.Close())
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSpanWriter_AsyncInsertSkipBatching(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	modelWriteExpectation := getModelWriteExpectation(spanJSON, "")
+	mock.ExpectBegin()
+	mock.ExpectPrepare(modelWriteExpectation.preparation).ExpectExec().WithArgs(modelWriteExpectation.execArgs[0]...).WillReturnError(errorMock)
+	mock.ExpectRollback()
+
+	writer := newTestSpanWriter(db, InsertSettings{Async: true, SkipBatching: true})
+	// The span is written synchronously, so the error is reported to the caller
+	assert.ErrorIs(t, writer.WriteSpan(context.Background(), &testSpan), errorMock)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	require.NoError(t, writer.Close())
+}
+
+func TestSpanWriter_Update(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	spanJSON, err := json.Marshal(&testSpan)
+	require.NoError(t, err)
+	for _, expectation := range []expectation{getModelWriteExpectation(spanJSON, ""), indexWriteExpectation} {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare(expectation.preparation)
+		for _, args := range expectation.execArgs {
+			prep.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	writer := newTestSpanWriter(db, InsertSettings{})
+	defer writer.Close()
+
+	// Dropped by the sampler
+	rate := 0.0
+	writer.SetSampler(NewSampler(SamplingRules{Rate: &rate}))
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+
+	// Flushed right away with the batch size of the update
+	writer.SetSampler(nil)
+	writer.Update(WriterSettings{Delay: time.Hour, Size: 1})
+	require.NoError(t, writer.WriteSpan(context.Background(), &testSpan))
+	assert.Eventually(t, func() bool {
+		return mock.ExpectationsWereMet() == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSpanWriter_UpdateDoesNotBlock(t *testing.T) {
+	db, _, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	writer := newTestSpanWriter(db, InsertSettings{})
+	updated := make(chan bool)
+	go func() {
+		// Settings which were not picked up yet are replaced, also after the background writer finished
+		for i := 0; i < 3; i++ {
+			writer.Update(WriterSettings{Delay: time.Hour, Size: int64(i + 1)})
+		}
+		assert.NoError(t, writer.Close())
+		writer.Update(WriterSettings{Delay: time.Hour, Size: 10})
+		writer.Update(WriterSettings{Delay: time.Hour, Size: 20})
+		close(updated)
+	}()
+
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("Update blocked")
+	}
+	assert.Equal(t, int64(20), (<-writer.updates).Size)
+}
+
+// newTestSpanWriter returns a SpanWriter for the test tables, which flushes batches of 10 spans or on close
+func newTestSpanWriter(db *sql.DB, insertSettings InsertSettings) *SpanWriter {
+	return NewSpanWriter(SpanWriterParams{
+		Logger:         mocks.NewSpyLogger(),
+		DB:             db,
+		IndexTable:     testIndexTable,
+		SpansTable:     testSpansTable,
+		Encoding:       EncodingJSON,
+		InsertSettings: insertSettings,
+		WriterSettings: WriterSettings{Delay: time.Hour, Size: 10},
+	})
+}
@@ -1,24 +1,46 @@
 package storage
 
 import (
+	"strings"
 	"time"
 
+	hclog "github.com/hashicorp/go-hclog"
+
 	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
 )
 
 type EncodingType string
 
+// ProtocolType is the protocol of connections to ClickHouse
+type ProtocolType string
+
+// ConnectionStrategy is the order in which ClickHouse addresses are tried when opening connections
+type ConnectionStrategy string
+
 const (
-	defaultEncoding                     = JSONEncoding
-	JSONEncoding           EncodingType = "json"
-	ProtobufEncoding       EncodingType = "protobuf"
-	defaultMaxSpanCount                 = int(1e7)
-	defaultBatchSize                    = 10_000
-	defaultBatchDelay                   = time.Second * 5
-	defaultUsername                     = "default"
-	defaultDatabaseName                 = "default"
-	defaultMetricsEndpoint              = "localhost:9090"
-	defaultMaxNumSpans                  = 0
+	defaultEncoding                                 = JSONEncoding
+	JSONEncoding                 EncodingType       = "json"
+	ProtobufEncoding             EncodingType       = "protobuf"
+	NativeProtocol               ProtocolType       = "native"
+	HTTPProtocol                 ProtocolType       = "http"
+	defaultProtocol                                 = NativeProtocol
+	ConnectionInOrder            ConnectionStrategy = "in_order"
+	ConnectionRoundRobin         ConnectionStrategy = "round_robin"
+	ConnectionRandom             ConnectionStrategy = "random"
+	defaultConnectionStrategy                       = ConnectionInOrder
+	defaultFailedAddressBackoff                     = 30 * time.Second
+	defaultMaxSpanCount                             = int(1e7)
+	defaultBatchSize                                = 10_000
+	defaultBatchDelay                               = time.Second * 5
+	defaultUsername                                 = "default"
+	defaultDatabaseName                             = "default"
+	defaultMetricsEndpoint                          = "localhost:9090"
+	defaultLogLevel                                 = "trace"
+	defaultMaxNumSpans                              = 0
+	defaultCluster                                  = "{cluster}"
+	defaultReplicaName                              = "{replica}"
+	defaultTraceShardingKey                         = "cityHash64(traceID)"
+	defaultOperationsShardingKey                    = "rand()"
 
 	defaultSpansTable      clickhousespanstore.TableName = "jaeger_spans"
 	defaultSpansIndexTable clickhousespanstore.TableName = "jaeger_index"
@@ -30,16 +52,74 @@ type Configuration struct {
 	BatchWriteSize int64 `yaml:"batch_write_size"`
 	// Batch flush interval. Default is 5s.
 	BatchFlushInterval time.Duration `yaml:"batch_flush_interval"`
+	// Whether to adapt the batch write size and flush interval to the incoming span rate and to the latency and errors
+	// of inserts, within the bounds below. Batches grow when inserts fail or are slow, the flush interval grows
+	// when few spans arrive, and batches grow when many spans arrive. Default false.
+	AdaptiveBatching bool `yaml:"adaptive_batching"`
+	// Lower bound of the adaptive batch write size. Default is batch_write_size / 10.
+	MinBatchWriteSize int64 `yaml:"min_batch_write_size"`
+	// Upper bound of the adaptive batch write size. Default is batch_write_size * 10.
+	MaxBatchWriteSize int64 `yaml:"max_batch_write_size"`
+	// Lower bound of the adaptive batch flush interval. Default is batch_flush_interval / 5.
+	MinBatchFlushInterval time.Duration `yaml:"min_batch_flush_interval"`
+	// Upper bound of the adaptive batch flush interval. Default is batch_flush_interval * 6.
+	MaxBatchFlushInterval time.Duration `yaml:"max_batch_flush_interval"`
 	// Maximal amount of spans that can be pending writes at a time.
 	// New spans exceeding this limit will be discarded,
 	// keeping memory in check if there are issues writing to ClickHouse.
 	// Check the "jaeger_clickhouse_discarded_spans" metric to keep track of discards.
 	// Default 10_000_000, or disable the limit entirely by setting to 0.
 	MaxSpanCount int `yaml:"max_span_count"`
+	// Maximal size in bytes of spans that can be pending writes at a time, measured by their protobuf encoded size.
+	// New spans exceeding this limit will be discarded, which bounds memory when span sizes vary a lot.
+	// Check the "jaeger_clickhouse_pending_bytes" metric to keep track of pending bytes.
+	// Default 0, which disables the limit.
+	MaxPendingBytes int64 `yaml:"max_pending_bytes"`
+	// Maximal length in bytes of string and binary values of tags, process tags and log fields.
+	// Longer values are truncated. Default 0, which disables the limit.
+	MaxTagValueLength int `yaml:"max_tag_value_length"`
+	// Maximal number of tags of a span, further tags are dropped. Default 0, which disables the limit.
+	MaxTagsPerSpan int `yaml:"max_tags_per_span"`
+	// Maximal number of logs of a span, further logs are dropped. Default 0, which disables the limit.
+	MaxLogsPerSpan int `yaml:"max_logs_per_span"`
+	// Maximal protobuf encoded size of a span in bytes. Logs and then tags are dropped from the end of larger spans.
+	// Truncated spans get a "jaeger_clickhouse.truncated" tag listing what was truncated, which counts against the size,
+	// check the "jaeger_clickhouse_truncated_spans_total" metric to keep track of truncations by service.
+	// Default 0, which disables the limit.
+	MaxSpanBytes int `yaml:"max_span_bytes"`
+	// Rules for removing, hashing and masking span tags, process tags and log fields before spans are written,
+	// e.g. to strip personal data. Check the "jaeger_clickhouse_redaction_hits_total" metric for rule hits.
+	// By default nothing is redacted.
+	Redaction clickhousespanstore.RedactionRules `yaml:"redaction"`
+	// Rules selecting the tag keys which are written to the index table, to keep it small.
+	// All tags are still stored in the spans table, but only indexed tags can be searched for.
+	// By default all span tags, process tags and log fields are indexed.
+	TagIndex clickhousespanstore.TagIndexRules `yaml:"tag_index"`
+	// Probabilistic sampling by trace ID and rate limits of spans, applied before spans are written.
+	// Traces are kept or dropped as a whole, and error spans are always kept.
+	// By default all spans are written.
+	Sampling clickhousespanstore.SamplingRules `yaml:"sampling"`
 	// Encoding either json or protobuf. Default is json.
 	Encoding EncodingType `yaml:"encoding"`
 	// ClickHouse address e.g. localhost:9000.
 	Address string `yaml:"address"`
+	// Protocol of connections to ClickHouse, either native or http. Addresses must point to the respective
+	// interface, e.g. port 9000 or 9440 for native, and port 8123 or 8443 for http.
+	// Default native.
+	Protocol ProtocolType `yaml:"protocol"`
+	// Proxy URL of http connections, e.g. http://proxy:3128. Default is no proxy.
+	HTTPProxy string `yaml:"http_proxy"`
+	// Headers added to requests of http connections, e.g. for authentication at a proxy. Default empty.
+	HTTPHeaders map[string]string `yaml:"http_headers"`
+	// ClickHouse addresses, e.g. of several replicas, used instead of address.
+	Addresses []string `yaml:"addresses"`
+	// ClickHouse addresses used by span readers, e.g. of read replicas. Default is addresses or address.
+	ReadAddresses []string `yaml:"read_addresses"`
+	// Order in which addresses are tried when opening connections, either in_order, round_robin or random.
+	// Default in_order, which fails over to the next address.
+	ConnectionStrategy ConnectionStrategy `yaml:"connection_strategy"`
+	// Time for which an address is tried after the other ones once connecting to it failed. Default 30s.
+	FailedAddressBackoff time.Duration `yaml:"failed_address_backoff"`
 	// Directory with .sql files to run at plugin startup, mainly for integration tests.
 	// Depending on the value of init_tables, this can be run as a
 	// replacement or supplement to creating default tables for span storage.
@@ -49,29 +129,124 @@ type Configuration struct {
 	// By default, this is enabled if init_sql_scripts_dir is empty,
 	// or disabled if init_sql_scripts_dir is provided.
 	InitTables *bool `yaml:"init_tables"`
+	// Whether to connect to the database with TLS, verified with the system root certificates unless ca_file is set.
+	// Default false, or true if ca_file or cert_file is set.
+	TLS bool `yaml:"tls"`
 	// Indicates location of TLS certificate used to connect to database.
+	// Reloaded on new connections when the file changes.
 	CaFile string `yaml:"ca_file"`
+	// Client certificate and key files for mutual TLS, reloaded on new connections when the files change.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Server name used to verify the certificate of the database. Default is the host of the address.
+	ServerName string `yaml:"server_name"`
+	// Minimal TLS version, either 1.0, 1.1, 1.2 or 1.3. Default 1.2.
+	TLSMinVersion string `yaml:"tls_min_version"`
+	// Whether to skip verifying the certificate of the database. Only use this for development. Default false.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
 	// Username for connection to database. Default is "default".
 	Username string `yaml:"username"`
 	// Password for connection to database.
 	Password string `yaml:"password"`
+	// File containing the password for connection to database, instead of password. The file is read again
+	// when connecting fails, so a rotated password is used without a restart.
+	PasswordFile string `yaml:"password_file"`
 	// Database name. Default is "default"
 	Database string `yaml:"database"`
 	// Endpoint for scraping prometheus metrics e.g. localhost:9090.
 	MetricsEndpoint string `yaml:"metrics_endpoint"`
-	// Whether to use SQL scripts supporting replication and sharding. Default false.
+	// Number of spans pending writes above which /ready of the metrics endpoint reports the plugin as not ready.
+	// Default is 90% of max_span_count, or no limit if max_span_count is 0.
+	ReadyMaxPendingSpans int `yaml:"ready_max_pending_spans"`
+	// Level of logs sent to Jaeger, which filters them again by --grpc-storage-plugin.log-level,
+	// either trace, debug, info, warn, error or off. Default trace.
+	LogLevel string `yaml:"log_level"`
+	// Whether to create tables with replicated engines on the cluster. Default false.
 	Replication bool `yaml:"replication"`
+	// Whether to create "_local" tables on the cluster, and distributed tables over them with the configured table names.
+	// Default is the value of replication.
+	Sharding *bool `yaml:"sharding"`
+	// Name of the cluster the tables are created on with replication, which may be a macro. Default "{cluster}".
+	Cluster string `yaml:"cluster"`
+	// ZooKeeper path of the replicated tables, e.g. "/clickhouse/{cluster}/tables/{shard}/{database}/{table}".
+	// Default is the default_replica_path of the server.
+	ReplicaZooKeeperPath string `yaml:"replica_zookeeper_path"`
+	// Replica name of the replicated tables, only used together with replica_zookeeper_path. Default "{replica}".
+	ReplicaName string `yaml:"replica_name"`
+	// Sharding key of the distributed spans and spans archive tables. Default "cityHash64(traceID)".
+	SpansShardingKey string `yaml:"spans_sharding_key"`
+	// Sharding key of the distributed index tables. Default "cityHash64(traceID)".
+	IndexShardingKey string `yaml:"index_sharding_key"`
+	// Sharding key of the distributed operations tables. Default "rand()".
+	OperationsShardingKey string `yaml:"operations_sharding_key"`
+	// Settings of the Distributed engine of the distributed tables, e.g. fsync_after_insert. Default empty.
+	DistributedSettings map[string]string `yaml:"distributed_settings"`
+	// Whether to insert into distributed tables of sharding with insert_distributed_sync=1, so inserts return only after
+	// the data was written to all shards. Default false.
+	InsertDistributedSync bool `yaml:"insert_distributed_sync"`
 	// If non-empty, enables multitenancy in SQL scripts, and assigns the tenant name for this instance.
 	Tenant string `yaml:"tenant"`
-	// Table with spans. Default "jaeger_spans_local" or "jaeger_spans" when replication is enabled.
+	// Table with spans. Default "jaeger_spans_local" or "jaeger_spans" when sharding is enabled.
 	SpansTable clickhousespanstore.TableName `yaml:"spans_table"`
-	// Span index table. Default "jaeger_index_local" or "jaeger_index" when replication is enabled.
+	// Span index table. Default "jaeger_index_local" or "jaeger_index" when sharding is enabled.
 	SpansIndexTable clickhousespanstore.TableName `yaml:"spans_index_table"`
-	// Operations table. Default "jaeger_operations_local" or "jaeger_operations" when replication is enabled.
+	// Operations table. Default "jaeger_operations_local" or "jaeger_operations" when sharding is enabled.
 	OperationsTable   clickhousespanstore.TableName `yaml:"operations_table"`
 	spansArchiveTable clickhousespanstore.TableName
+	// Whether to archive traces by copying them from the spans table to the archive table within ClickHouse,
+	// instead of writing the spans sent by Jaeger through a batching writer.
+	// Archiving is then synchronous and archiving a trace again does not duplicate its spans.
+	// Copies wait for distributed tables to write to all shards, as with insert_distributed_sync.
+	// If several plugin replicas archive the same trace at once, its spans are only copied once with deduplication,
+	// otherwise the extra copies are removed when the trace is read.
+	// Spans of traces missing from the spans table are still written as before. Default false.
+	CopyOnArchive bool `yaml:"copy_on_archive"`
+	// Whether to create an index table and an operations table for archived spans, so archived traces can be searched
+	// in the same way as other traces. The tables are named after the index and operations tables with an "_archive" suffix.
+	// Archived spans are only indexed if this was enabled at the time of archiving. Default false.
+	ArchiveIndex           bool `yaml:"archive_index"`
+	spansArchiveIndexTable clickhousespanstore.TableName
+	operationsArchiveTable clickhousespanstore.TableName
+	// Whether to create the spans tables with spanID and startTime columns and the ReplacingMergeTree engine,
+	// so spans written more than once, e.g. due to client retries, are removed by ClickHouse in background merges.
+	// Duplicated spans are always collapsed when reading traces.
+	// Like multitenancy, this must be decided when the tables are created. Default false.
+	Deduplication bool `yaml:"deduplication"`
+	// Whether to send an insert_deduplication_token with every insert, so a batch retried after a failure
+	// is not written twice. Requires ClickHouse 22.2 or newer, and is only effective for replicated tables,
+	// or non-replicated tables with the non_replicated_deduplication_window setting. Default false.
+	InsertDeduplication bool `yaml:"insert_deduplication"`
+	// Whether to insert with async_insert=1, so ClickHouse buffers and batches inserts of all plugin replicas,
+	// which avoids creating too many small parts. Default false.
+	AsyncInsert bool `yaml:"async_insert"`
+	// Whether async inserts are confirmed by ClickHouse only after they were flushed to the table. Default true.
+	WaitForAsyncInsert *bool `yaml:"wait_for_async_insert"`
+	// Whether to write each span as soon as it arrives instead of batching spans in the plugin,
+	// leaving batching entirely to ClickHouse. Only applied together with async_insert. Default false.
+	AsyncInsertSkipBatching bool `yaml:"async_insert_skip_batching"`
 	// TTL for data in tables in days. If 0, no TTL is set. Default 0.
 	TTLDays uint `yaml:"ttl"`
+	// TTL in days by service, overriding ttl and tenant_ttl for spans of these services. 0 keeps spans forever.
+	// Adds a service column to the spans table, also to existing ones when tables are initialized. Default empty.
+	ServiceTTLDays map[string]uint `yaml:"service_ttl"`
+	// TTL in days by tenant, overriding ttl for spans of these tenants in multitenant tables. 0 keeps spans forever.
+	// Default empty.
+	TenantTTLDays map[string]uint `yaml:"tenant_ttl"`
+	// TTL for data in archive tables in days. If 0, no TTL is set. Default is ttl.
+	ArchiveTTLDays *uint `yaml:"archive_ttl"`
+	// Whether to update the TTL of existing tables with ALTER TABLE ... MODIFY TTL when tables are initialized,
+	// or remove it with ALTER TABLE ... REMOVE TTL if the TTL is 0. Default false.
+	UpdateTTL bool `yaml:"update_ttl"`
+	// Storage policy of the spans, index and archive tables, e.g. with volumes on fast and slow disks.
+	// Only applied when tables are created. Default is the default policy of the server.
+	StoragePolicy string `yaml:"storage_policy"`
+	// Number of days after which data of the spans, index and archive tables is moved to move_to_volume or move_to_disk.
+	// If 0, data is not moved. Default 0.
+	MoveAfterDays uint `yaml:"move_after_days"`
+	// Volume of the storage policy to move data to after move_after_days.
+	MoveToVolume string `yaml:"move_to_volume"`
+	// Disk to move data to after move_after_days, used if move_to_volume is not set.
+	MoveToDisk string `yaml:"move_to_disk"`
 	// The maximum number of spans to fetch per trace. If 0, no limits is set. Default 0.
 	MaxNumSpans uint `yaml:"max_num_spans"`
 	// The maximum number of open connections to the database. Default is unlimited (see: https://pkg.go.dev/database/sql#DB.SetMaxOpenConns)
@@ -91,12 +266,43 @@ func (cfg *Configuration) setDefaults() {
 	if cfg.BatchFlushInterval == 0 {
 		cfg.BatchFlushInterval = defaultBatchDelay
 	}
+	if cfg.MinBatchWriteSize == 0 {
+		cfg.MinBatchWriteSize = cfg.BatchWriteSize / 10
+		if cfg.MinBatchWriteSize == 0 {
+			cfg.MinBatchWriteSize = 1
+		}
+	}
+	if cfg.MaxBatchWriteSize == 0 {
+		cfg.MaxBatchWriteSize = cfg.BatchWriteSize * 10
+	}
+	if cfg.MinBatchFlushInterval == 0 {
+		cfg.MinBatchFlushInterval = cfg.BatchFlushInterval / 5
+	}
+	if cfg.MaxBatchFlushInterval == 0 {
+		cfg.MaxBatchFlushInterval = cfg.BatchFlushInterval * 6
+	}
 	if cfg.MaxSpanCount == 0 {
 		cfg.MaxSpanCount = defaultMaxSpanCount
 	}
+	if cfg.ReadyMaxPendingSpans == 0 {
+		cfg.ReadyMaxPendingSpans = cfg.MaxSpanCount / 10 * 9
+	}
+	if cfg.ArchiveTTLDays == nil {
+		archiveTTLDays := cfg.TTLDays
+		cfg.ArchiveTTLDays = &archiveTTLDays
+	}
 	if cfg.Encoding == "" {
 		cfg.Encoding = defaultEncoding
 	}
+	if cfg.Protocol == "" {
+		cfg.Protocol = defaultProtocol
+	}
+	if cfg.ConnectionStrategy == "" {
+		cfg.ConnectionStrategy = defaultConnectionStrategy
+	}
+	if cfg.FailedAddressBackoff == 0 {
+		cfg.FailedAddressBackoff = defaultFailedAddressBackoff
+	}
 	if cfg.InitTables == nil {
 		// Decide whether to init tables based on whether a custom script path was provided
 		var defaultInitTables bool
@@ -107,6 +313,10 @@ func (cfg *Configuration) setDefaults() {
 		}
 		cfg.InitTables = &defaultInitTables
 	}
+	if cfg.WaitForAsyncInsert == nil {
+		waitForAsyncInsert := true
+		cfg.WaitForAsyncInsert = &waitForAsyncInsert
+	}
 	if cfg.Username == "" {
 		cfg.Username = defaultUsername
 	}
@@ -116,11 +326,33 @@ func (cfg *Configuration) setDefaults() {
 	if cfg.MetricsEndpoint == "" {
 		cfg.MetricsEndpoint = defaultMetricsEndpoint
 	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = defaultLogLevel
+	}
+	if cfg.Cluster == "" {
+		cfg.Cluster = defaultCluster
+	}
+	if cfg.ReplicaName == "" {
+		cfg.ReplicaName = defaultReplicaName
+	}
+	if cfg.SpansShardingKey == "" {
+		cfg.SpansShardingKey = defaultTraceShardingKey
+	}
+	if cfg.IndexShardingKey == "" {
+		cfg.IndexShardingKey = defaultTraceShardingKey
+	}
+	if cfg.OperationsShardingKey == "" {
+		cfg.OperationsShardingKey = defaultOperationsShardingKey
+	}
 	if cfg.MaxNumSpans == 0 {
 		cfg.MaxNumSpans = defaultMaxNumSpans
 	}
+	if cfg.Sharding == nil {
+		sharding := cfg.Replication
+		cfg.Sharding = &sharding
+	}
 	if cfg.SpansTable == "" {
-		if cfg.Replication {
+		if *cfg.Sharding {
 			cfg.SpansTable = defaultSpansTable
 			cfg.spansArchiveTable = defaultSpansTable + "_archive"
 		} else {
@@ -131,21 +363,179 @@ func (cfg *Configuration) setDefaults() {
 		cfg.spansArchiveTable = cfg.SpansTable + "_archive"
 	}
 	if cfg.SpansIndexTable == "" {
-		if cfg.Replication {
+		if *cfg.Sharding {
 			cfg.SpansIndexTable = defaultSpansIndexTable
+			cfg.spansArchiveIndexTable = defaultSpansIndexTable + "_archive"
 		} else {
 			cfg.SpansIndexTable = defaultSpansIndexTable.ToLocal()
+			cfg.spansArchiveIndexTable = (defaultSpansIndexTable + "_archive").ToLocal()
 		}
+	} else {
+		cfg.spansArchiveIndexTable = cfg.SpansIndexTable + "_archive"
 	}
 	if cfg.OperationsTable == "" {
-		if cfg.Replication {
+		if *cfg.Sharding {
 			cfg.OperationsTable = defaultOperationsTable
+			cfg.operationsArchiveTable = defaultOperationsTable + "_archive"
 		} else {
 			cfg.OperationsTable = defaultOperationsTable.ToLocal()
+			cfg.operationsArchiveTable = (defaultOperationsTable + "_archive").ToLocal()
 		}
+	} else {
+		cfg.operationsArchiveTable = cfg.OperationsTable + "_archive"
+	}
+	if !cfg.ArchiveIndex {
+		cfg.spansArchiveIndexTable = ""
+		cfg.operationsArchiveTable = ""
+	}
+}
+
+func (cfg *Configuration) getInsertSettings() clickhousespanstore.InsertSettings {
+	return clickhousespanstore.InsertSettings{
+		Deduplication: cfg.InsertDeduplication,
+		Async:         cfg.AsyncInsert,
+		WaitForAsync:  *cfg.WaitForAsyncInsert,
+		SkipBatching:  cfg.AsyncInsertSkipBatching,
+		// Distributed tables are only created with sharding
+		DistributedSync: *cfg.Sharding && cfg.InsertDistributedSync,
+	}
+}
+
+// getMoveTo returns the destination of data moved after MoveAfterDays in TTL syntax, or an empty string
+func (cfg *Configuration) getMoveTo() string {
+	if cfg.MoveToVolume != "" {
+		return "TO VOLUME " + quote(cfg.MoveToVolume)
+	}
+	if cfg.MoveToDisk != "" {
+		return "TO DISK " + quote(cfg.MoveToDisk)
+	}
+	return ""
+}
+
+// getAddresses returns the addresses used by span writers and to initialize tables
+func (cfg *Configuration) getAddresses() []string {
+	if len(cfg.Addresses) == 0 {
+		return []string{sanitize(cfg.Address)}
+	}
+	addresses := make([]string, len(cfg.Addresses))
+	for i, address := range cfg.Addresses {
+		addresses[i] = sanitize(address)
 	}
+	return addresses
+}
+
+// getReadAddresses returns the addresses used by span readers, or nil if they share the connections of writers
+func (cfg *Configuration) getReadAddresses() []string {
+	if len(cfg.ReadAddresses) == 0 {
+		return nil
+	}
+	addresses := make([]string, len(cfg.ReadAddresses))
+	for i, address := range cfg.ReadAddresses {
+		addresses[i] = sanitize(address)
+	}
+	return addresses
+}
+
+// onCluster returns whether tables are created on the cluster, which is needed by both replication and sharding
+func (cfg *Configuration) onCluster() bool {
+	return cfg.Replication || *cfg.Sharding
+}
+
+// getReplicaArgs returns the arguments of the replicated table engines, or an empty string to use the server defaults
+func (cfg *Configuration) getReplicaArgs() string {
+	if cfg.ReplicaZooKeeperPath == "" {
+		return ""
+	}
+	return "(" + quote(cfg.ReplicaZooKeeperPath) + ", " + quote(cfg.ReplicaName) + ")"
+}
+
+// getDistributedSettings returns the settings of the Distributed engine sorted by name, or an empty string
+func (cfg *Configuration) getDistributedSettings() string {
+	settings := make([]string, 0, len(cfg.DistributedSettings))
+	for _, name := range sortedKeys(cfg.DistributedSettings) {
+		settings = append(settings, name+" = "+cfg.DistributedSettings[name])
+	}
+	return strings.Join(settings, ", ")
+}
+
+func (cfg *Configuration) getStoragePolicy() string {
+	if cfg.StoragePolicy == "" {
+		return ""
+	}
+	return quote(cfg.StoragePolicy)
+}
+
+// hasServiceColumn returns whether the spans table has a service column, which is needed for service TTLs
+func (cfg *Configuration) hasServiceColumn() bool {
+	return len(cfg.ServiceTTLDays) > 0
+}
+
+func (cfg *Configuration) getSpanLimits() clickhousespanstore.SpanLimits {
+	return clickhousespanstore.SpanLimits{
+		MaxTagValueLength: cfg.MaxTagValueLength,
+		MaxTags:           cfg.MaxTagsPerSpan,
+		MaxLogs:           cfg.MaxLogsPerSpan,
+		MaxSpanBytes:      cfg.MaxSpanBytes,
+	}
+}
+
+// getWriterSettings returns the settings of span writers which can be updated while they are running
+func (cfg *Configuration) getWriterSettings(
+	redactor *clickhousespanstore.Redactor,
+	tagIndex *clickhousespanstore.TagIndex,
+) clickhousespanstore.WriterSettings {
+	return clickhousespanstore.WriterSettings{
+		SpanLimits:      cfg.getSpanLimits(),
+		Redactor:        redactor,
+		TagIndex:        tagIndex,
+		Delay:           cfg.BatchFlushInterval,
+		Size:            cfg.BatchWriteSize,
+		Adaptive:        cfg.getAdaptiveBatching(),
+		MaxSpanCount:    cfg.MaxSpanCount,
+		MaxPendingBytes: cfg.MaxPendingBytes,
+	}
+}
+
+// getArchiveWriterSettings returns the settings of the archive span writer. Archiving is rare, so the archive writer
+// keeps the static batch size and interval. Archiving is requested explicitly, so archived spans are not sampled,
+// and the archive table has no service column, as archived traces are kept for the archive TTL.
+func (cfg *Configuration) getArchiveWriterSettings(
+	redactor *clickhousespanstore.Redactor,
+	tagIndex *clickhousespanstore.TagIndex,
+) clickhousespanstore.WriterSettings {
+	settings := cfg.getWriterSettings(redactor, tagIndex)
+	settings.Adaptive = clickhousespanstore.AdaptiveBatching{}
+	return settings
+}
+
+func (cfg *Configuration) getAdaptiveBatching() clickhousespanstore.AdaptiveBatching {
+	return clickhousespanstore.AdaptiveBatching{
+		Enabled:     cfg.AdaptiveBatching,
+		MinSize:     cfg.MinBatchWriteSize,
+		MaxSize:     cfg.MaxBatchWriteSize,
+		MinInterval: cfg.MinBatchFlushInterval,
+		MaxInterval: cfg.MaxBatchFlushInterval,
+	}
+}
+
+// GetLogLevel returns the level of log_level, or hclog.NoLevel if it is unknown
+func (cfg *Configuration) GetLogLevel() hclog.Level {
+	if cfg.LogLevel == "" {
+		return hclog.LevelFromString(defaultLogLevel)
+	}
+	return hclog.LevelFromString(cfg.LogLevel)
 }
 
 func (cfg *Configuration) GetSpansArchiveTable() clickhousespanstore.TableName {
 	return cfg.spansArchiveTable
 }
+
+// GetSpansArchiveIndexTable returns the index table for archived spans, or an empty name if archive_index is disabled.
+func (cfg *Configuration) GetSpansArchiveIndexTable() clickhousespanstore.TableName {
+	return cfg.spansArchiveIndexTable
+}
+
+// GetOperationsArchiveTable returns the operations table for archived spans, or an empty name if archive_index is disabled.
+func (cfg *Configuration) GetOperationsArchiveTable() clickhousespanstore.TableName {
+	return cfg.operationsArchiveTable
+}
@@ -35,6 +35,22 @@ func TestSetDefaults(t *testing.T) {
 			getField: func(config Configuration) interface{} { return config.BatchFlushInterval },
 			expected: defaultBatchDelay,
 		},
+		"min batch write size": {
+			getField: func(config Configuration) interface{} { return config.MinBatchWriteSize },
+			expected: int64(defaultBatchSize / 10),
+		},
+		"max batch write size": {
+			getField: func(config Configuration) interface{} { return config.MaxBatchWriteSize },
+			expected: int64(defaultBatchSize * 10),
+		},
+		"min batch flush interval": {
+			getField: func(config Configuration) interface{} { return config.MinBatchFlushInterval },
+			expected: defaultBatchDelay / 5,
+		},
+		"max batch flush interval": {
+			getField: func(config Configuration) interface{} { return config.MaxBatchFlushInterval },
+			expected: defaultBatchDelay * 6,
+		},
 		"max span count": {
 			getField: func(config Configuration) interface{} { return config.MaxSpanCount },
 			expected: defaultMaxSpanCount,
@@ -70,6 +86,39 @@ func TestSetDefaults(t *testing.T) {
 			getField:    func(config Configuration) interface{} { return config.OperationsTable },
 			expected:    defaultOperationsTable,
 		},
+		"sharding local": {
+			getField: func(config Configuration) interface{} { return *config.Sharding },
+			expected: false,
+		},
+		"sharding replication": {
+			replication: true,
+			getField:    func(config Configuration) interface{} { return *config.Sharding },
+			expected:    true,
+		},
+		"wait for async insert": {
+			getField: func(config Configuration) interface{} { return *config.WaitForAsyncInsert },
+			expected: true,
+		},
+		"cluster": {
+			getField: func(config Configuration) interface{} { return config.Cluster },
+			expected: defaultCluster,
+		},
+		"replica name": {
+			getField: func(config Configuration) interface{} { return config.ReplicaName },
+			expected: defaultReplicaName,
+		},
+		"spans sharding key": {
+			getField: func(config Configuration) interface{} { return config.SpansShardingKey },
+			expected: defaultTraceShardingKey,
+		},
+		"index sharding key": {
+			getField: func(config Configuration) interface{} { return config.IndexShardingKey },
+			expected: defaultTraceShardingKey,
+		},
+		"operations sharding key": {
+			getField: func(config Configuration) interface{} { return config.OperationsShardingKey },
+			expected: defaultOperationsShardingKey,
+		},
 		"max number spans": {
 			getField: func(config Configuration) interface{} { return config.MaxNumSpans },
 			expected: defaultMaxNumSpans,
@@ -103,6 +152,39 @@ func TestConfiguration_GetSpansArchiveTable(t *testing.T) {
 	}
 }
 
+func TestConfiguration_GetArchiveIndexTables(t *testing.T) {
+	tests := map[string]struct {
+		config                         Configuration
+		expectedSpansArchiveIndexTable clickhousespanstore.TableName
+		expectedOperationsArchiveTable clickhousespanstore.TableName
+	}{
+		"disabled": {config: Configuration{}},
+		"default_config_local": {
+			config:                         Configuration{ArchiveIndex: true},
+			expectedSpansArchiveIndexTable: (defaultSpansIndexTable + "_archive").ToLocal(),
+			expectedOperationsArchiveTable: (defaultOperationsTable + "_archive").ToLocal(),
+		},
+		"default_config_replication": {
+			config:                         Configuration{ArchiveIndex: true, Replication: true},
+			expectedSpansArchiveIndexTable: defaultSpansIndexTable + "_archive",
+			expectedOperationsArchiveTable: defaultOperationsTable + "_archive",
+		},
+		"custom_tables": {
+			config:                         Configuration{ArchiveIndex: true, SpansIndexTable: "custom_index", OperationsTable: "custom_operations"},
+			expectedSpansArchiveIndexTable: "custom_index_archive",
+			expectedOperationsArchiveTable: "custom_operations_archive",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.config.setDefaults()
+			assert.Equal(t, test.expectedSpansArchiveIndexTable, test.config.GetSpansArchiveIndexTable())
+			assert.Equal(t, test.expectedOperationsArchiveTable, test.config.GetOperationsArchiveTable())
+		})
+	}
+}
+
 func TestConfiguration_InitTables(test *testing.T) {
 	// for pointers below
 	t := true
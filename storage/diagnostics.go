@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+const (
+	diagnosticsTimeout = 5 * time.Second
+	maskedSecret       = "*****"
+)
+
+// HealthHandler serves whether ClickHouse answers a ping
+func (s *Store) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), diagnosticsTimeout)
+		defer cancel()
+		var problems []string
+		if err := s.db.PingContext(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("could not ping ClickHouse: %s", err))
+		}
+		if s.readDB != nil && s.readDB != s.db {
+			if err := s.readDB.PingContext(ctx); err != nil {
+				problems = append(problems, fmt.Sprintf("could not ping ClickHouse read addresses: %s", err))
+			}
+		}
+		writeProblems(w, problems)
+	})
+}
+
+// ReadyHandler serves whether the tables exist, and spans are written without a growing backlog
+func (s *Store) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), diagnosticsTimeout)
+		defer cancel()
+		cfg := s.config()
+		problems := s.missingTables(ctx, cfg)
+		if writer, ok := s.writer.(*clickhousespanstore.SpanWriter); ok {
+			backlog := writer.Backlog()
+			if backlog.QueueCapacity > 0 && backlog.Queued >= backlog.QueueCapacity {
+				problems = append(problems, fmt.Sprintf("span writer is saturated with %d queued spans", backlog.Queued))
+			}
+			if cfg.ReadyMaxPendingSpans > 0 && backlog.Pending > int64(cfg.ReadyMaxPendingSpans) {
+				problems = append(problems, fmt.Sprintf("%d spans are pending writes, more than ready_max_pending_spans %d",
+					backlog.Pending, cfg.ReadyMaxPendingSpans))
+			}
+		}
+		writeProblems(w, problems)
+	})
+}
+
+// ConfigHandler serves the configuration in effect as YAML, with secrets masked
+func (s *Store) ConfigHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		out, err := yaml.Marshal(maskSecrets(s.config()))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(out)
+	})
+}
+
+// config returns the configuration in effect
+func (s *Store) config() Configuration {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	return s.cfg
+}
+
+// missingTables returns a problem for each table which spans are written to or read from that does not exist
+func (s *Store) missingTables(ctx context.Context, cfg Configuration) []string {
+	tables := []clickhousespanstore.TableName{cfg.SpansTable, cfg.SpansIndexTable, cfg.OperationsTable}
+	query := fmt.Sprintf(
+		"SELECT name FROM system.tables WHERE database = ? AND name IN (%s)",
+		"?"+strings.Repeat(", ?", len(tables)-1),
+	)
+	args := []interface{}{cfg.Database}
+	for _, table := range tables {
+		args = append(args, string(table))
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return []string{fmt.Sprintf("could not list tables: %s", err)}
+	}
+	defer rows.Close()
+	existing := make(map[string]bool, len(tables))
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return []string{fmt.Sprintf("could not list tables: %s", err)}
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return []string{fmt.Sprintf("could not list tables: %s", err)}
+	}
+
+	var problems []string
+	for _, table := range tables {
+		if !existing[string(table)] {
+			problems = append(problems, fmt.Sprintf("table %s.%s does not exist", cfg.Database, table))
+		}
+	}
+	return problems
+}
+
+// writeProblems responds with 503 Service Unavailable listing problems, or with 200 OK if there are none
+func writeProblems(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// maskSecrets returns cfg with passwords, header values and the redaction hash salt masked
+func maskSecrets(cfg Configuration) Configuration {
+	if cfg.Password != "" {
+		cfg.Password = maskedSecret
+	}
+	if proxy, err := url.Parse(cfg.HTTPProxy); err == nil && proxy.User != nil {
+		if _, ok := proxy.User.Password(); ok {
+			proxy.User = url.UserPassword(proxy.User.Username(), maskedSecret)
+			cfg.HTTPProxy = proxy.String()
+		}
+	}
+	if len(cfg.HTTPHeaders) > 0 {
+		headers := make(map[string]string, len(cfg.HTTPHeaders))
+		for name := range cfg.HTTPHeaders {
+			headers[name] = maskedSecret
+		}
+		cfg.HTTPHeaders = headers
+	}
+	if cfg.Redaction.HashSalt != "" {
+		cfg.Redaction.HashSalt = maskedSecret
+	}
+	return cfg
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables overriding configuration fields,
+// followed by the upper-cased yaml key, e.g. JAEGER_CLICKHOUSE_ADDRESS for address.
+const EnvPrefix = "JAEGER_CLICKHOUSE_"
+
+// envReference matches ${NAME} references to environment variables, and $${ escaping them
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ParseConfiguration parses the YAML configuration in data. References to environment variables in values,
+// e.g. ${CLICKHOUSE_ADDRESS}, are replaced by their values, and escaped references, e.g. $${name}, by ${name}.
+// Environment variables named after the EnvPrefix and the yaml key of a top level field override the field.
+// Unknown keys are rejected with a *ValidationError listing all of them.
+func ParseConfiguration(data []byte, lookupEnv func(string) (string, bool)) (Configuration, error) {
+	var cfg Configuration
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return cfg, err
+	}
+	if problems := unknownKeys(&root, reflect.TypeOf(cfg), ""); len(problems) > 0 {
+		return cfg, &ValidationError{Problems: problems}
+	}
+	if err := interpolate(&root, lookupEnv); err != nil {
+		return cfg, err
+	}
+	if root.Kind != 0 {
+		if err := root.Decode(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, overrideFromEnv(&cfg, lookupEnv)
+}
+
+// interpolate replaces references to environment variables in scalar values of node and its children
+func interpolate(node *yaml.Node, lookupEnv func(string) (string, bool)) error {
+	if node.Kind == yaml.ScalarNode {
+		var err error
+		value := envReference.ReplaceAllStringFunc(node.Value, func(reference string) string {
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+			name := envReference.FindStringSubmatch(reference)[1]
+			value, ok := lookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s referenced in line %d is not set", name, node.Line)
+			}
+			return value
+		})
+		if value != node.Value && node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle) == 0 {
+			// Resolve the type of plain values again, e.g. for numbers from environment variables
+			node.Tag = ""
+		}
+		node.Value = value
+		return err
+	}
+	for i, child := range node.Content {
+		if node.Kind == yaml.MappingNode && i%2 == 0 {
+			// Keys are not interpolated
+			continue
+		}
+		if err := interpolate(child, lookupEnv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unknownKeys returns a problem for each key of node and its children which is not a yaml key of the fields of t
+func unknownKeys(node *yaml.Node, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var problems []string
+	switch {
+	case node.Kind == yaml.DocumentNode:
+		for _, child := range node.Content {
+			problems = append(problems, unknownKeys(child, t, path)...)
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if key := yamlKey(t.Field(i)); key != "" {
+				fields[key] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("unknown key %s%s in line %d", path, key.Value, key.Line))
+				continue
+			}
+			problems = append(problems, unknownKeys(node.Content[i+1], fieldType, path+key.Value+".")...)
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			problems = append(problems, unknownKeys(node.Content[i+1], t.Elem(), path+node.Content[i].Value+".")...)
+		}
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for _, child := range node.Content {
+			problems = append(problems, unknownKeys(child, t.Elem(), path)...)
+		}
+	}
+	return problems
+}
+
+// overrideFromEnv sets the fields of cfg for which an environment variable is set.
+// String fields are set to the value as is, other fields are parsed from the value as YAML, e.g. [a, b] for lists.
+func overrideFromEnv(cfg *Configuration, lookupEnv func(string) (string, bool)) error {
+	value := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		key := yamlKey(value.Type().Field(i))
+		if key == "" {
+			continue
+		}
+		name := EnvPrefix + strings.ToUpper(key)
+		env, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		field := value.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(env)
+			continue
+		}
+		if err := yaml.Unmarshal([]byte(env), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("could not parse environment variable %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// yamlKey returns the yaml key of an exported field, or an empty string if it has none
+func yamlKey(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if key == "-" {
+		return ""
+	}
+	return key
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lookupEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestParseConfiguration(t *testing.T) {
+	tests := map[string]struct {
+		config   string
+		env      map[string]string
+		expected Configuration
+	}{
+		"empty": {},
+		"interpolation": {
+			config: "address: ${HOST}:9000\npassword: ${PASSWORD}\nmax_span_count: ${MAX_SPAN_COUNT}\n",
+			env:    map[string]string{"HOST": "clickhouse", "PASSWORD": "secret", "MAX_SPAN_COUNT": "100"},
+			expected: Configuration{
+				Address:      "clickhouse:9000",
+				Password:     "secret",
+				MaxSpanCount: 100,
+			},
+		},
+		"quoted interpolation": {
+			config:   "password: \"${PASSWORD}\"\n",
+			env:      map[string]string{"PASSWORD": "123"},
+			expected: Configuration{Password: "123"},
+		},
+		"escaped reference": {
+			config:   "password: $${PASSWORD}\n",
+			env:      map[string]string{"PASSWORD": "secret"},
+			expected: Configuration{Password: "${PASSWORD}"},
+		},
+		"keys are not interpolated": {
+			config:   "http_headers:\n  ${HEADER}: ${VALUE}\n",
+			env:      map[string]string{"HEADER": "X-Api-Key", "VALUE": "secret"},
+			expected: Configuration{HTTPHeaders: map[string]string{"${HEADER}": "secret"}},
+		},
+		"env overrides": {
+			config: "address: clickhouse:9000\nreplication: false\n",
+			env: map[string]string{
+				"JAEGER_CLICKHOUSE_ADDRESS":              "other:9000",
+				"JAEGER_CLICKHOUSE_REPLICATION":          "true",
+				"JAEGER_CLICKHOUSE_TTL":                  "72",
+				"JAEGER_CLICKHOUSE_ADDRESSES":            "[a:9000, b:9000]",
+				"JAEGER_CLICKHOUSE_BATCH_FLUSH_INTERVAL": "10s",
+				"JAEGER_CLICKHOUSE_PASSWORD":             "123",
+			},
+			expected: Configuration{
+				Address:            "other:9000",
+				Replication:        true,
+				TTLDays:            72,
+				Addresses:          []string{"a:9000", "b:9000"},
+				BatchFlushInterval: 10 * time.Second,
+				Password:           "123",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := ParseConfiguration([]byte(test.config), lookupEnv(test.env))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, cfg)
+		})
+	}
+}
+
+func TestParseConfiguration_Errors(t *testing.T) {
+	tests := map[string]struct {
+		config      string
+		env         map[string]string
+		expectedErr string
+	}{
+		"unset variable": {
+			config:      "address: clickhouse:9000\npassword: ${PASSWORD}\n",
+			expectedErr: "environment variable PASSWORD referenced in line 2 is not set",
+		},
+		"invalid override": {
+			env:         map[string]string{"JAEGER_CLICKHOUSE_REPLICATION": "maybe"},
+			expectedErr: "could not parse environment variable JAEGER_CLICKHOUSE_REPLICATION",
+		},
+		"unknown keys": {
+			config:      "adress: clickhouse:9000\nsampling:\n  rates: 0.5\ntag_index:\n  services:\n    frontend:\n      allow: [a]\n",
+			expectedErr: "invalid configuration: unknown key adress in line 1; unknown key sampling.rates in line 3; unknown key tag_index.services.frontend.allow in line 7",
+		},
+		"invalid yaml": {
+			config:      "address: [",
+			expectedErr: "yaml:",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseConfiguration([]byte(test.config), lookupEnv(test.env))
+			assert.ErrorContains(t, err, test.expectedErr)
+		})
+	}
+}
+
+func TestParseConfiguration_ExampleConfig(t *testing.T) {
+	data, err := os.ReadFile("../config.yaml")
+	require.NoError(t, err)
+	cfg, err := ParseConfiguration(data, lookupEnv(nil))
+	require.NoError(t, err)
+	assert.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"os"
+	"strings"
+	"sync"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// passwordFile holds the password read from a file, and reads it again on demand, e.g. after it was rotated
+type passwordFile struct {
+	path string
+
+	mutex    sync.Mutex
+	password string
+}
+
+func newPasswordFile(path string) (*passwordFile, error) {
+	file := &passwordFile{path: path}
+	if _, err := file.reload(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *passwordFile) get() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.password
+}
+
+// reload reads the file again, and returns whether the password changed
+func (f *passwordFile) reload() (bool, error) {
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	// Files written by editors and secret stores often end with a new line
+	password := strings.TrimRight(string(content), "\r\n")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	changed := password != f.password
+	f.password = password
+	return changed, nil
+}
+
+// passwordConnector connects with the current password of a password file.
+// If connecting fails and the password file changed, connecting is retried with the new password.
+type passwordConnector struct {
+	options  clickhouse.Options
+	password *passwordFile
+	// newConnector returns the connector of options
+	newConnector func(*clickhouse.Options) driver.Connector
+
+	mutex     sync.Mutex
+	current   string
+	connector driver.Connector
+}
+
+var _ driver.Connector = (*passwordConnector)(nil)
+
+func newPasswordConnector(options clickhouse.Options, password *passwordFile) *passwordConnector {
+	connector := &passwordConnector{options: options, password: password, newConnector: clickhouse.Connector}
+	connector.get()
+	return connector
+}
+
+// Connect implements driver.Connector
+func (c *passwordConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.get().Connect(ctx)
+	if err == nil {
+		return conn, nil
+	}
+	if changed, reloadErr := c.password.reload(); reloadErr != nil || !changed {
+		return nil, err
+	}
+	return c.get().Connect(ctx)
+}
+
+// Driver implements driver.Connector
+func (c *passwordConnector) Driver() driver.Driver {
+	return c.get().Driver()
+}
+
+// get returns the connector of the current password
+func (c *passwordConnector) get() driver.Connector {
+	password := c.password.get()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.connector == nil || password != c.current {
+		options := c.options
+		options.Auth.Password = password
+		c.connector = c.newConnector(&options)
+		c.current = password
+	}
+	return c.connector
+}
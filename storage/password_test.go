@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordFile(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "password", []byte("secret\n"))
+
+	file, err := newPasswordFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", file.get())
+
+	changed, err := file.reload()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	writeFile(t, dir, "password", []byte("rotated"))
+	changed, err = file.reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "rotated", file.get())
+
+	_, err = newPasswordFile(filepath.Join(dir, "missing"))
+	assert.ErrorContains(t, err, "no such file or directory")
+}
+
+func TestPasswordConnector_Connect(t *testing.T) {
+	authErr := errors.New("authentication failed")
+	tests := map[string]struct {
+		rotated      string
+		expectedErr  error
+		expectedUsed []string
+	}{
+		"rotated password": {
+			rotated:      "rotated",
+			expectedUsed: []string{"secret", "rotated"},
+		},
+		"unchanged password": {
+			rotated:      "secret",
+			expectedErr:  authErr,
+			expectedUsed: []string{"secret"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			file, err := newPasswordFile(writeFile(t, dir, "password", []byte("secret")))
+			require.NoError(t, err)
+
+			var used []string
+			connector := newPasswordConnector(clickhouse.Options{Addr: []string{"localhost:9000"}}, file)
+			connector.newConnector = func(options *clickhouse.Options) driver.Connector {
+				used = append(used, options.Auth.Password)
+				fake := &fakeConnector{address: options.Addr[0]}
+				if options.Auth.Password != "rotated" {
+					fake.err = authErr
+				}
+				return fake
+			}
+			connector.connector = nil
+
+			writeFile(t, dir, "password", []byte(test.rotated))
+			conn, err := connector.Connect(context.Background())
+			if test.expectedErr != nil {
+				assert.ErrorIs(t, err, test.expectedErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, fakeConn{address: "localhost:9000"}, conn)
+			}
+			assert.Equal(t, test.expectedUsed, used)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"reflect"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// reloadableFields are the yaml keys of the configuration fields which Reload applies while the plugin is running
+var reloadableFields = map[string]bool{
+	"batch_write_size":         true,
+	"batch_flush_interval":     true,
+	"adaptive_batching":        true,
+	"min_batch_write_size":     true,
+	"max_batch_write_size":     true,
+	"min_batch_flush_interval": true,
+	"max_batch_flush_interval": true,
+	"max_span_count":           true,
+	"max_pending_bytes":        true,
+	"max_tag_value_length":     true,
+	"max_tags_per_span":        true,
+	"max_logs_per_span":        true,
+	"max_span_bytes":           true,
+	"redaction":                true,
+	"tag_index":                true,
+	"sampling":                 true,
+	"max_num_spans":            true,
+	"ready_max_pending_spans":  true,
+	"log_level":                true,
+}
+
+// Reload applies the fields of cfg which can be changed while the plugin is running: batching, limits of spans,
+// redaction, tag index and sampling rules, max_num_spans and log_level. Changes of other fields are logged
+// and only take effect after a restart. Invalid configurations are rejected without applying any field.
+func (s *Store) Reload(cfg Configuration) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	cfg.setDefaults()
+	redactor, err := clickhousespanstore.NewRedactor(cfg.Redaction)
+	if err != nil {
+		return err
+	}
+	tagIndex := clickhousespanstore.NewTagIndex(s.logger, cfg.TagIndex)
+
+	s.applyMutex.Lock()
+	defer s.applyMutex.Unlock()
+	s.reloadMutex.Lock()
+	old := s.cfg
+	s.reloadMutex.Unlock()
+	reloadable, restart := changedFields(old, cfg)
+	if len(restart) > 0 {
+		s.logger.Warn("Configuration changes require a restart", "fields", restart)
+	}
+	if len(reloadable) == 0 {
+		return nil
+	}
+
+	if old.LogLevel != cfg.LogLevel {
+		s.logger.SetLevel(cfg.GetLogLevel())
+	}
+	if writer, ok := s.writer.(*clickhousespanstore.SpanWriter); ok {
+		writer.Update(cfg.getWriterSettings(redactor, tagIndex))
+		if !reflect.DeepEqual(old.Sampling, cfg.Sampling) {
+			// The sampler keeps rate limits and decisions of recent traces, so it is only replaced if its rules changed
+			writer.SetSampler(clickhousespanstore.NewSampler(cfg.Sampling))
+		}
+	}
+	archiveSettings := cfg.getArchiveWriterSettings(redactor, tagIndex)
+	switch archiveWriter := s.archiveWriter.(type) {
+	case *clickhousespanstore.SpanWriter:
+		archiveWriter.Update(archiveSettings)
+	case *clickhousespanstore.ArchiveWriter:
+		archiveWriter.Update(tagIndex, archiveSettings)
+	}
+	for _, reader := range []spanstore.Reader{s.reader, s.archiveReader} {
+		if traceReader, ok := reader.(*clickhousespanstore.TraceReader); ok {
+			traceReader.Update(cfg.MaxNumSpans, tagIndex)
+		}
+	}
+
+	s.reloadMutex.Lock()
+	copyFields(&s.cfg, cfg, reloadable)
+	s.reloadMutex.Unlock()
+	s.logger.Info("Applied configuration changes", "fields", reloadable)
+	return nil
+}
+
+// changedFields returns the yaml keys of the fields which differ between old and new,
+// split into the ones which can be reloaded and the ones which require a restart
+func changedFields(old, new Configuration) (reloadable []string, restart []string) {
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		key := yamlKey(oldValue.Type().Field(i))
+		if key == "" || reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		if reloadableFields[key] {
+			reloadable = append(reloadable, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	return reloadable, restart
+}
+
+// copyFields sets the fields of dst with the given yaml keys to their values in src
+func copyFields(dst *Configuration, src Configuration, keys []string) {
+	copied := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		copied[key] = true
+	}
+	dstValue, srcValue := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src)
+	for i := 0; i < dstValue.NumField(); i++ {
+		if copied[yamlKey(dstValue.Type().Field(i))] {
+			dstValue.Field(i).Set(srcValue.Field(i))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+func newReloadTestStore(t *testing.T, logger mocks.SpyLogger, cfg Configuration) *Store {
+	db, _, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	t.Cleanup(func() { _ = db.Close() })
+
+	cfg.setDefaults()
+	newWriter := func() *clickhousespanstore.SpanWriter {
+		return clickhousespanstore.NewSpanWriter(clickhousespanstore.SpanWriterParams{
+			Logger:         logger,
+			DB:             db,
+			IndexTable:     testIndexTable,
+			SpansTable:     testSpansTable,
+			Encoding:       clickhousespanstore.EncodingJSON,
+			WriterSettings: cfg.getWriterSettings(nil, nil),
+		})
+	}
+	writer, archiveWriter := newWriter(), newWriter()
+	t.Cleanup(func() {
+		_ = writer.Close()
+		_ = archiveWriter.Close()
+	})
+	return &Store{
+		logger:        logger,
+		cfg:           cfg,
+		writer:        writer,
+		archiveWriter: archiveWriter,
+		reader:        clickhousespanstore.NewTraceReader(db, testOperationsTable, testIndexTable, testSpansTable, "", cfg.MaxNumSpans, nil),
+		archiveReader: clickhousespanstore.NewTraceReader(db, "", "", testSpansArchiveTable, "", cfg.MaxNumSpans, nil),
+	}
+}
+
+func TestStore_Reload(t *testing.T) {
+	logger := mocks.NewSpyLogger()
+	store := newReloadTestStore(t, logger, Configuration{Address: "clickhouse:9000"})
+
+	rate := 0.5
+	err := store.Reload(Configuration{
+		Address:        "other:9000",
+		BatchWriteSize: 100,
+		MaxNumSpans:    10,
+		TagIndex:       clickhousespanstore.TagIndexRules{DenyKeys: []string{"key"}},
+		Sampling:       clickhousespanstore.SamplingRules{Rate: &rate},
+	})
+	require.NoError(t, err)
+
+	logger.AssertLogsOfLevelEqual(t, hclog.Warn, []mocks.LogMock{
+		{Msg: "Configuration changes require a restart", Args: []interface{}{"fields", []string{"address"}}},
+	})
+	logger.AssertLogsOfLevelEqual(t, hclog.Info, []mocks.LogMock{
+		{Msg: "Applied configuration changes", Args: []interface{}{"fields", []string{
+			"batch_write_size", "min_batch_write_size", "max_batch_write_size", "tag_index", "sampling", "max_num_spans",
+		}}},
+	})
+	// Fields which require a restart keep the values in effect
+	assert.Equal(t, "clickhouse:9000", store.cfg.Address)
+	assert.Equal(t, int64(100), store.cfg.BatchWriteSize)
+	assert.Equal(t, uint(10), store.cfg.MaxNumSpans)
+}
+
+func TestStore_ReloadUnchanged(t *testing.T) {
+	logger := mocks.NewSpyLogger()
+	store := newReloadTestStore(t, logger, Configuration{Address: "clickhouse:9000"})
+
+	require.NoError(t, store.Reload(Configuration{Address: "clickhouse:9000"}))
+	logger.AssertLogsEmpty(t)
+}
+
+func TestStore_ReloadInvalid(t *testing.T) {
+	logger := mocks.NewSpyLogger()
+	store := newReloadTestStore(t, logger, Configuration{Address: "clickhouse:9000"})
+
+	err := store.Reload(Configuration{Address: "clickhouse:9000", BatchWriteSize: -1})
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, int64(defaultBatchSize), store.cfg.BatchWriteSize)
+	logger.AssertLogsEmpty(t)
+}
+
+func TestStore_ReloadClosedWriter(t *testing.T) {
+	logger := mocks.NewSpyLogger()
+	store := newReloadTestStore(t, logger, Configuration{Address: "clickhouse:9000"})
+	require.NoError(t, store.writer.(*clickhousespanstore.SpanWriter).Close())
+
+	// Updates of writers which already finished, e.g. while the plugin shuts down, do not block
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- store.Reload(Configuration{Address: "clickhouse:9000", BatchWriteSize: 100})
+	}()
+	select {
+	case err := <-reloaded:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Reload blocked")
+	}
+	assert.Equal(t, int64(100), store.cfg.BatchWriteSize)
+}
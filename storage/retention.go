@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// renderTTL returns the TTL clause moving rows by column to moveTo after moveDays and deleting them according to
+// the retention settings, or an empty string if rows are never moved or deleted.
+// Rows of services in serviceDays are kept for their number of days, then rows of tenants in tenantDays,
+// and all other rows for days. Zero days keep rows forever. Service rules require a service column,
+// and tenant rules are only rendered for multitenant tables.
+func renderTTL(column string, moveDays uint, moveTo string, days uint, serviceDays, tenantDays map[string]uint, multitenant bool) string {
+	var (
+		rules    []string
+		services []string
+		tenants  []string
+	)
+	if moveDays > 0 && moveTo != "" {
+		rules = append(rules, fmt.Sprintf("%s + INTERVAL %d DAY %s", column, moveDays, moveTo))
+	}
+	rule := func(days uint, conditions []string) {
+		if days == 0 {
+			return
+		}
+		ttl := fmt.Sprintf("%s + INTERVAL %d DAY DELETE", column, days)
+		if len(conditions) > 0 {
+			ttl += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		rules = append(rules, ttl)
+	}
+
+	for _, service := range sortedKeys(serviceDays) {
+		rule(serviceDays[service], []string{"service = " + quote(service)})
+		services = append(services, quote(service))
+	}
+	var exceptServices []string
+	if len(services) > 0 {
+		exceptServices = []string{fmt.Sprintf("service NOT IN (%s)", strings.Join(services, ", "))}
+	}
+
+	if multitenant {
+		for _, tenant := range sortedKeys(tenantDays) {
+			rule(tenantDays[tenant], append([]string{"tenant = " + quote(tenant)}, exceptServices...))
+			tenants = append(tenants, quote(tenant))
+		}
+	}
+	exceptTenants := exceptServices
+	if len(tenants) > 0 {
+		exceptTenants = append(exceptTenants, fmt.Sprintf("tenant NOT IN (%s)", strings.Join(tenants, ", ")))
+	}
+	rule(days, exceptTenants)
+
+	if len(rules) == 0 {
+		return ""
+	}
+	return "TTL " + strings.Join(rules, ", ")
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quote returns value as a ClickHouse string literal
+func quote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTTL(t *testing.T) {
+	tests := map[string]struct {
+		moveDays    uint
+		moveTo      string
+		days        uint
+		serviceDays map[string]uint
+		tenantDays  map[string]uint
+		multitenant bool
+		expected    string
+	}{
+		"none": {
+			expected: "",
+		},
+		"default": {
+			days:     3,
+			expected: "TTL timestamp + INTERVAL 3 DAY DELETE",
+		},
+		"service kept forever": {
+			days:        3,
+			serviceDays: map[string]uint{"audit": 0},
+			expected:    "TTL timestamp + INTERVAL 3 DAY DELETE WHERE service NOT IN ('audit')",
+		},
+		"services without default": {
+			serviceDays: map[string]uint{"debug": 1},
+			expected:    "TTL timestamp + INTERVAL 1 DAY DELETE WHERE service = 'debug'",
+		},
+		"tenants ignored without tenant column": {
+			days:       3,
+			tenantDays: map[string]uint{"tenant": 1},
+			expected:   "TTL timestamp + INTERVAL 3 DAY DELETE",
+		},
+		"tenants": {
+			days:        3,
+			tenantDays:  map[string]uint{"tenant": 1},
+			multitenant: true,
+			expected:    "TTL timestamp + INTERVAL 1 DAY DELETE WHERE tenant = 'tenant', timestamp + INTERVAL 3 DAY DELETE WHERE tenant NOT IN ('tenant')",
+		},
+		"move": {
+			moveDays: 2,
+			moveTo:   "TO VOLUME 'cold'",
+			days:     3,
+			expected: "TTL timestamp + INTERVAL 2 DAY TO VOLUME 'cold', timestamp + INTERVAL 3 DAY DELETE",
+		},
+		"move without volume": {
+			moveDays: 2,
+			expected: "",
+		},
+		"quoted": {
+			serviceDays: map[string]uint{`it's\`: 1},
+			expected:    `TTL timestamp + INTERVAL 1 DAY DELETE WHERE service = 'it\'s\\'`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, renderTTL("timestamp", test.moveDays, test.moveTo, test.days, test.serviceDays, test.tenantDays, test.multitenant))
+		})
+	}
+}
@@ -1,15 +1,16 @@
 package storage
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -18,6 +19,7 @@ import (
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
 	"github.com/jaegertracing/jaeger/storage/dependencystore"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/prometheus/client_golang/prometheus"
 
 	jaegerclickhouse "github.com/jaegertracing/jaeger-clickhouse"
 	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousedependencystore"
@@ -25,11 +27,23 @@ import (
 )
 
 type Store struct {
-	db            *sql.DB
+	logger hclog.Logger
+	// cfg is the configuration in effect, with the defaults applied
+	cfg Configuration
+	// reloadMutex guards cfg, it is only held briefly so diagnostics handlers do not wait for writers
+	reloadMutex sync.Mutex
+	// applyMutex serializes Reload
+	applyMutex sync.Mutex
+
+	db *sql.DB
+	// readDB is used by span readers if read addresses are configured, otherwise it is db
+	readDB        *sql.DB
 	writer        spanstore.Writer
 	reader        spanstore.Reader
 	archiveWriter spanstore.Writer
 	archiveReader spanstore.Reader
+	// volumes reports the size of tables on volumes when tiered storage is configured
+	volumes prometheus.Collector
 }
 
 var (
@@ -40,107 +54,133 @@ var (
 )
 
 func NewStore(logger hclog.Logger, cfg Configuration) (*Store, error) {
+	return createStore(logger, cfg, true)
+}
+
+// NewReadOnlyStore returns a Store for reading traces, e.g. to export them. Unlike NewStore, it neither runs
+// the scripts of init_sql_scripts_dir nor creates or alters tables, regardless of init_tables and update_ttl.
+func NewReadOnlyStore(logger hclog.Logger, cfg Configuration) (*Store, error) {
+	return createStore(logger, cfg, false)
+}
+
+func createStore(logger hclog.Logger, cfg Configuration, initTables bool) (*Store, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	cfg.setDefaults()
-	db, err := connector(cfg)
+	redactor, err := clickhousespanstore.NewRedactor(cfg.Redaction)
+	if err != nil {
+		return nil, err
+	}
+	tagIndex := clickhousespanstore.NewTagIndex(logger, cfg.TagIndex)
+	db, err := connector(logger, cfg, "write", cfg.getAddresses())
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to database: %q", err)
 	}
 
-	if err := runInitScripts(logger, db, cfg); err != nil {
-		_ = db.Close()
-		return nil, err
+	if initTables {
+		if err := runInitScripts(logger, db, cfg); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
 	}
-	if cfg.Replication {
-		return &Store{
-			db: db,
-			writer: clickhousespanstore.NewSpanWriter(
-				logger,
-				db,
-				cfg.SpansIndexTable,
-				cfg.SpansTable,
-				cfg.Tenant,
-				clickhousespanstore.Encoding(cfg.Encoding),
-				cfg.BatchFlushInterval,
-				cfg.BatchWriteSize,
-				cfg.MaxSpanCount,
-			),
-			reader: clickhousespanstore.NewTraceReader(
-				db,
-				cfg.OperationsTable,
-				cfg.SpansIndexTable,
-				cfg.SpansTable,
-				cfg.Tenant,
-				cfg.MaxNumSpans,
-			),
-			archiveWriter: clickhousespanstore.NewSpanWriter(
-				logger,
-				db,
-				"",
-				cfg.GetSpansArchiveTable(),
-				cfg.Tenant,
-				clickhousespanstore.Encoding(cfg.Encoding),
-				cfg.BatchFlushInterval,
-				cfg.BatchWriteSize,
-				cfg.MaxSpanCount,
-			),
-			archiveReader: clickhousespanstore.NewTraceReader(
-				db,
-				"",
-				"",
-				cfg.GetSpansArchiveTable(),
-				cfg.Tenant,
-				cfg.MaxNumSpans,
-			),
-		}, nil
+	readDB := db
+	if readAddresses := cfg.getReadAddresses(); readAddresses != nil {
+		if readDB, err = connector(logger, cfg, "read", readAddresses); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("could not connect to read database: %q", err)
+		}
+	}
+	var volumes prometheus.Collector
+	if cfg.StoragePolicy != "" || cfg.getMoveTo() != "" {
+		volumes = newVolumeCollector(logger, db, cfg)
+		if err := prometheus.Register(volumes); err != nil {
+			logger.Warn("Could not register the table volume metrics", "error", err)
+			volumes = nil
+		}
 	}
 	return &Store{
-		db: db,
-		writer: clickhousespanstore.NewSpanWriter(
-			logger,
-			db,
-			cfg.SpansIndexTable,
-			cfg.SpansTable,
-			cfg.Tenant,
-			clickhousespanstore.Encoding(cfg.Encoding),
-			cfg.BatchFlushInterval,
-			cfg.BatchWriteSize,
-			cfg.MaxSpanCount,
-		),
+		logger:  logger,
+		cfg:     cfg,
+		db:      db,
+		readDB:  readDB,
+		volumes: volumes,
+		writer: clickhousespanstore.NewSpanWriter(clickhousespanstore.SpanWriterParams{
+			Logger:         logger,
+			DB:             db,
+			IndexTable:     cfg.SpansIndexTable,
+			SpansTable:     cfg.SpansTable,
+			Tenant:         cfg.Tenant,
+			Encoding:       clickhousespanstore.Encoding(cfg.Encoding),
+			Deduplication:  cfg.Deduplication,
+			ServiceColumn:  cfg.hasServiceColumn(),
+			InsertSettings: cfg.getInsertSettings(),
+			Sampler:        clickhousespanstore.NewSampler(cfg.Sampling),
+			WriterSettings: cfg.getWriterSettings(redactor, tagIndex),
+		}),
 		reader: clickhousespanstore.NewTraceReader(
-			db,
+			readDB,
 			cfg.OperationsTable,
 			cfg.SpansIndexTable,
 			cfg.SpansTable,
 			cfg.Tenant,
 			cfg.MaxNumSpans,
+			tagIndex,
 		),
-		archiveWriter: clickhousespanstore.NewSpanWriter(
-			logger,
-			db,
-			"",
-			cfg.GetSpansArchiveTable(),
-			cfg.Tenant,
-			clickhousespanstore.Encoding(cfg.Encoding),
-			cfg.BatchFlushInterval,
-			cfg.BatchWriteSize,
-			cfg.MaxSpanCount,
-		),
+		archiveWriter: newArchiveWriter(logger, db, cfg, redactor, tagIndex),
 		archiveReader: clickhousespanstore.NewTraceReader(
-			db,
-			"",
-			"",
+			readDB,
+			cfg.GetOperationsArchiveTable(),
+			cfg.GetSpansArchiveIndexTable(),
 			cfg.GetSpansArchiveTable(),
 			cfg.Tenant,
 			cfg.MaxNumSpans,
+			tagIndex,
 		),
 	}, nil
 }
 
-func connector(cfg Configuration) (*sql.DB, error) {
+// newArchiveWriter returns the writer of archived traces. Spans are redacted like spans of the spans table,
+// as they may be imported into the archive directly.
+func newArchiveWriter(
+	logger hclog.Logger,
+	db *sql.DB,
+	cfg Configuration,
+	redactor *clickhousespanstore.Redactor,
+	tagIndex *clickhousespanstore.TagIndex,
+) spanstore.Writer {
+	archiveWriter := clickhousespanstore.NewSpanWriter(clickhousespanstore.SpanWriterParams{
+		Logger:         logger,
+		DB:             db,
+		IndexTable:     cfg.GetSpansArchiveIndexTable(),
+		SpansTable:     cfg.GetSpansArchiveTable(),
+		Tenant:         cfg.Tenant,
+		Encoding:       clickhousespanstore.Encoding(cfg.Encoding),
+		Deduplication:  cfg.Deduplication,
+		InsertSettings: cfg.getInsertSettings(),
+		WriterSettings: cfg.getArchiveWriterSettings(redactor, tagIndex),
+	})
+	if !cfg.CopyOnArchive {
+		return archiveWriter
+	}
+	return clickhousespanstore.NewArchiveWriter(
+		logger,
+		db,
+		cfg.SpansTable,
+		cfg.GetSpansArchiveTable(),
+		cfg.GetSpansArchiveIndexTable(),
+		cfg.Tenant,
+		cfg.Deduplication,
+		cfg.getInsertSettings(),
+		tagIndex,
+		archiveWriter,
+	)
+}
+
+func connector(logger hclog.Logger, cfg Configuration, role string, addresses []string) (*sql.DB, error) {
 	var conn *sql.DB
 
 	options := clickhouse.Options{
-		Addr: []string{sanitize(cfg.Address)},
 		Auth: clickhouse.Auth{
 			Database: cfg.Database,
 			Username: cfg.Username,
@@ -150,22 +190,35 @@ func connector(cfg Configuration) (*sql.DB, error) {
 			Method: clickhouse.CompressionLZ4,
 		},
 	}
-
-	if cfg.CaFile != "" {
-		caCert, err := os.ReadFile(cfg.CaFile)
-		if err != nil {
-			return nil, err
+	if cfg.Protocol == HTTPProtocol {
+		options.Protocol = clickhouse.HTTP
+		options.HttpHeaders = cfg.HTTPHeaders
+		if cfg.HTTPProxy != "" {
+			proxy, err := url.Parse(cfg.HTTPProxy)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse http_proxy: %w", err)
+			}
+			options.HTTPProxyURL = proxy
 		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		options.TLS = &tls.Config{
-			RootCAs: caCertPool,
+	}
+
+	clientTLS, err := newClientTLS(logger, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var password *passwordFile
+	if cfg.PasswordFile != "" {
+		if password, err = newPasswordFile(cfg.PasswordFile); err != nil {
+			return nil, fmt.Errorf("could not read password_file: %w", err)
 		}
 	}
-	conn = clickhouse.OpenDB(&options)
+
+	connectors := addressConnectors(addresses, options, clientTLS, password)
+	conn = sql.OpenDB(newBalancedConnector(logger, role, addresses, connectors, cfg.ConnectionStrategy, cfg.FailedAddressBackoff))
 
 	if cfg.MaxOpenConns != nil {
-		conn.SetMaxIdleConns(int(*cfg.MaxOpenConns))
+		conn.SetMaxOpenConns(int(*cfg.MaxOpenConns))
 	}
 	if cfg.MaxIdleConns != nil {
 		conn.SetMaxIdleConns(int(*cfg.MaxIdleConns))
@@ -178,11 +231,33 @@ func connector(cfg Configuration) (*sql.DB, error) {
 	}
 
 	if err := conn.Ping(); err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 	return conn, nil
 }
 
+// addressConnectors returns a connector for each address. If password is set, connectors use its current password.
+func addressConnectors(
+	addresses []string,
+	options clickhouse.Options,
+	clientTLS *clientTLS,
+	password *passwordFile,
+) []driver.Connector {
+	connectors := make([]driver.Connector, len(addresses))
+	for i, address := range addresses {
+		addressOptions := options
+		addressOptions.Addr = []string{address}
+		addressOptions.TLS = clientTLS.config(address)
+		if password != nil {
+			connectors[i] = newPasswordConnector(addressOptions, password)
+		} else {
+			connectors[i] = clickhouse.Connector(&addressOptions)
+		}
+	}
+	return connectors
+}
+
 type tableArgs struct {
 	Database string
 
@@ -193,15 +268,36 @@ type tableArgs struct {
 
 	TTLTimestamp string
 	TTLDate      string
+	// StoragePolicy is the quoted storage policy of the spans and index tables, if set
+	StoragePolicy string
+	// Cluster is the quoted cluster name
+	Cluster string
+	// ReplicaArgs are the arguments of replicated engines, empty to use the server defaults
+	ReplicaArgs string
+
+	Multitenant   bool
+	OnCluster     bool
+	Replication   bool
+	Deduplication bool
+	ServiceColumn bool
+}
 
-	Multitenant bool
-	Replication bool
+type alterTableArgs struct {
+	Table         clickhousespanstore.TableName
+	Cluster       string
+	TTL           string
+	OnCluster     bool
+	Distributed   bool
+	ServiceColumn bool
 }
 
 type distributedTableArgs struct {
 	Database string
 	Table    clickhousespanstore.TableName
 	Hash     string
+	Cluster  string
+	// Settings of the Distributed engine, empty for none
+	Settings string
 }
 
 func render(templates *template.Template, filename string, args interface{}) string {
@@ -214,15 +310,7 @@ func render(templates *template.Template, filename string, args interface{}) str
 }
 
 func runInitScripts(logger hclog.Logger, db *sql.DB, cfg Configuration) error {
-	var (
-		sqlStatements []string
-		ttlTimestamp  string
-		ttlDate       string
-	)
-	if cfg.TTLDays > 0 {
-		ttlTimestamp = fmt.Sprintf("TTL timestamp + INTERVAL %d DAY DELETE", cfg.TTLDays)
-		ttlDate = fmt.Sprintf("TTL date + INTERVAL %d DAY DELETE", cfg.TTLDays)
-	}
+	var sqlStatements []string
 	if cfg.InitSQLScriptsDir != "" {
 		filePaths, err := walkMatch(cfg.InitSQLScriptsDir, "*.sql")
 		if err != nil {
@@ -238,57 +326,237 @@ func runInitScripts(logger hclog.Logger, db *sql.DB, cfg Configuration) error {
 		}
 	}
 	if *cfg.InitTables {
-		templates := template.Must(template.ParseFS(jaegerclickhouse.SQLScripts, "sqlscripts/*.tmpl.sql"))
+		sqlStatements = append(sqlStatements, renderSchema(cfg)...)
+	}
+	if err := executeScripts(logger, sqlStatements, db); err != nil {
+		return err
+	}
+	if !*cfg.InitTables || !cfg.UpdateTTL {
+		return nil
+	}
+	// The inner tables of the operations materialized views are named after their UUID, which is only known
+	// once the views exist
+	innerTables, err := resolveInnerTables(db, operationsViews(cfg))
+	if err != nil {
+		return err
+	}
+	return executeScripts(logger, renderOperationsTTL(cfg, func(view clickhousespanstore.TableName) clickhousespanstore.TableName {
+		return innerTables[view]
+	}), db)
+}
 
-		args := tableArgs{
-			Database: cfg.Database,
+// resolveInnerTables returns the names of the inner tables of materialized views by view. Views of Atomic databases
+// store their data in ".inner_id.<uuid>" tables, and views of Ordinary databases in ".inner.<view>" tables.
+func resolveInnerTables(db *sql.DB, views []clickhousespanstore.TableName) (map[clickhousespanstore.TableName]clickhousespanstore.TableName, error) {
+	innerTables := make(map[clickhousespanstore.TableName]clickhousespanstore.TableName, len(views))
+	for _, view := range views {
+		var uuid string
+		err := db.QueryRow(
+			"SELECT toString(uuid) FROM system.tables WHERE database = currentDatabase() AND name = ?", string(view),
+		).Scan(&uuid)
+		if err != nil {
+			return nil, fmt.Errorf("could not get the uuid of materialized view %s: %w", view, err)
+		}
+		if uuid == "00000000-0000-0000-0000-000000000000" {
+			innerTables[view] = ordinaryInnerTable(view)
+		} else {
+			innerTables[view] = clickhousespanstore.TableName("`.inner_id." + uuid + "`")
+		}
+	}
+	return innerTables, nil
+}
+
+// ordinaryInnerTable returns the name of the inner table of a materialized view in an Ordinary database
+func ordinaryInnerTable(view clickhousespanstore.TableName) clickhousespanstore.TableName {
+	return clickhousespanstore.TableName("`.inner." + string(view) + "`")
+}
+
+// RenderSchema returns the statements that would be run to create the default tables for the given configuration,
+// without connecting to ClickHouse. The statements are rendered regardless of the value of init_tables,
+// so they can be reviewed and applied manually. Scripts from init_sql_scripts_dir are not included.
+//
+// With update_ttl, the TTL of the operations materialized views is updated on their inner tables, which are named
+// ".inner.<view>" in Ordinary databases. In Atomic databases, the default, they are named ".inner_id.<uuid>" after
+// the UUID of the view, so the rendered names must be replaced by the names from system.tables.
+func RenderSchema(cfg Configuration) []string {
+	cfg.setDefaults()
+	statements := renderSchema(cfg)
+	if cfg.UpdateTTL {
+		statements = append(statements, renderOperationsTTL(cfg, ordinaryInnerTable)...)
+	}
+	return statements
+}
 
-			SpansIndexTable:   cfg.SpansIndexTable,
-			SpansTable:        cfg.SpansTable,
-			OperationsTable:   cfg.OperationsTable,
-			SpansArchiveTable: cfg.GetSpansArchiveTable(),
+func renderSchema(cfg Configuration) []string {
+	var sqlStatements []string
+	multitenant := cfg.Tenant != ""
+	templates := template.Must(template.ParseFS(jaegerclickhouse.SQLScripts, "sqlscripts/*.tmpl.sql"))
 
-			TTLTimestamp: ttlTimestamp,
-			TTLDate:      ttlDate,
+	args := tableArgs{
+		Database: cfg.Database,
+
+		SpansIndexTable:   cfg.SpansIndexTable,
+		SpansTable:        cfg.SpansTable,
+		OperationsTable:   cfg.OperationsTable,
+		SpansArchiveTable: cfg.GetSpansArchiveTable(),
+
+		TTLTimestamp: renderTTL("timestamp", cfg.MoveAfterDays, cfg.getMoveTo(), cfg.TTLDays, cfg.ServiceTTLDays, cfg.TenantTTLDays, multitenant),
+		TTLDate:      cfg.operationsTTL(),
+
+		StoragePolicy: cfg.getStoragePolicy(),
+		Cluster:       quote(cfg.Cluster),
+		ReplicaArgs:   cfg.getReplicaArgs(),
+
+		Multitenant:   multitenant,
+		OnCluster:     cfg.onCluster(),
+		Replication:   cfg.Replication,
+		Deduplication: cfg.Deduplication,
+		ServiceColumn: cfg.hasServiceColumn(),
+	}
+
+	if *cfg.Sharding {
+		// Add "_local" to the local table names, and omit it from the distributed tables below
+		args.SpansIndexTable = args.SpansIndexTable.ToLocal()
+		args.SpansTable = args.SpansTable.ToLocal()
+		args.OperationsTable = args.OperationsTable.ToLocal()
+		args.SpansArchiveTable = args.SpansArchiveTable.ToLocal()
+	}
 
-			Multitenant: cfg.Tenant != "",
-			Replication: cfg.Replication,
+	sqlStatements = append(sqlStatements, render(templates, "jaeger-index.tmpl.sql", args))
+	sqlStatements = append(sqlStatements, render(templates, "jaeger-operations.tmpl.sql", args))
+	sqlStatements = append(sqlStatements, render(templates, "jaeger-spans.tmpl.sql", args))
+	// Archived traces are kept for the archive TTL regardless of their service and tenant
+	archiveArgs := args
+	archiveArgs.TTLTimestamp = renderTTL("timestamp", cfg.MoveAfterDays, cfg.getMoveTo(), *cfg.ArchiveTTLDays, nil, nil, false)
+	archiveArgs.TTLDate = cfg.archiveOperationsTTL()
+	archiveArgs.ServiceColumn = false
+	sqlStatements = append(sqlStatements, render(templates, "jaeger-spans-archive.tmpl.sql", archiveArgs))
+
+	if cfg.ArchiveIndex {
+		// The archive index and operations tables share the schema of the regular ones
+		archiveArgs.SpansIndexTable = cfg.GetSpansArchiveIndexTable()
+		archiveArgs.OperationsTable = cfg.GetOperationsArchiveTable()
+		if *cfg.Sharding {
+			archiveArgs.SpansIndexTable = archiveArgs.SpansIndexTable.ToLocal()
+			archiveArgs.OperationsTable = archiveArgs.OperationsTable.ToLocal()
 		}
+		sqlStatements = append(sqlStatements, render(templates, "jaeger-index.tmpl.sql", archiveArgs))
+		sqlStatements = append(sqlStatements, render(templates, "jaeger-operations.tmpl.sql", archiveArgs))
+	}
 
-		if cfg.Replication {
-			// Add "_local" to the local table names, and omit it from the distributed tables below
-			args.SpansIndexTable = args.SpansIndexTable.ToLocal()
-			args.SpansTable = args.SpansTable.ToLocal()
-			args.OperationsTable = args.OperationsTable.ToLocal()
-			args.SpansArchiveTable = args.SpansArchiveTable.ToLocal()
+	if *cfg.Sharding {
+		// Now these tables omit the "_local" suffix
+		distargs := distributedTableArgs{
+			Table:    cfg.SpansTable,
+			Database: cfg.Database,
+			Hash:     cfg.SpansShardingKey,
+			Cluster:  args.Cluster,
+			Settings: cfg.getDistributedSettings(),
 		}
+		sqlStatements = append(sqlStatements, render(templates, "distributed-table.tmpl.sql", distargs))
 
-		sqlStatements = append(sqlStatements, render(templates, "jaeger-index.tmpl.sql", args))
-		sqlStatements = append(sqlStatements, render(templates, "jaeger-operations.tmpl.sql", args))
-		sqlStatements = append(sqlStatements, render(templates, "jaeger-spans.tmpl.sql", args))
-		sqlStatements = append(sqlStatements, render(templates, "jaeger-spans-archive.tmpl.sql", args))
-
-		if cfg.Replication {
-			// Now these tables omit the "_local" suffix
-			distargs := distributedTableArgs{
-				Table:    cfg.SpansTable,
-				Database: cfg.Database,
-				Hash:     "cityHash64(traceID)",
-			}
-			sqlStatements = append(sqlStatements, render(templates, "distributed-table.tmpl.sql", distargs))
+		distargs.Table = cfg.SpansIndexTable
+		distargs.Hash = cfg.IndexShardingKey
+		sqlStatements = append(sqlStatements, render(templates, "distributed-table.tmpl.sql", distargs))
 
-			distargs.Table = cfg.SpansIndexTable
-			sqlStatements = append(sqlStatements, render(templates, "distributed-table.tmpl.sql", distargs))
+		distargs.Table = cfg.GetSpansArchiveTable()
+		distargs.Hash = cfg.SpansShardingKey
+		sqlStatements = append(sqlStatements, render(templates, "distributed-table.tmpl.sql", distargs))
 
-			distargs.Table = cfg.GetSpansArchiveTable()
+		if cfg.ArchiveIndex {
+			distargs.Table = cfg.GetSpansArchiveIndexTable()
+			distargs.Hash = cfg.IndexShardingKey
 			sqlStatements = append(sqlStatements, render(templates, "distributed-table.tmpl.sql", distargs))
+		}
 
-			distargs.Table = cfg.OperationsTable
-			distargs.Hash = "rand()"
+		distargs.Table = cfg.OperationsTable
+		distargs.Hash = cfg.OperationsShardingKey
+		sqlStatements = append(sqlStatements, render(templates, "distributed-table.tmpl.sql", distargs))
+
+		if cfg.ArchiveIndex {
+			distargs.Table = cfg.GetOperationsArchiveTable()
 			sqlStatements = append(sqlStatements, render(templates, "distributed-table.tmpl.sql", distargs))
 		}
 	}
-	return executeScripts(logger, sqlStatements, db)
+
+	return append(sqlStatements, renderAlterTables(templates, cfg, args, archiveArgs)...)
+}
+
+// renderAlterTables returns the statements adding the service column needed by service_ttl to existing spans tables,
+// which spans are written with as soon as service_ttl is set, and with update_ttl the statements updating the TTL
+// of existing tables, or removing it if it is 0. Each statement alters one thing, so a REMOVE TTL of a table
+// without TTL, which ClickHouse rejects, can be ignored.
+func renderAlterTables(templates *template.Template, cfg Configuration, args, archiveArgs tableArgs) []string {
+	var alters []alterTableArgs
+	if args.ServiceColumn {
+		alters = append(alters, alterTableArgs{Table: args.SpansTable, ServiceColumn: true})
+		if *cfg.Sharding {
+			alters = append(alters, alterTableArgs{Table: cfg.SpansTable, Distributed: true, ServiceColumn: true})
+		}
+	}
+	if cfg.UpdateTTL {
+		alters = append(alters,
+			alterTableArgs{Table: args.SpansTable, TTL: args.TTLTimestamp},
+			alterTableArgs{Table: args.SpansIndexTable, TTL: args.TTLTimestamp},
+			alterTableArgs{Table: archiveArgs.SpansArchiveTable, TTL: archiveArgs.TTLTimestamp},
+		)
+		if cfg.ArchiveIndex {
+			alters = append(alters, alterTableArgs{Table: archiveArgs.SpansIndexTable, TTL: archiveArgs.TTLTimestamp})
+		}
+	}
+
+	var sqlStatements []string
+	for _, alter := range alters {
+		alter.OnCluster = args.OnCluster
+		alter.Cluster = args.Cluster
+		sqlStatements = append(sqlStatements, render(templates, "alter-table.tmpl.sql", alter))
+	}
+	return sqlStatements
+}
+
+// operationsTTL returns the TTL of the operations tables. Operations are small, so they are not moved.
+func (cfg Configuration) operationsTTL() string {
+	return renderTTL("date", 0, "", cfg.TTLDays, cfg.ServiceTTLDays, cfg.TenantTTLDays, cfg.Tenant != "")
+}
+
+// archiveOperationsTTL returns the TTL of the archive operations tables
+func (cfg Configuration) archiveOperationsTTL() string {
+	return renderTTL("date", 0, "", *cfg.ArchiveTTLDays, nil, nil, false)
+}
+
+// operationsViews returns the operations materialized views which the schema creates
+func operationsViews(cfg Configuration) []clickhousespanstore.TableName {
+	views := []clickhousespanstore.TableName{cfg.OperationsTable}
+	if cfg.ArchiveIndex {
+		views = append(views, cfg.GetOperationsArchiveTable())
+	}
+	if *cfg.Sharding {
+		for i := range views {
+			views[i] = views[i].ToLocal()
+		}
+	}
+	return views
+}
+
+// renderOperationsTTL returns the statements updating the TTL of the operations materialized views with update_ttl,
+// or removing it if it is 0. ClickHouse does not alter the TTL of a materialized view, so the statements alter
+// its inner table, which innerTable returns.
+func renderOperationsTTL(cfg Configuration, innerTable func(view clickhousespanstore.TableName) clickhousespanstore.TableName) []string {
+	templates := template.Must(template.ParseFS(jaegerclickhouse.SQLScripts, "sqlscripts/*.tmpl.sql"))
+	views := operationsViews(cfg)
+	alters := []alterTableArgs{{Table: innerTable(views[0]), TTL: cfg.operationsTTL()}}
+	if cfg.ArchiveIndex {
+		// Archived operations are kept for the archive TTL
+		alters = append(alters, alterTableArgs{Table: innerTable(views[1]), TTL: cfg.archiveOperationsTTL()})
+	}
+
+	var sqlStatements []string
+	for _, alter := range alters {
+		alter.OnCluster = cfg.onCluster()
+		alter.Cluster = quote(cfg.Cluster)
+		sqlStatements = append(sqlStatements, render(templates, "alter-table.tmpl.sql", alter))
+	}
+	return sqlStatements
 }
 
 func (s *Store) SpanReader() spanstore.Reader {
@@ -315,7 +583,46 @@ func (s *Store) StreamingSpanWriter() spanstore.Writer {
 	return s.writer
 }
 
+// ImportSpanWriter returns a writer of imported spans, which writes them synchronously to the spans table,
+// or to the archive table if archive is set. Spans are redacted and truncated, but not sampled nor discarded.
+func (s *Store) ImportSpanWriter(archive bool) (*clickhousespanstore.ImportWriter, error) {
+	cfg := s.config()
+	redactor, err := clickhousespanstore.NewRedactor(cfg.Redaction)
+	if err != nil {
+		return nil, err
+	}
+	tagIndex := clickhousespanstore.NewTagIndex(s.logger, cfg.TagIndex)
+	params := clickhousespanstore.SpanWriterParams{
+		Logger:         s.logger,
+		DB:             s.db,
+		IndexTable:     cfg.SpansIndexTable,
+		SpansTable:     cfg.SpansTable,
+		Tenant:         cfg.Tenant,
+		Encoding:       clickhousespanstore.Encoding(cfg.Encoding),
+		Deduplication:  cfg.Deduplication,
+		ServiceColumn:  cfg.hasServiceColumn(),
+		InsertSettings: cfg.getInsertSettings(),
+		WriterSettings: cfg.getWriterSettings(redactor, tagIndex),
+	}
+	if archive {
+		params.IndexTable = cfg.GetSpansArchiveIndexTable()
+		params.SpansTable = cfg.GetSpansArchiveTable()
+		params.ServiceColumn = false
+		params.WriterSettings = cfg.getArchiveWriterSettings(redactor, tagIndex)
+	}
+	return clickhousespanstore.NewImportWriter(params), nil
+}
+
 func (s *Store) Close() error {
+	if s.volumes != nil {
+		prometheus.Unregister(s.volumes)
+	}
+	if s.readDB != nil && s.readDB != s.db {
+		if err := s.readDB.Close(); err != nil {
+			_ = s.db.Close()
+			return err
+		}
+	}
 	return s.db.Close()
 }
 
@@ -334,6 +641,10 @@ func executeScripts(logger hclog.Logger, sqlStatements []string, db *sql.DB) err
 	for _, statement := range sqlStatements {
 		logger.Debug("Running SQL statement", "statement", statement)
 		_, err = tx.Exec(statement)
+		if err != nil && isRemoveMissingTTL(statement, err) {
+			logger.Debug("Table has no TTL to remove", "statement", statement)
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("could not run sql %q: %q", statement, err)
 		}
@@ -342,6 +653,11 @@ func executeScripts(logger hclog.Logger, sqlStatements []string, db *sql.DB) err
 	return tx.Commit()
 }
 
+// isRemoveMissingTTL returns whether err reports that statement removed the TTL of a table which has none
+func isRemoveMissingTTL(statement string, err error) bool {
+	return strings.Contains(statement, "REMOVE TTL") && strings.Contains(err.Error(), "doesn't have any table TTL")
+}
+
 func walkMatch(root, pattern string) ([]string, error) {
 	var matches []string
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
@@ -1,12 +1,21 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -40,6 +49,41 @@ func TestStore_ArchiveSpanWriter(t *testing.T) {
 	assert.Equal(t, &writer, store.ArchiveSpanWriter())
 }
 
+func TestStore_ArchiveSpanWriterRedacts(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	cfg := Configuration{Address: "clickhouse:9000", Redaction: clickhousespanstore.RedactionRules{DenyKeys: []string{"password"}}}
+	cfg.setDefaults()
+	redactor, err := clickhousespanstore.NewRedactor(cfg.Redaction)
+	require.NoError(t, err)
+
+	span := &model.Span{
+		TraceID:   model.NewTraceID(1, 2),
+		StartTime: time.Unix(0, 0).UTC(),
+		Tags:      []model.KeyValue{model.String("password", "secret"), model.String("http.method", "GET")},
+		Process:   model.NewProcess("service", nil),
+	}
+	redacted := *span
+	redacted.Tags = span.Tags[1:]
+	redactedJSON, err := json.Marshal(&redacted)
+	require.NoError(t, err)
+
+	// Spans imported into the archive are written directly, without passing through the spans table
+	mock.ExpectBegin()
+	mock.ExpectPrepare(fmt.Sprintf("INSERT INTO %s (timestamp, traceID, model) VALUES (?, ?, ?)", cfg.GetSpansArchiveTable())).
+		ExpectExec().
+		WithArgs(span.StartTime, span.TraceID.String(), redactedJSON).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	writer := newArchiveWriter(mocks.NewSpyLogger(), db, cfg, redactor, nil)
+	require.NoError(t, writer.WriteSpan(context.Background(), span))
+	require.NoError(t, writer.(io.Closer).Close())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestStore_SpanReader(t *testing.T) {
 	reader := clickhousespanstore.TraceReader{}
 	store := Store{
@@ -75,20 +119,35 @@ func TestStore_Close(t *testing.T) {
 	logger.AssertLogsEmpty(t)
 }
 
+func TestStore_CloseReadDB(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer db.Close()
+	readDB, readMock, err := mocks.GetDbMock()
+	require.NoError(t, err)
+	defer readDB.Close()
+
+	logger := mocks.NewSpyLogger()
+	store := newStore(db, logger)
+	store.readDB = readDB
+
+	readMock.ExpectClose()
+	mock.ExpectClose()
+	require.NoError(t, store.Close())
+	assert.NoError(t, readMock.ExpectationsWereMet())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func newStore(db *sql.DB, logger mocks.SpyLogger) Store {
 	return Store{
 		db: db,
-		writer: clickhousespanstore.NewSpanWriter(
-			logger,
-			db,
-			testIndexTable,
-			testSpansTable,
-			"",
-			clickhousespanstore.EncodingJSON,
-			0,
-			0,
-			0,
-		),
+		writer: clickhousespanstore.NewSpanWriter(clickhousespanstore.SpanWriterParams{
+			Logger:     logger,
+			DB:         db,
+			IndexTable: testIndexTable,
+			SpansTable: testSpansTable,
+			Encoding:   clickhousespanstore.EncodingJSON,
+		}),
 		reader: clickhousespanstore.NewTraceReader(
 			db,
 			testOperationsTable,
@@ -96,18 +155,15 @@ func newStore(db *sql.DB, logger mocks.SpyLogger) Store {
 			testSpansTable,
 			"",
 			0,
+			nil,
 		),
-		archiveWriter: clickhousespanstore.NewSpanWriter(
-			logger,
-			db,
-			testIndexTable,
-			testSpansArchiveTable,
-			"",
-			clickhousespanstore.EncodingJSON,
-			0,
-			0,
-			0,
-		),
+		archiveWriter: clickhousespanstore.NewSpanWriter(clickhousespanstore.SpanWriterParams{
+			Logger:     logger,
+			DB:         db,
+			IndexTable: testIndexTable,
+			SpansTable: testSpansArchiveTable,
+			Encoding:   clickhousespanstore.EncodingJSON,
+		}),
 		archiveReader: clickhousespanstore.NewTraceReader(
 			db,
 			testOperationsTable,
@@ -115,6 +171,7 @@ func newStore(db *sql.DB, logger mocks.SpyLogger) Store {
 			testSpansArchiveTable,
 			"",
 			0,
+			nil,
 		),
 	}
 }
@@ -170,6 +227,28 @@ func TestStore_executeScriptsExecuteError(t *testing.T) {
 	)
 }
 
+func TestStore_executeScriptsRemoveMissingTTL(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	removeTTL := "ALTER TABLE jaeger_spans_local\n\n    REMOVE TTL\n"
+	modifyTTL := "ALTER TABLE jaeger_index_local\n\n    MODIFY TTL timestamp + INTERVAL 1 DAY DELETE\n"
+	missingTTL := fmt.Errorf("code: 36, message: Table doesn't have any table TTL expression, cannot remove")
+	mock.ExpectBegin()
+	mock.ExpectExec(removeTTL).WillReturnError(missingTTL)
+	mock.ExpectExec(modifyTTL).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	require.NoError(t, executeScripts(mocks.NewSpyLogger(), []string{removeTTL, modifyTTL}, db))
+
+	// Other statements failing with the same error are not ignored
+	mock.ExpectBegin()
+	mock.ExpectExec(modifyTTL).WillReturnError(missingTTL)
+	mock.ExpectRollback()
+	assert.Error(t, executeScripts(mocks.NewSpyLogger(), []string{modifyTTL}, db))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestStore_executeScriptBeginError(t *testing.T) {
 	db, mock, err := mocks.GetDbMock()
 	require.NoError(t, err)
@@ -185,3 +264,246 @@ func TestStore_executeScriptBeginError(t *testing.T) {
 	err = executeScripts(spyLogger, scripts, db)
 	assert.EqualError(t, err, errorMock.Error())
 }
+
+func TestStore_resolveInnerTables(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	query := "SELECT toString(uuid) FROM system.tables WHERE database = currentDatabase() AND name = ?"
+	mock.ExpectQuery(query).WithArgs("operations").
+		WillReturnRows(sqlmock.NewRows([]string{"uuid"}).AddRow("1b3e5a3c-2f7e-4c1b-9a4d-6e2f8b9c0d1e"))
+	mock.ExpectQuery(query).WithArgs("operations_archive").
+		WillReturnRows(sqlmock.NewRows([]string{"uuid"}).AddRow("00000000-0000-0000-0000-000000000000"))
+
+	innerTables, err := resolveInnerTables(db, []clickhousespanstore.TableName{"operations", "operations_archive"})
+	require.NoError(t, err)
+	assert.Equal(t, map[clickhousespanstore.TableName]clickhousespanstore.TableName{
+		"operations":         "`.inner_id.1b3e5a3c-2f7e-4c1b-9a4d-6e2f8b9c0d1e`",
+		"operations_archive": "`.inner.operations_archive`",
+	}, innerTables)
+
+	mock.ExpectQuery(query).WithArgs("missing").WillReturnRows(sqlmock.NewRows([]string{"uuid"}))
+	_, err = resolveInnerTables(db, []clickhousespanstore.TableName{"missing"})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStore_RenderSchema(t *testing.T) {
+	archiveTTLDays := uint(365)
+	trueValue, falseValue := true, false
+	tests := map[string]struct {
+		config             Configuration
+		expectedStatements int
+		expectedContains   []string
+		expectedMissing    []string
+	}{
+		"local": {
+			config:             Configuration{},
+			expectedStatements: 4,
+			expectedContains:   []string{"CREATE TABLE IF NOT EXISTS jaeger_spans_local", "MergeTree()"},
+			expectedMissing:    []string{"ON CLUSTER", "Distributed", "TTL", "tenant"},
+		},
+		"replication": {
+			config:             Configuration{Replication: true, Database: "jaeger"},
+			expectedStatements: 8,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_spans_local",
+				"ReplicatedMergeTree",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_spans_local, cityHash64(traceID))",
+				"ENGINE = Distributed('{cluster}', jaeger, jaeger_operations_local, rand())",
+			},
+		},
+		"archive index": {
+			config:             Configuration{ArchiveIndex: true},
+			expectedStatements: 6,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_index_archive_local",
+				"CREATE MATERIALIZED VIEW IF NOT EXISTS jaeger_operations_archive_local",
+				"FROM default.jaeger_index_archive_local",
+			},
+		},
+		"sharding": {
+			config:             Configuration{Sharding: &trueValue},
+			expectedStatements: 8,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_spans_local\nON CLUSTER '{cluster}'",
+				") ENGINE MergeTree()",
+				"ENGINE SummingMergeTree",
+				"ENGINE = Distributed('{cluster}', default, jaeger_spans_local, cityHash64(traceID))",
+			},
+			expectedMissing: []string{"Replicated"},
+		},
+		"replication without sharding": {
+			config:             Configuration{Replication: true, Sharding: &falseValue},
+			expectedStatements: 4,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_spans_local\nON CLUSTER '{cluster}'",
+				"ReplicatedMergeTree",
+			},
+			expectedMissing: []string{"Distributed"},
+		},
+		"archive index replication": {
+			config:             Configuration{ArchiveIndex: true, Replication: true},
+			expectedStatements: 12,
+			expectedContains: []string{
+				"ENGINE = Distributed('{cluster}', default, jaeger_index_archive_local, cityHash64(traceID))",
+				"ENGINE = Distributed('{cluster}', default, jaeger_operations_archive_local, rand())",
+			},
+		},
+		"deduplication": {
+			config:             Configuration{Deduplication: true},
+			expectedStatements: 4,
+			expectedContains: []string{
+				"spanID    String CODEC (ZSTD(1))",
+				"ENGINE ReplacingMergeTree()",
+				"ORDER BY (traceID, spanID, startTime)",
+			},
+		},
+		"ttl and tenant": {
+			config:             Configuration{TTLDays: 3, Tenant: "tenant_1", InitSQLScriptsDir: "does_not_exist"},
+			expectedStatements: 4,
+			expectedContains:   []string{"TTL timestamp + INTERVAL 3 DAY DELETE", "TTL date + INTERVAL 3 DAY DELETE", "tenant"},
+		},
+		"service and tenant ttl": {
+			expectedStatements: 5,
+			config: Configuration{
+				TTLDays:        7,
+				ServiceTTLDays: map[string]uint{"debug": 1, "payments": 30},
+				TenantTTLDays:  map[string]uint{"tenant_2": 14},
+				ArchiveTTLDays: &archiveTTLDays,
+				Tenant:         "tenant_1",
+			},
+			expectedContains: []string{
+				"service   LowCardinality(String) CODEC (ZSTD(1)),",
+				"TTL timestamp + INTERVAL 1 DAY DELETE WHERE service = 'debug', " +
+					"timestamp + INTERVAL 30 DAY DELETE WHERE service = 'payments', " +
+					"timestamp + INTERVAL 14 DAY DELETE WHERE tenant = 'tenant_2' AND service NOT IN ('debug', 'payments'), " +
+					"timestamp + INTERVAL 7 DAY DELETE WHERE service NOT IN ('debug', 'payments') AND tenant NOT IN ('tenant_2')",
+				"TTL date + INTERVAL 1 DAY DELETE WHERE service = 'debug'",
+				"TTL timestamp + INTERVAL 365 DAY DELETE\n",
+				// Spans are written with the service column, so it is added to existing tables without update_ttl
+				"ALTER TABLE jaeger_spans_local\n\n    ADD COLUMN IF NOT EXISTS service LowCardinality(String) CODEC (ZSTD(1)) AFTER traceID",
+			},
+			expectedMissing: []string{"MODIFY TTL", "REMOVE TTL"},
+		},
+		"tiered storage": {
+			config:             Configuration{TTLDays: 30, StoragePolicy: "tiered", MoveAfterDays: 3, MoveToVolume: "cold"},
+			expectedStatements: 4,
+			expectedContains: []string{
+				"SETTINGS index_granularity = 1024, storage_policy = 'tiered'",
+				"TTL timestamp + INTERVAL 3 DAY TO VOLUME 'cold', timestamp + INTERVAL 30 DAY DELETE\n",
+				"TTL date + INTERVAL 30 DAY DELETE\n",
+			},
+			expectedMissing: []string{"SETTINGS index_granularity = 32, storage_policy"},
+		},
+		"cluster": {
+			config: Configuration{
+				Replication:           true,
+				ArchiveIndex:          true,
+				Cluster:               "tracing",
+				ReplicaZooKeeperPath:  "/clickhouse/tracing/tables/{shard}/{database}/{table}",
+				SpansShardingKey:      "sipHash64(traceID)",
+				IndexShardingKey:      "xxHash64(traceID)",
+				OperationsShardingKey: "cityHash64(service)",
+				DistributedSettings:   map[string]string{"fsync_directories": "1", "fsync_after_insert": "1"},
+			},
+			expectedStatements: 12,
+			expectedContains: []string{
+				"CREATE TABLE IF NOT EXISTS jaeger_spans_local\nON CLUSTER 'tracing'",
+				"ReplicatedMergeTree('/clickhouse/tracing/tables/{shard}/{database}/{table}', '{replica}')",
+				"ReplicatedSummingMergeTree('/clickhouse/tracing/tables/{shard}/{database}/{table}', '{replica}')",
+				"ENGINE = Distributed('tracing', default, jaeger_spans_local, sipHash64(traceID))\n" +
+					"    SETTINGS fsync_after_insert = 1, fsync_directories = 1",
+				"ENGINE = Distributed('tracing', default, jaeger_spans_archive_local, sipHash64(traceID))",
+				"ENGINE = Distributed('tracing', default, jaeger_index_local, xxHash64(traceID))",
+				"ENGINE = Distributed('tracing', default, jaeger_index_archive_local, xxHash64(traceID))",
+				"ENGINE = Distributed('tracing', default, jaeger_operations_local, cityHash64(service))",
+			},
+			expectedMissing: []string{"{cluster}"},
+		},
+		"update ttl replication": {
+			config: Configuration{
+				TTLDays:        7,
+				ServiceTTLDays: map[string]uint{"debug": 1},
+				Replication:    true,
+				UpdateTTL:      true,
+			},
+			expectedStatements: 14,
+			expectedContains: []string{
+				"ALTER TABLE jaeger_spans_local\nON CLUSTER '{cluster}'\n" +
+					"    ADD COLUMN IF NOT EXISTS service LowCardinality(String) CODEC (ZSTD(1)) AFTER traceID\n",
+				"ALTER TABLE jaeger_spans_local\nON CLUSTER '{cluster}'\n" +
+					"    MODIFY TTL timestamp + INTERVAL 1 DAY DELETE WHERE service = 'debug', " +
+					"timestamp + INTERVAL 7 DAY DELETE WHERE service NOT IN ('debug')",
+				"ALTER TABLE jaeger_index_local\nON CLUSTER '{cluster}'\n    MODIFY TTL",
+				"ALTER TABLE jaeger_spans_archive_local\nON CLUSTER '{cluster}'\n    MODIFY TTL timestamp + INTERVAL 7 DAY DELETE",
+				"ALTER TABLE jaeger_spans\nON CLUSTER '{cluster}'\n    ADD COLUMN IF NOT EXISTS service LowCardinality(String) AFTER traceID",
+				"ALTER TABLE `.inner.jaeger_operations_local`\nON CLUSTER '{cluster}'\n" +
+					"    MODIFY TTL date + INTERVAL 1 DAY DELETE WHERE service = 'debug', " +
+					"date + INTERVAL 7 DAY DELETE WHERE service NOT IN ('debug')",
+			},
+		},
+		"update ttl archive index": {
+			config:             Configuration{TTLDays: 7, ArchiveTTLDays: &archiveTTLDays, ArchiveIndex: true, UpdateTTL: true},
+			expectedStatements: 12,
+			expectedContains: []string{
+				"ALTER TABLE `.inner.jaeger_operations_local`\n\n    MODIFY TTL date + INTERVAL 7 DAY DELETE",
+				"ALTER TABLE `.inner.jaeger_operations_archive_local`\n\n    MODIFY TTL date + INTERVAL 365 DAY DELETE",
+			},
+		},
+		"update ttl removes ttl": {
+			config:             Configuration{UpdateTTL: true},
+			expectedStatements: 8,
+			expectedContains: []string{
+				"ALTER TABLE jaeger_spans_local\n\n    REMOVE TTL",
+				"ALTER TABLE `.inner.jaeger_operations_local`\n\n    REMOVE TTL",
+				"ALTER TABLE jaeger_index_local\n\n    REMOVE TTL",
+				"ALTER TABLE jaeger_spans_archive_local\n\n    REMOVE TTL",
+			},
+			expectedMissing: []string{"ADD COLUMN", "MODIFY TTL"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			statements := RenderSchema(test.config)
+			require.Len(t, statements, test.expectedStatements)
+			schema := strings.Join(statements, "\n")
+			for _, expected := range test.expectedContains {
+				assert.Contains(t, schema, expected)
+			}
+			for _, missing := range test.expectedMissing {
+				assert.NotContains(t, schema, missing)
+			}
+		})
+	}
+}
+
+func TestConnector_HTTPProxyAndHeaders(t *testing.T) {
+	var proxied []*http.Request
+	var mutex sync.Mutex
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		proxied = append(proxied, req)
+		mutex.Unlock()
+		http.Error(w, "Code: 516. DB::Exception: Authentication failed", http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	cfg := Configuration{
+		Address:     "clickhouse:8123",
+		Protocol:    HTTPProtocol,
+		HTTPProxy:   proxy.URL,
+		HTTPHeaders: map[string]string{"X-Api-Key": "secret"},
+	}
+	cfg.setDefaults()
+	_, err := connector(mocks.NewSpyLogger(), cfg, "write", []string{cfg.Address})
+	require.Error(t, err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.NotEmpty(t, proxied)
+	assert.Equal(t, "clickhouse:8123", proxied[0].Host)
+	assert.Equal(t, "secret", proxied[0].Header.Get("X-Api-Key"))
+}
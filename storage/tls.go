@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// clientTLS builds the TLS configurations of connections to ClickHouse addresses.
+// The CA and client certificates are reloaded on new connections when their files change.
+type clientTLS struct {
+	base  *tls.Config
+	files *tlsFiles
+	// verify verifies server certificates against the CA certificates of files
+	verify bool
+}
+
+// newClientTLS returns the TLS configuration of connections to ClickHouse, or nil if TLS is disabled
+func newClientTLS(logger hclog.Logger, cfg Configuration) (*clientTLS, error) {
+	if !cfg.TLS && cfg.CaFile == "" && cfg.CertFile == "" {
+		return nil, nil
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file must be set together")
+	}
+
+	base := &tls.Config{
+		ServerName: cfg.ServerName,
+		//nolint:gosec  , G402: TLS InsecureSkipVerify may be true, only for development
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.TLSMinVersion != "" {
+		version, ok := tlsVersions[cfg.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls_min_version %q, expected one of 1.0, 1.1, 1.2, 1.3", cfg.TLSMinVersion)
+		}
+		base.MinVersion = version
+	}
+
+	files := &tlsFiles{logger: logger, caFile: cfg.CaFile, certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+	if cfg.CertFile != "" {
+		base.GetClientCertificate = files.clientCertificate
+	}
+	verify := cfg.CaFile != "" && !cfg.InsecureSkipVerify
+	if verify {
+		// RootCAs cannot be replaced once the configuration is in use, so the server certificate is verified
+		// against the current CA certificates in VerifyConnection instead
+		//nolint:gosec  , G402: TLS InsecureSkipVerify set true, verified in VerifyConnection
+		base.InsecureSkipVerify = true
+	}
+	return &clientTLS{base: base, files: files, verify: verify}, nil
+}
+
+// config returns the TLS configuration of connections to address, verifying its host unless server_name is set
+func (c *clientTLS) config(address string) *tls.Config {
+	if c == nil {
+		return nil
+	}
+	config := c.base.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config.ServerName = host
+	}
+	if c.verify {
+		// The server name of the connection state is empty for IP addresses, which are not sent in SNI
+		config.VerifyConnection = c.files.verifier(config.ServerName)
+	}
+	return config
+}
+
+// tlsFiles holds the CA and client certificates loaded from files, and reloads them when the files change
+type tlsFiles struct {
+	logger   hclog.Logger
+	caFile   string
+	certFile string
+	keyFile  string
+
+	mutex    sync.Mutex
+	modTimes map[string]time.Time
+	roots    *x509.CertPool
+	cert     *tls.Certificate
+}
+
+func (f *tlsFiles) load() error {
+	modTimes, err := f.stat()
+	if err != nil {
+		return err
+	}
+
+	var roots *x509.CertPool
+	if f.caFile != "" {
+		caCert, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("could not parse any PEM certificate from ca_file %s", f.caFile)
+		}
+	}
+	var cert *tls.Certificate
+	if f.certFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return fmt.Errorf("could not load client certificate from cert_file %s and key_file %s: %w", f.certFile, f.keyFile, err)
+		}
+		cert = &keyPair
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.modTimes = modTimes
+	f.roots = roots
+	f.cert = cert
+	return nil
+}
+
+func (f *tlsFiles) stat() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{f.caFile, f.certFile, f.keyFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// reload loads the files again if any of them changed. Certificates that fail to load are logged,
+// and the previous ones are kept, since rotated files may be written one after another.
+func (f *tlsFiles) reload() {
+	modTimes, err := f.stat()
+	if err == nil && !f.changed(modTimes) {
+		return
+	}
+	if err == nil {
+		err = f.load()
+	}
+	if err != nil {
+		f.logger.Warn("Could not reload TLS certificates, using the previous ones", "error", err)
+		return
+	}
+	f.logger.Info("Reloaded TLS certificates")
+}
+
+func (f *tlsFiles) changed(modTimes map[string]time.Time) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for file, modTime := range modTimes {
+		if !modTime.Equal(f.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *tlsFiles) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.reload()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.cert, nil
+}
+
+// verifier returns a function verifying the certificate of serverName against the current CA certificates
+func (f *tlsFiles) verifier(serverName string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		f.reload()
+		f.mutex.Lock()
+		roots := f.roots
+		f.mutex.Unlock()
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
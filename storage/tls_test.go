@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+	return path
+}
+
+// newMutualTLSServer returns a server requiring client certificates signed by ca
+func newMutualTLSServer(t *testing.T, ca, server testCertificate) *httptest.Server {
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	httpServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	httpServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	httpServer.StartTLS()
+	return httpServer
+}
+
+func get(t *testing.T, config *tls.Config, url string) (string, error) {
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body := make([]byte, 64)
+	n, _ := resp.Body.Read(body)
+	return string(body[:n]), nil
+}
+
+func TestNewClientTLS_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	server := newMutualTLSServer(t, ca, newTestCertificate(t, "clickhouse", &ca))
+	defer server.Close()
+	client := newTestCertificate(t, "jaeger", &ca)
+
+	logger := mocks.NewSpyLogger()
+	clientTLS, err := newClientTLS(logger, Configuration{
+		CaFile:        writeFile(t, dir, "ca.pem", ca.certPEM),
+		CertFile:      writeFile(t, dir, "cert.pem", client.certPEM),
+		KeyFile:       writeFile(t, dir, "key.pem", client.keyPEM),
+		ServerName:    "clickhouse",
+		TLSMinVersion: "1.3",
+	})
+	require.NoError(t, err)
+	config := clientTLS.config(server.Listener.Addr().String())
+	assert.Equal(t, uint16(tls.VersionTLS13), config.MinVersion)
+
+	body, err := get(t, config, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "jaeger", body)
+	logger.AssertLogsEmpty(t)
+}
+
+func TestNewClientTLS_VerifyServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	otherCA := newTestCertificate(t, "other", nil)
+	server := newMutualTLSServer(t, ca, newTestCertificate(t, "clickhouse", &ca))
+	defer server.Close()
+	client := newTestCertificate(t, "jaeger", &ca)
+	certFile := writeFile(t, dir, "cert.pem", client.certPEM)
+	keyFile := writeFile(t, dir, "key.pem", client.keyPEM)
+
+	address := server.Listener.Addr().String()
+	tests := map[string]struct {
+		config      Configuration
+		address     string
+		expectedErr string
+	}{
+		"ip address": {
+			config:  Configuration{CaFile: writeFile(t, dir, "ca.pem", ca.certPEM)},
+			address: address,
+		},
+		"wrong host": {
+			config:      Configuration{CaFile: writeFile(t, dir, "ca.pem", ca.certPEM)},
+			address:     "127.0.0.2:9440",
+			expectedErr: "certificate is valid for 127.0.0.1, not 127.0.0.2",
+		},
+		"unknown authority": {
+			config:      Configuration{CaFile: writeFile(t, dir, "other.pem", otherCA.certPEM), ServerName: "clickhouse"},
+			expectedErr: "certificate signed by unknown authority",
+		},
+		"wrong server name": {
+			config:      Configuration{CaFile: writeFile(t, dir, "ca.pem", ca.certPEM), ServerName: "other"},
+			expectedErr: "certificate is valid for clickhouse, not other",
+		},
+		"insecure skip verify": {
+			config: Configuration{CaFile: writeFile(t, dir, "other.pem", otherCA.certPEM), InsecureSkipVerify: true},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.config.CertFile, test.config.KeyFile = certFile, keyFile
+			clientTLS, err := newClientTLS(mocks.NewSpyLogger(), test.config)
+			require.NoError(t, err)
+
+			_, err = get(t, clientTLS.config(test.address), server.URL)
+			if test.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+			}
+		})
+	}
+}
+
+func TestNewClientTLS_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	server := newMutualTLSServer(t, ca, newTestCertificate(t, "clickhouse", &ca))
+	defer server.Close()
+	client := newTestCertificate(t, "jaeger", &ca)
+	certFile := writeFile(t, dir, "cert.pem", client.certPEM)
+	keyFile := writeFile(t, dir, "key.pem", client.keyPEM)
+
+	logger := mocks.NewSpyLogger()
+	clientTLS, err := newClientTLS(logger, Configuration{
+		CaFile:     writeFile(t, dir, "ca.pem", ca.certPEM),
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "clickhouse",
+	})
+	require.NoError(t, err)
+	config := clientTLS.config(server.Listener.Addr().String())
+
+	// A half written rotation keeps the previous certificate
+	rotated := newTestCertificate(t, "jaeger-rotated", &ca)
+	writeFile(t, dir, "cert.pem", rotated.certPEM)
+	require.NoError(t, os.Chtimes(certFile, time.Now(), time.Now().Add(time.Minute)))
+	body, err := get(t, config, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "jaeger", body)
+
+	writeFile(t, dir, "key.pem", rotated.keyPEM)
+	require.NoError(t, os.Chtimes(keyFile, time.Now(), time.Now().Add(time.Minute)))
+	body, err = get(t, config, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "jaeger-rotated", body)
+
+	logger.AssertLogsOfLevelEqual(t, hclog.Info, []mocks.LogMock{{Msg: "Reloaded TLS certificates"}})
+}
+
+func TestNewClientTLS_Errors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	caFile := writeFile(t, dir, "ca.pem", ca.certPEM)
+	badFile := writeFile(t, dir, "bad.pem", []byte("not a certificate"))
+
+	tests := map[string]struct {
+		config      Configuration
+		expectedErr string
+	}{
+		"bad ca": {
+			config:      Configuration{CaFile: badFile},
+			expectedErr: "could not parse any PEM certificate from ca_file " + badFile,
+		},
+		"bad client certificate": {
+			config:      Configuration{CaFile: caFile, CertFile: badFile, KeyFile: badFile},
+			expectedErr: "could not load client certificate from cert_file " + badFile,
+		},
+		"missing key": {
+			config:      Configuration{CertFile: caFile},
+			expectedErr: "cert_file and key_file must be set together",
+		},
+		"missing ca": {
+			config:      Configuration{CaFile: filepath.Join(dir, "missing.pem")},
+			expectedErr: "no such file or directory",
+		},
+		"unknown version": {
+			config:      Configuration{TLS: true, TLSMinVersion: "1.4"},
+			expectedErr: `unknown tls_min_version "1.4"`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := newClientTLS(mocks.NewSpyLogger(), test.config)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.expectedErr)
+		})
+	}
+}
+
+func TestNewClientTLS_Disabled(t *testing.T) {
+	clientTLS, err := newClientTLS(mocks.NewSpyLogger(), Configuration{})
+	require.NoError(t, err)
+	assert.Nil(t, clientTLS.config("localhost:9440"))
+
+	clientTLS, err = newClientTLS(mocks.NewSpyLogger(), Configuration{TLS: true})
+	require.NoError(t, err)
+	assert.Equal(t, &tls.Config{ServerName: "localhost"}, clientTLS.config("localhost:9440"))
+}
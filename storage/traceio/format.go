@@ -0,0 +1,73 @@
+package traceio
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+type Format string
+
+const (
+	// FormatJaegerJSON is the JSON format returned by the Jaeger query API, which can be loaded in Jaeger UI.
+	FormatJaegerJSON Format = "jaeger"
+	// FormatOTLPJSON is the OTLP/JSON encoding of an ExportTraceServiceRequest.
+	FormatOTLPJSON Format = "otlp"
+)
+
+// ParseFormat returns the Format with the given name.
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case FormatJaegerJSON, FormatOTLPJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown trace file format %q, expected %q or %q", name, FormatJaegerJSON, FormatOTLPJSON)
+	}
+}
+
+// WriteTraces encodes traces to out in the given format.
+func WriteTraces(out io.Writer, format Format, traces []*model.Trace) error {
+	switch format {
+	case FormatJaegerJSON:
+		return writeJaegerJSON(out, traces)
+	case FormatOTLPJSON:
+		return writeOTLPJSON(out, traces)
+	default:
+		return fmt.Errorf("unknown trace file format %q", format)
+	}
+}
+
+// ReadTraces decodes traces from in in the given format.
+// The input may contain several concatenated or newline-delimited documents.
+// Spans are grouped into traces in the order their trace IDs first appear.
+func ReadTraces(in io.Reader, format Format) ([]*model.Trace, error) {
+	var (
+		spans []*model.Span
+		err   error
+	)
+	switch format {
+	case FormatJaegerJSON:
+		spans, err = readJaegerJSON(in)
+	case FormatOTLPJSON:
+		spans, err = readOTLPJSON(in)
+	default:
+		err = fmt.Errorf("unknown trace file format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	traces := make([]*model.Trace, 0)
+	byID := make(map[model.TraceID]*model.Trace)
+	for _, span := range spans {
+		trace, ok := byID[span.TraceID]
+		if !ok {
+			trace = &model.Trace{}
+			byID[span.TraceID] = trace
+			traces = append(traces, trace)
+		}
+		trace.Spans = append(trace.Spans, span)
+	}
+	return traces, nil
+}
@@ -0,0 +1,223 @@
+package traceio
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/jaegertracing/jaeger/model"
+	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+	uimodel "github.com/jaegertracing/jaeger/model/json"
+)
+
+// jaegerDocument mirrors the response of the Jaeger query API, e.g. /api/traces/{id}
+type jaegerDocument struct {
+	Data []*uimodel.Trace `json:"data"`
+}
+
+func writeJaegerJSON(out io.Writer, traces []*model.Trace) error {
+	document := jaegerDocument{Data: make([]*uimodel.Trace, 0, len(traces))}
+	for _, trace := range traces {
+		document.Data = append(document.Data, uiconv.FromDomain(trace))
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
+
+func readJaegerJSON(in io.Reader) ([]*model.Span, error) {
+	spans := make([]*model.Span, 0)
+	decoder := json.NewDecoder(in)
+	for {
+		var document json.RawMessage
+		if err := decoder.Decode(&document); err != nil {
+			if errors.Is(err, io.EOF) {
+				return spans, nil
+			}
+			return nil, err
+		}
+
+		var traces []*uimodel.Trace
+		documentDecoder := json.NewDecoder(bytes.NewReader(document))
+		// Keep integer tag values intact instead of decoding them as float64
+		documentDecoder.UseNumber()
+		if bytes.HasPrefix(bytes.TrimSpace(document), []byte("[")) {
+			// Plain list of traces, as saved by some tools
+			if err := documentDecoder.Decode(&traces); err != nil {
+				return nil, err
+			}
+		} else {
+			var wrapped jaegerDocument
+			if err := documentDecoder.Decode(&wrapped); err != nil {
+				return nil, err
+			}
+			traces = wrapped.Data
+		}
+
+		for _, trace := range traces {
+			traceSpans, err := jaegerTraceToDomain(trace)
+			if err != nil {
+				return nil, fmt.Errorf("could not convert trace %s: %w", trace.TraceID, err)
+			}
+			spans = append(spans, traceSpans...)
+		}
+	}
+}
+
+func jaegerTraceToDomain(trace *uimodel.Trace) ([]*model.Span, error) {
+	spans := make([]*model.Span, 0, len(trace.Spans))
+	for i := range trace.Spans {
+		jSpan := &trace.Spans[i]
+		jProcess := jSpan.Process
+		if jProcess == nil {
+			process, ok := trace.Processes[jSpan.ProcessID]
+			if !ok {
+				return nil, fmt.Errorf("span %s references unknown process %q", jSpan.SpanID, jSpan.ProcessID)
+			}
+			jProcess = &process
+		}
+		span, err := jaegerSpanToDomain(jSpan, jProcess)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert span %s: %w", jSpan.SpanID, err)
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+func jaegerSpanToDomain(jSpan *uimodel.Span, jProcess *uimodel.Process) (*model.Span, error) {
+	traceID, err := model.TraceIDFromString(string(jSpan.TraceID))
+	if err != nil {
+		return nil, err
+	}
+	spanID, err := model.SpanIDFromString(string(jSpan.SpanID))
+	if err != nil {
+		return nil, err
+	}
+	references, err := jaegerReferencesToDomain(jSpan, traceID)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := jaegerKeyValuesToDomain(jSpan.Tags)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]model.Log, 0, len(jSpan.Logs))
+	for _, jLog := range jSpan.Logs {
+		fields, err := jaegerKeyValuesToDomain(jLog.Fields)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, model.Log{
+			Timestamp: model.EpochMicrosecondsAsTime(jLog.Timestamp),
+			Fields:    fields,
+		})
+	}
+	processTags, err := jaegerKeyValuesToDomain(jProcess.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.Span{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: jSpan.OperationName,
+		References:    references,
+		Flags:         model.Flags(jSpan.Flags),
+		StartTime:     model.EpochMicrosecondsAsTime(jSpan.StartTime),
+		Duration:      model.MicrosecondsAsDuration(jSpan.Duration),
+		Tags:          tags,
+		Logs:          logs,
+		Process:       model.NewProcess(jProcess.ServiceName, processTags),
+		Warnings:      jSpan.Warnings,
+	}, nil
+}
+
+func jaegerReferencesToDomain(jSpan *uimodel.Span, traceID model.TraceID) ([]model.SpanRef, error) {
+	references := make([]model.SpanRef, 0, len(jSpan.References)+1)
+	for _, jReference := range jSpan.References {
+		refTraceID, err := model.TraceIDFromString(string(jReference.TraceID))
+		if err != nil {
+			return nil, err
+		}
+		refSpanID, err := model.SpanIDFromString(string(jReference.SpanID))
+		if err != nil {
+			return nil, err
+		}
+		refType := model.ChildOf
+		if jReference.RefType == uimodel.FollowsFrom {
+			refType = model.FollowsFrom
+		}
+		references = append(references, model.SpanRef{TraceID: refTraceID, SpanID: refSpanID, RefType: refType})
+	}
+	// ParentSpanID is deprecated, but still produced by older tools
+	if jSpan.ParentSpanID != "" && len(references) == 0 {
+		parentSpanID, err := model.SpanIDFromString(string(jSpan.ParentSpanID))
+		if err != nil {
+			return nil, err
+		}
+		references = append(references, model.NewChildOfRef(traceID, parentSpanID))
+	}
+	return references, nil
+}
+
+func jaegerKeyValuesToDomain(jKeyValues []uimodel.KeyValue) ([]model.KeyValue, error) {
+	keyValues := make([]model.KeyValue, 0, len(jKeyValues))
+	for _, jKeyValue := range jKeyValues {
+		keyValue, err := jaegerKeyValueToDomain(jKeyValue)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert tag %q: %w", jKeyValue.Key, err)
+		}
+		keyValues = append(keyValues, keyValue)
+	}
+	return keyValues, nil
+}
+
+func jaegerKeyValueToDomain(jKeyValue uimodel.KeyValue) (model.KeyValue, error) {
+	switch jKeyValue.Type {
+	case uimodel.StringType, "":
+		value, ok := jKeyValue.Value.(string)
+		if !ok {
+			value = fmt.Sprint(jKeyValue.Value)
+		}
+		return model.String(jKeyValue.Key, value), nil
+	case uimodel.BoolType:
+		switch value := jKeyValue.Value.(type) {
+		case bool:
+			return model.Bool(jKeyValue.Key, value), nil
+		case string:
+			parsed, err := strconv.ParseBool(value)
+			return model.Bool(jKeyValue.Key, parsed), err
+		}
+	case uimodel.Int64Type:
+		switch value := jKeyValue.Value.(type) {
+		case json.Number:
+			parsed, err := value.Int64()
+			return model.Int64(jKeyValue.Key, parsed), err
+		case string:
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			return model.Int64(jKeyValue.Key, parsed), err
+		}
+	case uimodel.Float64Type:
+		switch value := jKeyValue.Value.(type) {
+		case json.Number:
+			parsed, err := value.Float64()
+			return model.Float64(jKeyValue.Key, parsed), err
+		case string:
+			parsed, err := strconv.ParseFloat(value, 64)
+			return model.Float64(jKeyValue.Key, parsed), err
+		}
+	case uimodel.BinaryType:
+		if value, ok := jKeyValue.Value.(string); ok {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			return model.Binary(jKeyValue.Key, decoded), err
+		}
+	default:
+		return model.KeyValue{}, fmt.Errorf("unknown value type %q", jKeyValue.Type)
+	}
+	return model.KeyValue{}, fmt.Errorf("unexpected value %v for type %q", jKeyValue.Value, jKeyValue.Type)
+}
@@ -0,0 +1,59 @@
+package traceio
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/jaegertracing/jaeger/model"
+	jaegertranslator "github.com/open-telemetry/opentelemetry-collector-contrib/pkg/translator/jaeger"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func writeOTLPJSON(out io.Writer, traces []*model.Trace) error {
+	batches := make([]*model.Batch, 0, len(traces))
+	for _, trace := range traces {
+		batches = append(batches, &model.Batch{Spans: trace.Spans})
+	}
+	otlpTraces, err := jaegertranslator.ProtoToTraces(batches)
+	if err != nil {
+		return err
+	}
+	serialized, err := ptrace.NewJSONMarshaler().MarshalTraces(otlpTraces)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(serialized, '\n'))
+	return err
+}
+
+func readOTLPJSON(in io.Reader) ([]*model.Span, error) {
+	spans := make([]*model.Span, 0)
+	unmarshaler := ptrace.NewJSONUnmarshaler()
+	decoder := json.NewDecoder(in)
+	for {
+		var document json.RawMessage
+		if err := decoder.Decode(&document); err != nil {
+			if errors.Is(err, io.EOF) {
+				return spans, nil
+			}
+			return nil, err
+		}
+		otlpTraces, err := unmarshaler.UnmarshalTraces(document)
+		if err != nil {
+			return nil, err
+		}
+		batches, err := jaegertranslator.ProtoFromTraces(otlpTraces)
+		if err != nil {
+			return nil, err
+		}
+		for _, batch := range batches {
+			for _, span := range batch.Spans {
+				if span.Process == nil {
+					span.Process = batch.Process
+				}
+				spans = append(spans, span)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package traceio
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// ExportTraceIDs fetches the given traces from reader and writes them to out in the given format.
+// It returns the number of exported traces.
+func ExportTraceIDs(ctx context.Context, reader spanstore.Reader, traceIDs []model.TraceID, out io.Writer, format Format) (int, error) {
+	traces := make([]*model.Trace, 0, len(traceIDs))
+	for _, traceID := range traceIDs {
+		trace, err := reader.GetTrace(ctx, traceID)
+		if err != nil {
+			return 0, fmt.Errorf("could not get trace %s: %w", traceID, err)
+		}
+		traces = append(traces, trace)
+	}
+	return len(traces), WriteTraces(out, format, traces)
+}
+
+// ExportQuery finds traces matching query in reader and writes them to out in the given format.
+// It returns the number of exported traces.
+func ExportQuery(ctx context.Context, reader spanstore.Reader, query *spanstore.TraceQueryParameters, out io.Writer, format Format) (int, error) {
+	traces, err := reader.FindTraces(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("could not find traces: %w", err)
+	}
+	return len(traces), WriteTraces(out, format, traces)
+}
+
+// Import reads traces from in and writes every span with writer.
+// It returns the number of written spans.
+// Writers which batch spans, like SpanWriter, have to be closed to ensure all spans were flushed.
+func Import(ctx context.Context, in io.Reader, format Format, writer spanstore.Writer) (int, error) {
+	traces, err := ReadTraces(in, format)
+	if err != nil {
+		return 0, fmt.Errorf("could not read traces: %w", err)
+	}
+	written := 0
+	for _, trace := range traces {
+		for _, span := range trace.Spans {
+			if err := writer.WriteSpan(ctx, span); err != nil {
+				return written, fmt.Errorf("could not write span %s of trace %s: %w", span.SpanID, span.TraceID, err)
+			}
+			written++
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,173 @@
+package traceio
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/memory"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testStartTime = time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	testTraceID   = model.NewTraceID(1, 2)
+	testProcess   = model.NewProcess("test_service", []model.KeyValue{model.String("test_process_key", "test_process_value")})
+	testRootSpan  = &model.Span{
+		TraceID:       testTraceID,
+		SpanID:        model.NewSpanID(3),
+		OperationName: "GET /unit_test",
+		StartTime:     testStartTime,
+		Duration:      time.Second,
+		Process:       testProcess,
+		Tags: []model.KeyValue{
+			model.String("test_string_key", "test_string_value"),
+			model.Int64("test_int64_key", 1<<60+1),
+			model.Float64("test_float64_key", 0.5),
+			model.Bool("test_bool_key", true),
+			model.Binary("test_binary_key", []byte{0, 1, 2}),
+		},
+		Logs: []model.Log{{Timestamp: testStartTime, Fields: []model.KeyValue{model.String("event", "test_log_value")}}},
+	}
+	testChildSpan = &model.Span{
+		TraceID:       testTraceID,
+		SpanID:        model.NewSpanID(4),
+		OperationName: "SELECT",
+		References:    []model.SpanRef{model.NewChildOfRef(testTraceID, model.NewSpanID(3))},
+		StartTime:     testStartTime.Add(time.Millisecond),
+		Duration:      time.Millisecond,
+		Process:       testProcess,
+		Tags:          []model.KeyValue{model.String("test_string_key", "test_string_value")},
+	}
+)
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("otlp")
+	require.NoError(t, err)
+	assert.Equal(t, FormatOTLPJSON, format)
+
+	_, err = ParseFormat("zipkin")
+	assert.Error(t, err)
+}
+
+func TestExportImport_RoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatJaegerJSON, FormatOTLPJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			ctx := context.Background()
+			source := memory.NewStore()
+			require.NoError(t, source.WriteSpan(ctx, testRootSpan))
+			require.NoError(t, source.WriteSpan(ctx, testChildSpan))
+
+			var exported bytes.Buffer
+			count, err := ExportTraceIDs(ctx, source, []model.TraceID{testTraceID}, &exported, format)
+			require.NoError(t, err)
+			assert.Equal(t, 1, count)
+
+			destination := memory.NewStore()
+			count, err = Import(ctx, &exported, format, destination)
+			require.NoError(t, err)
+			assert.Equal(t, 2, count)
+
+			trace, err := destination.GetTrace(ctx, testTraceID)
+			require.NoError(t, err)
+			require.Len(t, trace.Spans, 2)
+			spans := map[model.SpanID]*model.Span{}
+			for _, span := range trace.Spans {
+				spans[span.SpanID] = span
+			}
+			root := spans[testRootSpan.SpanID]
+			require.NotNil(t, root)
+			assert.Equal(t, testRootSpan.OperationName, root.OperationName)
+			assert.True(t, testRootSpan.StartTime.Equal(root.StartTime))
+			assert.Equal(t, testRootSpan.Duration, root.Duration)
+			assert.Equal(t, testProcess.ServiceName, root.Process.ServiceName)
+			for _, tag := range testRootSpan.Tags {
+				if format == FormatOTLPJSON && tag.VType == model.BinaryType {
+					// The OTLP translator stores binary values as base64 strings
+					continue
+				}
+				actual, ok := model.KeyValues(root.Tags).FindByKey(tag.Key)
+				if assert.True(t, ok, tag.Key) {
+					assert.Equal(t, tag, actual)
+				}
+			}
+			child := spans[testChildSpan.SpanID]
+			require.NotNil(t, child)
+			assert.Equal(t, testRootSpan.SpanID, child.ParentSpanID())
+		})
+	}
+}
+
+func TestExportQuery(t *testing.T) {
+	ctx := context.Background()
+	source := memory.NewStore()
+	require.NoError(t, source.WriteSpan(ctx, testRootSpan))
+
+	var exported bytes.Buffer
+	count, err := ExportQuery(ctx, source, &spanstore.TraceQueryParameters{
+		ServiceName:  testProcess.ServiceName,
+		StartTimeMin: testStartTime.Add(-time.Hour),
+		StartTimeMax: testStartTime.Add(time.Hour),
+		NumTraces:    10,
+	}, &exported, FormatJaegerJSON)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Contains(t, exported.String(), testTraceID.String())
+}
+
+func TestExportTraceIDs_NotFound(t *testing.T) {
+	var exported bytes.Buffer
+	_, err := ExportTraceIDs(context.Background(), memory.NewStore(), []model.TraceID{testTraceID}, &exported, FormatJaegerJSON)
+	assert.ErrorIs(t, err, spanstore.ErrTraceNotFound)
+}
+
+func TestReadTraces_JaegerJSON(t *testing.T) {
+	tests := map[string]struct {
+		input         string
+		expectedSpans int
+		expectedError string
+	}{
+		"embedded process and parent span ID": {
+			input: `[{"traceID":"1","spans":[{"traceID":"1","spanID":"2","parentSpanID":"1","operationName":"op",` +
+				`"startTime":1,"duration":1,"tags":[{"key":"k","type":"int64","value":"42"}],"process":{"serviceName":"svc"}}]}]`,
+			expectedSpans: 1,
+		},
+		"concatenated documents": {
+			input: `{"data":[{"traceID":"1","spans":[{"traceID":"1","spanID":"2","operationName":"op","processID":"p1"}],` +
+				`"processes":{"p1":{"serviceName":"svc"}}}]}` + "\n" +
+				`{"data":[{"traceID":"2","spans":[{"traceID":"2","spanID":"3","operationName":"op","processID":"p1"}],` +
+				`"processes":{"p1":{"serviceName":"svc"}}}]}`,
+			expectedSpans: 2,
+		},
+		"unknown process": {
+			input:         `{"data":[{"traceID":"1","spans":[{"traceID":"1","spanID":"2","processID":"p2"}],"processes":{}}]}`,
+			expectedError: `could not convert trace 1: span 2 references unknown process "p2"`,
+		},
+		"unknown value type": {
+			input: `{"data":[{"traceID":"1","spans":[{"traceID":"1","spanID":"2","processID":"p1",` +
+				`"tags":[{"key":"k","type":"uint8","value":1}]}],"processes":{"p1":{"serviceName":"svc"}}}]}`,
+			expectedError: `could not convert trace 1: could not convert span 2: could not convert tag "k": unknown value type "uint8"`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			traces, err := ReadTraces(strings.NewReader(test.input), FormatJaegerJSON)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			spans := 0
+			for _, trace := range traces {
+				spans += len(trace.Spans)
+			}
+			assert.Equal(t, test.expectedSpans, spans)
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	hclog "github.com/hashicorp/go-hclog"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+// ValidationError lists all problems of an invalid configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+type validation struct {
+	problems []string
+}
+
+func (v *validation) addf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validation) nonNegative(key string, value int64) {
+	if value < 0 {
+		v.addf("%s must not be negative, got %d", key, value)
+	}
+}
+
+func (v *validation) oneOf(key string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.addf("unknown %s %q, expected one of %s", key, value, strings.Join(allowed, ", "))
+}
+
+func (v *validation) rate(key string, rate float64) {
+	if rate < 0 || rate > 1 {
+		v.addf("%s must be between 0 and 1, got %v", key, rate)
+	}
+}
+
+func (v *validation) err() error {
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// Validate checks the configuration with its defaults applied, and returns a *ValidationError listing every problem
+func (cfg Configuration) Validate() error {
+	v := &validation{}
+	cfg.validateConnectionAndWriting(v)
+	cfg.validateSchema(v)
+	return v.err()
+}
+
+// ValidateSchema checks only the rules of the configuration which affect the rendered schema, so the schema
+// can be rendered offline from a configuration without connection settings
+func (cfg Configuration) ValidateSchema() error {
+	v := &validation{}
+	cfg.validateSchema(v)
+	return v.err()
+}
+
+func (cfg Configuration) validateConnectionAndWriting(v *validation) {
+	cfg.setDefaults()
+
+	if cfg.Address == "" && len(cfg.Addresses) == 0 {
+		v.addf("address or addresses must be set")
+	}
+	v.oneOf("encoding", string(cfg.Encoding), string(JSONEncoding), string(ProtobufEncoding))
+	v.oneOf("protocol", string(cfg.Protocol), string(NativeProtocol), string(HTTPProtocol))
+	v.oneOf("connection_strategy", string(cfg.ConnectionStrategy),
+		string(ConnectionInOrder), string(ConnectionRoundRobin), string(ConnectionRandom))
+	if cfg.FailedAddressBackoff < 0 {
+		v.addf("failed_address_backoff must not be negative, got %s", cfg.FailedAddressBackoff)
+	}
+	if cfg.Protocol != HTTPProtocol && (cfg.HTTPProxy != "" || len(cfg.HTTPHeaders) > 0) {
+		v.addf("http_proxy and http_headers require protocol http")
+	}
+	if cfg.HTTPProxy != "" {
+		if _, err := url.Parse(cfg.HTTPProxy); err != nil {
+			v.addf("could not parse http_proxy: %s", err)
+		}
+	}
+
+	v.nonNegative("batch_write_size", cfg.BatchWriteSize)
+	v.nonNegative("min_batch_write_size", cfg.MinBatchWriteSize)
+	v.nonNegative("max_batch_write_size", cfg.MaxBatchWriteSize)
+	if cfg.BatchFlushInterval < 0 || cfg.MinBatchFlushInterval < 0 || cfg.MaxBatchFlushInterval < 0 {
+		v.addf("batch_flush_interval, min_batch_flush_interval and max_batch_flush_interval must not be negative")
+	}
+	if cfg.AdaptiveBatching {
+		if cfg.MinBatchWriteSize > cfg.BatchWriteSize || cfg.BatchWriteSize > cfg.MaxBatchWriteSize {
+			v.addf("batch_write_size %d must be between min_batch_write_size %d and max_batch_write_size %d",
+				cfg.BatchWriteSize, cfg.MinBatchWriteSize, cfg.MaxBatchWriteSize)
+		}
+		if cfg.MinBatchFlushInterval > cfg.BatchFlushInterval || cfg.BatchFlushInterval > cfg.MaxBatchFlushInterval {
+			v.addf("batch_flush_interval %s must be between min_batch_flush_interval %s and max_batch_flush_interval %s",
+				cfg.BatchFlushInterval, cfg.MinBatchFlushInterval, cfg.MaxBatchFlushInterval)
+		}
+	}
+	v.nonNegative("max_span_count", int64(cfg.MaxSpanCount))
+	v.nonNegative("max_pending_bytes", cfg.MaxPendingBytes)
+	v.nonNegative("ready_max_pending_spans", int64(cfg.ReadyMaxPendingSpans))
+	v.nonNegative("max_tag_value_length", int64(cfg.MaxTagValueLength))
+	v.nonNegative("max_tags_per_span", int64(cfg.MaxTagsPerSpan))
+	v.nonNegative("max_logs_per_span", int64(cfg.MaxLogsPerSpan))
+	v.nonNegative("max_span_bytes", int64(cfg.MaxSpanBytes))
+	if cfg.MaxOpenConns != nil && cfg.MaxIdleConns != nil && *cfg.MaxOpenConns > 0 && *cfg.MaxIdleConns > *cfg.MaxOpenConns {
+		v.addf("max_idle_conns %d must not exceed max_open_conns %d", *cfg.MaxIdleConns, *cfg.MaxOpenConns)
+	}
+
+	if _, err := clickhousespanstore.NewRedactor(cfg.Redaction); err != nil {
+		v.addf("%s", err)
+	}
+	if cfg.Sampling.Rate != nil {
+		v.rate("sampling.rate", *cfg.Sampling.Rate)
+	}
+	for _, service := range sortedKeys(cfg.Sampling.ServiceRates) {
+		v.rate(fmt.Sprintf("sampling.service_rates of %s", service), cfg.Sampling.ServiceRates[service])
+	}
+	if cfg.Sampling.ServiceRateLimit < 0 || cfg.Sampling.TenantRateLimit < 0 {
+		v.addf("sampling.service_rate_limit and sampling.tenant_rate_limit must not be negative")
+	}
+	for _, service := range sortedKeys(cfg.Sampling.ServiceRateLimits) {
+		if cfg.Sampling.ServiceRateLimits[service] < 0 {
+			v.addf("sampling.service_rate_limits of %s must not be negative", service)
+		}
+	}
+
+	if cfg.GetLogLevel() == hclog.NoLevel {
+		v.addf("unknown log_level %q, expected one of trace, debug, info, warn, error, off", cfg.LogLevel)
+	}
+	if cfg.Password != "" && cfg.PasswordFile != "" {
+		v.addf("password and password_file must not be set together")
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		v.addf("cert_file and key_file must be set together")
+	}
+	if cfg.TLSMinVersion != "" {
+		if _, ok := tlsVersions[cfg.TLSMinVersion]; !ok {
+			v.addf("unknown tls_min_version %q, expected one of 1.0, 1.1, 1.2, 1.3", cfg.TLSMinVersion)
+		}
+	}
+}
+
+func (cfg Configuration) validateSchema(v *validation) {
+	tables := 0
+	for _, table := range []clickhousespanstore.TableName{cfg.SpansTable, cfg.SpansIndexTable, cfg.OperationsTable} {
+		if table != "" {
+			tables++
+		}
+	}
+	cfg.setDefaults()
+
+	if cfg.onCluster() && tables != 0 && tables != 3 {
+		// Defaults of the other tables would not match custom tables, e.g. distributed tables over other local tables
+		v.addf("spans_table, spans_index_table and operations_table must be set together with replication or sharding")
+	}
+	if len(cfg.TenantTTLDays) > 0 && cfg.Tenant == "" {
+		v.addf("tenant_ttl requires tenant")
+	}
+	if cfg.MoveAfterDays > 0 && cfg.getMoveTo() == "" {
+		v.addf("move_after_days requires move_to_volume or move_to_disk")
+	}
+	if cfg.MoveAfterDays == 0 && cfg.getMoveTo() != "" {
+		v.addf("move_to_volume and move_to_disk require move_after_days")
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+func TestConfiguration_Validate(t *testing.T) {
+	negative := -0.5
+	maxOpenConns, maxIdleConns := uint(2), uint(5)
+	tests := map[string]struct {
+		cfg              Configuration
+		expectedProblems []string
+	}{
+		"defaults": {
+			cfg: Configuration{Address: "localhost:9000"},
+		},
+		"custom tables with replication": {
+			cfg: Configuration{
+				Address:         "localhost:9000",
+				Replication:     true,
+				SpansTable:      "spans",
+				SpansIndexTable: "index",
+				OperationsTable: "operations",
+			},
+		},
+		"types": {
+			cfg: Configuration{
+				Encoding:           "xml",
+				Protocol:           "grpc",
+				ConnectionStrategy: "fastest",
+				TLSMinVersion:      "1.4",
+			},
+			expectedProblems: []string{
+				"address or addresses must be set",
+				`unknown encoding "xml", expected one of json, protobuf`,
+				`unknown protocol "grpc", expected one of native, http`,
+				`unknown connection_strategy "fastest", expected one of in_order, round_robin, random`,
+				`unknown tls_min_version "1.4", expected one of 1.0, 1.1, 1.2, 1.3`,
+			},
+		},
+		"ranges": {
+			cfg: Configuration{
+				Addresses:            []string{"localhost:9000"},
+				BatchWriteSize:       -1,
+				FailedAddressBackoff: -time.Second,
+				MaxSpanCount:         -1,
+				MaxSpanBytes:         -1,
+				MaxOpenConns:         &maxOpenConns,
+				MaxIdleConns:         &maxIdleConns,
+			},
+			expectedProblems: []string{
+				"failed_address_backoff must not be negative, got -1s",
+				"batch_write_size must not be negative, got -1",
+				"max_batch_write_size must not be negative, got -10",
+				"max_span_count must not be negative, got -1",
+				"max_span_bytes must not be negative, got -1",
+				"max_idle_conns 5 must not exceed max_open_conns 2",
+			},
+		},
+		"rules": {
+			cfg: Configuration{
+				Address: "localhost:9000",
+				Redaction: clickhousespanstore.RedactionRules{
+					Masks: []clickhousespanstore.MaskRule{{Pattern: "("}},
+				},
+				Sampling: clickhousespanstore.SamplingRules{
+					Rate:              &negative,
+					ServiceRates:      map[string]float64{"frontend": 2},
+					ServiceRateLimits: map[string]float64{"frontend": -1},
+				},
+			},
+			expectedProblems: []string{
+				"could not compile redaction mask \"(\": error parsing regexp: missing closing ): `(`",
+				"sampling.rate must be between 0 and 1, got -0.5",
+				"sampling.service_rates of frontend must be between 0 and 1, got 2",
+				"sampling.service_rate_limits of frontend must not be negative",
+			},
+		},
+		"cross fields": {
+			cfg: Configuration{
+				Address:           "localhost:9000",
+				HTTPProxy:         "http://proxy:3128",
+				AdaptiveBatching:  true,
+				BatchWriteSize:    100,
+				MinBatchWriteSize: 200,
+				Password:          "secret",
+				PasswordFile:      "/run/secrets/password",
+				CertFile:          "cert.pem",
+				Replication:       true,
+				SpansTable:        "spans",
+				TenantTTLDays:     map[string]uint{"a": 1},
+				MoveToDisk:        "cold",
+			},
+			expectedProblems: []string{
+				"http_proxy and http_headers require protocol http",
+				"batch_write_size 100 must be between min_batch_write_size 200 and max_batch_write_size 1000",
+				"password and password_file must not be set together",
+				"cert_file and key_file must be set together",
+				"spans_table, spans_index_table and operations_table must be set together with replication or sharding",
+				"tenant_ttl requires tenant",
+				"move_to_volume and move_to_disk require move_after_days",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.cfg.Validate()
+			if test.expectedProblems == nil {
+				assert.NoError(t, err)
+				return
+			}
+			var validationErr *ValidationError
+			require.ErrorAs(t, err, &validationErr)
+			assert.Equal(t, test.expectedProblems, validationErr.Problems)
+		})
+	}
+}
+
+func TestConfiguration_ValidateSchema(t *testing.T) {
+	// Connection settings are not needed to render the schema
+	assert.NoError(t, Configuration{Password: "secret", PasswordFile: "/run/secrets/password", CertFile: "cert.pem"}.ValidateSchema())
+
+	err := Configuration{Replication: true, SpansTable: "spans", MoveAfterDays: 7}.ValidateSchema()
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, []string{
+		"spans_table, spans_index_table and operations_table must be set together with replication or sharding",
+		"move_after_days requires move_to_volume or move_to_disk",
+	}, validationErr.Problems)
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+)
+
+const volumeQueryTimeout = 10 * time.Second
+
+var tableVolumeBytes = prometheus.NewDesc(
+	"jaeger_clickhouse_table_volume_bytes",
+	"Size in bytes of the active parts of a table on a volume of its storage policy",
+	[]string{"table", "volume"},
+	nil,
+)
+
+// volumeCollector reports the size of tables on each volume from system.parts when scraped
+type volumeCollector struct {
+	logger   hclog.Logger
+	db       *sql.DB
+	database string
+	tables   []clickhousespanstore.TableName
+}
+
+var _ prometheus.Collector = (*volumeCollector)(nil)
+
+func newVolumeCollector(logger hclog.Logger, db *sql.DB, cfg Configuration) *volumeCollector {
+	tables := []clickhousespanstore.TableName{cfg.SpansTable, cfg.SpansIndexTable, cfg.GetSpansArchiveTable()}
+	if cfg.ArchiveIndex {
+		tables = append(tables, cfg.GetSpansArchiveIndexTable())
+	}
+	if *cfg.Sharding {
+		// Parts belong to the local tables
+		for i := range tables {
+			tables[i] = tables[i].ToLocal()
+		}
+	}
+	return &volumeCollector{
+		logger:   logger,
+		db:       db,
+		database: cfg.Database,
+		tables:   tables,
+	}
+}
+
+func (c *volumeCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- tableVolumeBytes
+}
+
+func (c *volumeCollector) Collect(metrics chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), volumeQueryTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(
+		`SELECT parts.table, volumes.volume_name, sum(parts.bytes_on_disk)
+FROM system.parts AS parts
+INNER JOIN system.tables AS tables ON tables.database = parts.database AND tables.name = parts.table
+INNER JOIN (SELECT policy_name, volume_name, arrayJoin(disks) AS disk FROM system.storage_policies) AS volumes
+    ON volumes.policy_name = tables.storage_policy AND volumes.disk = parts.disk_name
+WHERE parts.active AND parts.database = ? AND parts.table IN (%s)
+GROUP BY parts.table, volumes.volume_name`,
+		"?"+strings.Repeat(", ?", len(c.tables)-1),
+	)
+	args := []interface{}{c.database}
+	for _, table := range c.tables {
+		args = append(args, string(table))
+	}
+
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		c.logger.Error("Could not query the size of tables on volumes", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			table  string
+			volume string
+			bytes  uint64
+		)
+		if err := rows.Scan(&table, &volume, &bytes); err != nil {
+			c.logger.Error("Could not read the size of tables on volumes", "error", err)
+			return
+		}
+		metrics <- prometheus.MustNewConstMetric(tableVolumeBytes, prometheus.GaugeValue, float64(bytes), table, volume)
+	}
+	if err := rows.Err(); err != nil {
+		c.logger.Error("Could not read the size of tables on volumes", "error", err)
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/mocks"
+)
+
+const volumesQuery = `SELECT parts.table, volumes.volume_name, sum(parts.bytes_on_disk)
+FROM system.parts AS parts
+INNER JOIN system.tables AS tables ON tables.database = parts.database AND tables.name = parts.table
+INNER JOIN (SELECT policy_name, volume_name, arrayJoin(disks) AS disk FROM system.storage_policies) AS volumes
+    ON volumes.policy_name = tables.storage_policy AND volumes.disk = parts.disk_name
+WHERE parts.active AND parts.database = ? AND parts.table IN (?, ?, ?)
+GROUP BY parts.table, volumes.volume_name`
+
+func TestVolumeCollector_Collect(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	cfg := Configuration{Replication: true, Database: "jaeger", StoragePolicy: "tiered"}
+	cfg.setDefaults()
+
+	mock.ExpectQuery(volumesQuery).
+		WithArgs("jaeger", "jaeger_spans_local", "jaeger_index_local", "jaeger_spans_archive_local").
+		WillReturnRows(sqlmock.NewRows([]string{"table", "volume_name", "bytes"}).
+			AddRow("jaeger_spans_local", "hot", uint64(1000)).
+			AddRow("jaeger_spans_local", "cold", uint64(5000)))
+
+	logger := mocks.NewSpyLogger()
+	collector := newVolumeCollector(logger, db, cfg)
+	expected := `
+# HELP jaeger_clickhouse_table_volume_bytes Size in bytes of the active parts of a table on a volume of its storage policy
+# TYPE jaeger_clickhouse_table_volume_bytes gauge
+jaeger_clickhouse_table_volume_bytes{table="jaeger_spans_local",volume="cold"} 5000
+jaeger_clickhouse_table_volume_bytes{table="jaeger_spans_local",volume="hot"} 1000
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	logger.AssertLogsEmpty(t)
+}
+
+func TestVolumeCollector_CollectQueryError(t *testing.T) {
+	db, mock, err := mocks.GetDbMock()
+	require.NoError(t, err, "an error was not expected when opening a stub database connection")
+	defer db.Close()
+
+	cfg := Configuration{Database: "jaeger"}
+	cfg.setDefaults()
+
+	mock.ExpectQuery(volumesQuery).
+		WithArgs("jaeger", "jaeger_spans_local", "jaeger_index_local", "jaeger_spans_archive_local").
+		WillReturnError(errorMock)
+
+	logger := mocks.NewSpyLogger()
+	collector := newVolumeCollector(logger, db, cfg)
+	assert.Equal(t, 0, testutil.CollectAndCount(collector))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	logger.AssertLogsOfLevelEqual(t, hclog.Error, []mocks.LogMock{
+		{Msg: "Could not query the size of tables on volumes", Args: []interface{}{"error", errorMock}},
+	})
+}